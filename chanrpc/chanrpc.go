@@ -1,10 +1,12 @@
 package chanrpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
+	"time"
 
 	"github.com/yinyihanbing/gserv/conf"
 	"github.com/yinyihanbing/gutils/logs"
@@ -19,15 +21,20 @@ type Server struct {
 	// func(args []any)
 	// func(args []any) any
 	// func(args []any) []any
+	// typed function registered by Register
 	functions map[any]any
 	ChanCall  chan *CallInfo
+	metrics   *metrics
 }
 
 type CallInfo struct {
+	id      any
 	f       any
 	args    []any
 	chanRet chan *RetInfo
 	cb      any
+	ctx     context.Context
+	enqueue time.Time
 }
 
 type RetInfo struct {
@@ -100,10 +107,18 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 				err = fmt.Errorf("%v", r)
 			}
 
+			if s.metrics != nil {
+				s.metrics.panic(ci.id)
+			}
 			s.ret(ci, &RetInfo{err: fmt.Errorf("%v", r)})
 		}
 	}()
 
+	// the caller already gave up
+	if ci.ctx != nil && ci.ctx.Err() != nil {
+		return s.ret(ci, &RetInfo{err: canceledErr(ci.ctx)})
+	}
+
 	// execute
 	switch ci.f.(type) {
 	case func([]any):
@@ -115,6 +130,9 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 	case func([]any) []any:
 		ret := ci.f.(func([]any) []any)(ci.args)
 		return s.ret(ci, &RetInfo{ret: ret})
+	case typedFunc:
+		ret, err := ci.f.(typedFunc).call(ci.args)
+		return s.ret(ci, &RetInfo{ret: ret, err: err})
 	default:
 		vs := make([]reflect.Value, len(ci.args))
 		for k, v := range ci.args {
@@ -126,6 +144,11 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 }
 
 func (s *Server) Exec(ci *CallInfo) {
+	if s.metrics != nil {
+		s.metrics.exec(s, ci)
+		return
+	}
+
 	err := s.exec(ci)
 	if err != nil {
 		logs.Error("%v", err)
@@ -146,10 +169,15 @@ func (s *Server) Go(id any, args ...any) {
 		recover()
 	}()
 
-	s.ChanCall <- &CallInfo{
+	ci := &CallInfo{
+		id:   id,
 		f:    f,
 		args: args,
 	}
+	if s.metrics != nil {
+		ci.enqueue = time.Now()
+	}
+	s.ChanCall <- ci
 }
 
 // goroutine safe
@@ -202,7 +230,17 @@ func (c *Client) call(ci *CallInfo, block bool) (err error) {
 		}
 	}()
 
-	if block {
+	if c.s.metrics != nil {
+		ci.enqueue = time.Now()
+	}
+
+	if block && ci.ctx != nil {
+		select {
+		case c.s.ChanCall <- ci:
+		case <-ci.ctx.Done():
+			err = canceledErr(ci.ctx)
+		}
+	} else if block {
 		c.s.ChanCall <- ci
 	} else {
 		select {
@@ -226,6 +264,11 @@ func (c *Client) f(id any, n int) (f any, err error) {
 		return
 	}
 
+	// typed functions return a single value
+	if _, typed := f.(typedFunc); typed && n != 2 {
+		return
+	}
+
 	var ok bool
 	switch n {
 	case 0:
@@ -251,6 +294,7 @@ func (c *Client) Call0(id any, args ...any) error {
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -270,6 +314,7 @@ func (c *Client) Call1(id any, args ...any) (any, error) {
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -289,6 +334,7 @@ func (c *Client) CallN(id any, args ...any) ([]any, error) {
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -308,6 +354,7 @@ func (c *Client) asynCall(id any, args []any, cb any, n int) {
 		return
 	}
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.ChanAsynRet,
@@ -326,27 +373,55 @@ func (c *Client) AsynCall(id any, _args ...any) {
 
 	args := _args[:len(_args)-1]
 	cb := _args[len(_args)-1]
+	n := cbRetNum(cb)
 
-	var n int
-	switch cb.(type) {
-	case func(error):
-		n = 0
-	case func(any, error):
-		n = 1
-	case func([]any, error):
-		n = 2
-	default:
-		panic("definition of callback function is invalid")
+	// too many calls
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
+		return
 	}
 
+	c.asynCall(id, args, cb, n)
+	c.pendingAsynCall++
+}
+
+// AsynCallFunc runs call on its own goroutine and delivers the result to the callback like AsynCall,
+// it lets a client wait for work done outside of a chanrpc server, e.g. a cluster call.
+// call must return nil, any or []any matching the callback
+func (c *Client) AsynCallFunc(call func() (any, error), cb any) {
+	cbRetNum(cb)
+
 	// too many calls
 	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
 		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
 		return
 	}
 
-	c.asynCall(id, args, cb, n)
 	c.pendingAsynCall++
+	go func() {
+		ri := &RetInfo{cb: cb}
+		defer func() {
+			if r := recover(); r != nil {
+				ri.ret, ri.err = nil, fmt.Errorf("%v", r)
+			}
+			c.ChanAsynRet <- ri
+		}()
+		ri.ret, ri.err = call()
+	}()
+}
+
+// cbRetNum returns the return kind expected by the callback
+func cbRetNum(cb any) int {
+	switch cb.(type) {
+	case func(error):
+		return 0
+	case func(any, error):
+		return 1
+	case func([]any, error):
+		return 2
+	default:
+		panic("definition of callback function is invalid")
+	}
 }
 
 func execCb(ri *RetInfo) {
@@ -389,3 +464,7 @@ func (c *Client) Close() {
 func (c *Client) Idle() bool {
 	return c.pendingAsynCall == 0
 }
+
+func (c *Client) Pending() int {
+	return c.pendingAsynCall
+}
@@ -0,0 +1,154 @@
+package chanrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrCallCanceled is returned when the caller's context is done before the call completes.
+// the returned error also wraps ctx.Err(), so errors.Is(err, context.DeadlineExceeded) works
+var ErrCallCanceled = errors.New("chanrpc call canceled")
+
+func canceledErr(ctx context.Context) error {
+	return fmt.Errorf("%w: %w", ErrCallCanceled, ctx.Err())
+}
+
+// goroutine safe
+func (s *Server) Call0Context(ctx context.Context, id any, args ...any) error {
+	return s.Open(0).Call0Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) Call1Context(ctx context.Context, id any, args ...any) (any, error) {
+	return s.Open(0).Call1Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) CallNContext(ctx context.Context, id any, args ...any) ([]any, error) {
+	return s.Open(0).CallNContext(ctx, id, args...)
+}
+
+// callContext sends a call and waits for the result until ctx is done.
+// every call gets its own result channel, a late reply lands there and is dropped
+func (c *Client) callContext(ctx context.Context, id any, f any, args []any) (*RetInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, canceledErr(ctx)
+	}
+
+	chanRet := make(chan *RetInfo, 1)
+	err := c.call(&CallInfo{
+		id:      id,
+		f:       f,
+		args:    args,
+		chanRet: chanRet,
+		ctx:     ctx,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case ri := <-chanRet:
+		return ri, nil
+	case <-ctx.Done():
+		return nil, canceledErr(ctx)
+	}
+}
+
+func (c *Client) Call0Context(ctx context.Context, id any, args ...any) error {
+	f, err := c.f(id, 0)
+	if err != nil {
+		return err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return err
+	}
+	return ri.err
+}
+
+func (c *Client) Call1Context(ctx context.Context, id any, args ...any) (any, error) {
+	f, err := c.f(id, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return nil, err
+	}
+	return ri.ret, ri.err
+}
+
+func (c *Client) CallNContext(ctx context.Context, id any, args ...any) ([]any, error) {
+	f, err := c.f(id, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return nil, err
+	}
+	return assert(ri.ret), ri.err
+}
+
+// asynCallContext sends an asynchronous call whose result is delivered to ChanAsynRet
+// exactly once: either the reply or a cancel error, whichever comes first
+func (c *Client) asynCallContext(ctx context.Context, id any, f any, args []any, cb any) {
+	if err := ctx.Err(); err != nil {
+		c.ChanAsynRet <- &RetInfo{err: canceledErr(ctx), cb: cb}
+		return
+	}
+
+	chanRet := make(chan *RetInfo, 1)
+	err := c.call(&CallInfo{
+		id:      id,
+		f:       f,
+		args:    args,
+		chanRet: chanRet,
+		cb:      cb,
+		ctx:     ctx,
+	}, false)
+	if err != nil {
+		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
+		return
+	}
+
+	go func() {
+		select {
+		case ri := <-chanRet:
+			c.ChanAsynRet <- ri
+		case <-ctx.Done():
+			c.ChanAsynRet <- &RetInfo{err: canceledErr(ctx), cb: cb}
+		}
+	}()
+}
+
+// AsynCallContext is like AsynCall, but the callback receives ErrCallCanceled
+// once ctx is done and a late reply is dropped
+func (c *Client) AsynCallContext(ctx context.Context, id any, _args ...any) {
+	if len(_args) < 1 {
+		panic("callback function not found")
+	}
+
+	args := _args[:len(_args)-1]
+	cb := _args[len(_args)-1]
+	n := cbRetNum(cb)
+
+	// too many calls
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
+		return
+	}
+
+	f, err := c.f(id, n)
+	if err != nil {
+		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
+	} else {
+		c.asynCallContext(ctx, id, f, args, cb)
+	}
+	c.pendingAsynCall++
+}
@@ -0,0 +1,108 @@
+package chanrpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallContextTimeout(t *testing.T) {
+	s := NewServer(10)
+	release := make(chan struct{})
+	s.Register("slow", func(args []any) any {
+		<-release
+		return 1
+	})
+	serve(s)
+	defer close(s.ChanCall)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := s.Call1Context(ctx, "slow")
+	if !errors.Is(err, ErrCallCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want ErrCallCanceled and DeadlineExceeded", err)
+	}
+}
+
+func TestCallContextFullQueue(t *testing.T) {
+	// no goroutine serves s, the call cannot be queued
+	s := NewServer(0)
+	s.Register("f", func(args []any) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Call0Context(ctx, "f"); !errors.Is(err, ErrCallCanceled) {
+		t.Fatalf("err = %v, want ErrCallCanceled", err)
+	}
+}
+
+func TestCallContextSkipped(t *testing.T) {
+	s := NewServer(10)
+	block := make(chan struct{})
+	var executed atomic.Int32
+	s.Register("block", func(args []any) { <-block })
+	s.Register("f", func(args []any) { executed.Add(1) })
+	serve(s)
+	defer close(s.ChanCall)
+
+	s.Go("block")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Call0Context(ctx, "f"); !errors.Is(err, ErrCallCanceled) {
+		t.Fatalf("err = %v, want ErrCallCanceled", err)
+	}
+
+	// the queued call is skipped once the server reaches it
+	close(block)
+	if err := s.Call0("f"); err != nil {
+		t.Fatal(err)
+	}
+	if n := executed.Load(); n != 1 {
+		t.Fatalf("executed %v times, want 1", n)
+	}
+}
+
+func TestAsynCallContext(t *testing.T) {
+	s := NewServer(10)
+	release := make(chan struct{})
+	s.Register("slow", func(args []any) any {
+		<-release
+		return 1
+	})
+	s.Register("fast", func(args []any) any { return 2 })
+	serve(s)
+	defer close(s.ChanCall)
+
+	c := s.Open(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	var slowErr error
+	var fast any
+	c.AsynCallContext(ctx, "slow", func(ret any, err error) { slowErr = err })
+	c.AsynCallContext(context.Background(), "fast", func(ret any, err error) { fast = ret })
+	cancel()
+	c.Close()
+
+	if !errors.Is(slowErr, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", slowErr)
+	}
+	if fast != 2 {
+		t.Fatalf("ret = %v, want 2", fast)
+	}
+	if c.Pending() != 0 {
+		t.Fatalf("pending = %v, want 0", c.Pending())
+	}
+
+	// the late reply is dropped, nothing reaches the client
+	close(release)
+	if _, err := s.Call1("fast"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ri := <-c.ChanAsynRet:
+		t.Fatalf("late reply delivered: %+v", ri)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,149 @@
+package chanrpc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// FuncMetrics holds the statistics of one registered function id
+type FuncMetrics struct {
+	ID       any
+	Calls    uint64        // number of executed calls
+	Panics   uint64        // number of calls that panicked
+	Slow     uint64        // number of calls slower than the threshold
+	WaitSum  time.Duration // total time spent in ChanCall
+	WaitMax  time.Duration
+	ExecSum  time.Duration // total execution time
+	ExecMax  time.Duration
+	LastCall time.Time
+}
+
+// AvgWait returns the average queue wait time
+func (m *FuncMetrics) AvgWait() time.Duration {
+	if m.Calls == 0 {
+		return 0
+	}
+	return m.WaitSum / time.Duration(m.Calls)
+}
+
+// AvgExec returns the average execution time
+func (m *FuncMetrics) AvgExec() time.Duration {
+	if m.Calls == 0 {
+		return 0
+	}
+	return m.ExecSum / time.Duration(m.Calls)
+}
+
+func (m *FuncMetrics) String() string {
+	return fmt.Sprintf("id=%v calls=%v panics=%v slow=%v wait(avg=%v max=%v) exec(avg=%v max=%v)",
+		m.ID, m.Calls, m.Panics, m.Slow, m.AvgWait(), m.WaitMax, m.AvgExec(), m.ExecMax)
+}
+
+type metrics struct {
+	sync.Mutex
+	slowThreshold time.Duration
+	funcs         map[any]*FuncMetrics
+}
+
+// EnableMetrics turns on per function instrumentation of Exec.
+// calls executing longer than slowThreshold are logged, 0 disables the slow call log.
+// you must call the function before calling Open and Go
+func (s *Server) EnableMetrics(slowThreshold time.Duration) {
+	s.metrics = &metrics{
+		slowThreshold: slowThreshold,
+		funcs:         make(map[any]*FuncMetrics),
+	}
+}
+
+// Metrics returns a snapshot of the statistics sorted by call count, nil if metrics are disabled
+// goroutine safe
+func (s *Server) Metrics() []FuncMetrics {
+	if s.metrics == nil {
+		return nil
+	}
+
+	s.metrics.Lock()
+	ret := make([]FuncMetrics, 0, len(s.metrics.funcs))
+	for _, m := range s.metrics.funcs {
+		ret = append(ret, *m)
+	}
+	s.metrics.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Calls > ret[j].Calls
+	})
+	return ret
+}
+
+// ResetMetrics clears the collected statistics
+// goroutine safe
+func (s *Server) ResetMetrics() {
+	if s.metrics == nil {
+		return
+	}
+
+	s.metrics.Lock()
+	s.metrics.funcs = make(map[any]*FuncMetrics)
+	s.metrics.Unlock()
+}
+
+// get must be called with the lock held
+func (m *metrics) get(id any) *FuncMetrics {
+	fm := m.funcs[id]
+	if fm == nil {
+		fm = &FuncMetrics{ID: id}
+		m.funcs[id] = fm
+	}
+	return fm
+}
+
+func (m *metrics) panic(id any) {
+	m.Lock()
+	m.get(id).Panics++
+	m.Unlock()
+}
+
+func (m *metrics) exec(s *Server, ci *CallInfo) {
+	start := time.Now()
+	var wait time.Duration
+	if !ci.enqueue.IsZero() {
+		wait = start.Sub(ci.enqueue)
+	}
+
+	err := s.exec(ci)
+	if err != nil {
+		logs.Error("%v", err)
+	}
+	cost := time.Since(start)
+
+	slow := m.slowThreshold > 0 && cost >= m.slowThreshold
+
+	m.Lock()
+	fm := m.get(ci.id)
+	fm.Calls++
+	fm.WaitSum += wait
+	fm.WaitMax = max(fm.WaitMax, wait)
+	fm.ExecSum += cost
+	fm.ExecMax = max(fm.ExecMax, cost)
+	fm.LastCall = start
+	if slow {
+		fm.Slow++
+	}
+	m.Unlock()
+
+	if slow {
+		logs.Warn("chanrpc slow call: id=%v, wait=%v, exec=%v, args=%v", ci.id, wait, cost, argTypes(ci.args))
+	}
+}
+
+func argTypes(args []any) []string {
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = fmt.Sprintf("%T", arg)
+	}
+	return types
+}
@@ -0,0 +1,84 @@
+package chanrpc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	s := NewServer(10)
+	s.EnableMetrics(10 * time.Millisecond)
+	s.Register("fast", func(args []any) {})
+	s.Register("slow", func(args []any) { time.Sleep(15 * time.Millisecond) })
+	s.Register("panic", func(args []any) { panic("boom") })
+	serve(s)
+	defer close(s.ChanCall)
+
+	for range 3 {
+		if err := s.Call0("fast"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Call0("slow", 1, "x")
+	if err := s.Call0("panic"); err == nil {
+		t.Fatal("panic not reported")
+	}
+
+	byID := make(map[any]FuncMetrics)
+	ms := s.Metrics()
+	for _, m := range ms {
+		byID[m.ID] = m
+	}
+	if ms[0].ID != "fast" || byID["fast"].Calls != 3 {
+		t.Fatalf("fast = %+v, want first with 3 calls", ms[0])
+	}
+	if m := byID["slow"]; m.Calls != 1 || m.Slow != 1 || m.ExecMax < 15*time.Millisecond {
+		t.Fatalf("slow = %v", &m)
+	}
+	if m := byID["panic"]; m.Panics != 1 || m.Calls != 1 {
+		t.Fatalf("panic = %v", &m)
+	}
+	if byID["fast"].Slow != 0 {
+		t.Fatal("fast counted as slow")
+	}
+
+	s.ResetMetrics()
+	if len(s.Metrics()) != 0 {
+		t.Fatal("metrics not reset")
+	}
+}
+
+func TestMetricsWait(t *testing.T) {
+	s := NewServer(10)
+	s.EnableMetrics(0)
+	block := make(chan struct{})
+	s.Register("block", func(args []any) { <-block })
+	s.Register("f", func(args []any) {})
+	serve(s)
+	defer close(s.ChanCall)
+
+	s.Go("block")
+	done := make(chan error)
+	go func() { done <- s.Call0("f") }()
+	time.Sleep(20 * time.Millisecond)
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range s.Metrics() {
+		if m.ID == "f" && m.WaitMax < 20*time.Millisecond {
+			t.Fatalf("wait = %v, want at least 20ms", m.WaitMax)
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	if m := NewServer(1).Metrics(); m != nil {
+		t.Fatalf("metrics = %v, want nil", m)
+	}
+	if got := argTypes([]any{1, "x", nil}); !reflect.DeepEqual(got, []string{"int", "string", "<nil>"}) {
+		t.Fatalf("argTypes = %v", got)
+	}
+}
@@ -0,0 +1,212 @@
+package chanrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Key identifies a typed function registered on a Server.
+// the request and response types are part of the key, so a handler
+// registered with one key can only be called with matching types
+type Key[Req, Resp any] struct {
+	id any
+}
+
+// NewKey returns a typed key for the given function id
+func NewKey[Req, Resp any](id any) Key[Req, Resp] {
+	return Key[Req, Resp]{id: id}
+}
+
+// ID returns the untyped function id, usable with the any-based API
+func (k Key[Req, Resp]) ID() any {
+	return k.id
+}
+
+// typedFunc is implemented by functions registered through the typed API.
+// Server.exec dispatches on it directly, without reflection
+type typedFunc interface {
+	call(args []any) (any, error)
+}
+
+type typedHandler[Req, Resp any] struct {
+	f func(Req) Resp
+}
+
+func (h *typedHandler[Req, Resp]) call(args []any) (any, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("typed function expects 1 argument, got %v", len(args))
+	}
+	req, ok := args[0].(Req)
+	if !ok && args[0] != nil {
+		return nil, fmt.Errorf("typed function argument mismatch: %T", args[0])
+	}
+	return h.f(req), nil
+}
+
+// Register registers a typed function on s.
+// you must call the function before calling Open and Go
+func Register[Req, Resp any](s *Server, key Key[Req, Resp], f func(Req) Resp) {
+	if f == nil {
+		panic(fmt.Sprintf("function id %v: nil function", key.id))
+	}
+	s.Register(key.id, &typedHandler[Req, Resp]{f: f})
+}
+
+func lookup[Req, Resp any](s *Server, key Key[Req, Resp]) (*typedHandler[Req, Resp], error) {
+	if s == nil {
+		return nil, errors.New("server not attached")
+	}
+
+	f := s.functions[key.id]
+	if f == nil {
+		return nil, fmt.Errorf("function id %v: function not registered", key.id)
+	}
+	h, ok := f.(*typedHandler[Req, Resp])
+	if !ok {
+		return nil, fmt.Errorf("function id %v: signature mismatch", key.id)
+	}
+	return h, nil
+}
+
+func castRet[Resp any](ret any) (Resp, error) {
+	var resp Resp
+	if ret == nil {
+		return resp, nil
+	}
+	resp, ok := ret.(Resp)
+	if !ok {
+		return resp, fmt.Errorf("typed function return mismatch: %T", ret)
+	}
+	return resp, nil
+}
+
+// Go sends a typed call to s without waiting for the result
+// goroutine safe
+func Go[Req, Resp any](s *Server, key Key[Req, Resp], req Req) {
+	h, err := lookup(s, key)
+	if err != nil {
+		logs.Error("%v", err)
+		return
+	}
+	defer func() {
+		recover()
+	}()
+
+	ci := &CallInfo{
+		id:   key.id,
+		f:    h,
+		args: []any{req},
+	}
+	if s.metrics != nil {
+		ci.enqueue = time.Now()
+	}
+	s.ChanCall <- ci
+}
+
+// Call performs a typed synchronous call through c
+func Call[Req, Resp any](c *Client, key Key[Req, Resp], req Req) (Resp, error) {
+	var resp Resp
+	h, err := lookup(c.s, key)
+	if err != nil {
+		return resp, err
+	}
+
+	err = c.call(&CallInfo{
+		id:      key.id,
+		f:       h,
+		args:    []any{req},
+		chanRet: c.chanSyncRet,
+	}, true)
+	if err != nil {
+		return resp, err
+	}
+
+	ri := <-c.chanSyncRet
+	if ri.err != nil {
+		return resp, ri.err
+	}
+	return castRet[Resp](ri.ret)
+}
+
+// CallContext performs a typed synchronous call through c, giving up once ctx is done
+func CallContext[Req, Resp any](ctx context.Context, c *Client, key Key[Req, Resp], req Req) (Resp, error) {
+	var resp Resp
+	h, err := lookup(c.s, key)
+	if err != nil {
+		return resp, err
+	}
+
+	ri, err := c.callContext(ctx, key.id, h, []any{req})
+	if err != nil {
+		return resp, err
+	}
+	if ri.err != nil {
+		return resp, ri.err
+	}
+	return castRet[Resp](ri.ret)
+}
+
+// typedCb adapts a typed callback to the func(any, error) form executed by execCb
+func typedCb[Resp any](cb func(Resp, error)) func(any, error) {
+	if cb == nil {
+		panic("callback function not found")
+	}
+
+	return func(ret any, err error) {
+		var resp Resp
+		if err == nil {
+			resp, err = castRet[Resp](ret)
+		}
+		cb(resp, err)
+	}
+}
+
+// AsynCall performs a typed asynchronous call through c.
+// cb is executed by Client.Cb on the goroutine owning c
+func AsynCall[Req, Resp any](c *Client, key Key[Req, Resp], req Req, cb func(Resp, error)) {
+	_cb := typedCb(cb)
+
+	// too many calls
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: _cb})
+		return
+	}
+
+	h, err := lookup(c.s, key)
+	if err == nil {
+		err = c.call(&CallInfo{
+			id:      key.id,
+			f:       h,
+			args:    []any{req},
+			chanRet: c.ChanAsynRet,
+			cb:      _cb,
+		}, false)
+	}
+	if err != nil {
+		c.ChanAsynRet <- &RetInfo{err: err, cb: _cb}
+	}
+	c.pendingAsynCall++
+}
+
+// AsynCallContext is like AsynCall, but cb receives ErrCallCanceled once ctx is done
+func AsynCallContext[Req, Resp any](ctx context.Context, c *Client, key Key[Req, Resp], req Req, cb func(Resp, error)) {
+	_cb := typedCb(cb)
+
+	// too many calls
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: _cb})
+		return
+	}
+
+	h, err := lookup(c.s, key)
+	if err != nil {
+		c.ChanAsynRet <- &RetInfo{err: err, cb: _cb}
+	} else {
+		c.asynCallContext(ctx, key.id, h, []any{req}, _cb)
+	}
+	c.pendingAsynCall++
+}
@@ -0,0 +1,141 @@
+package chanrpc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type addReq struct{ a, b int }
+
+// serve runs s until it is closed.
+func serve(s *Server) {
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+}
+
+func TestTypedCall(t *testing.T) {
+	s := NewServer(10)
+	add := NewKey[addReq, int]("add")
+	Register(s, add, func(r addReq) int { return r.a + r.b })
+	serve(s)
+	defer close(s.ChanCall)
+
+	sum, err := Call(s.Open(0), add, addReq{1, 2})
+	if err != nil || sum != 3 {
+		t.Fatalf("Call = %v, %v, want 3", sum, err)
+	}
+
+	// the any-based API still reaches typed functions
+	ret, err := s.Call1("add", addReq{2, 3})
+	if err != nil || ret.(int) != 5 {
+		t.Fatalf("Call1 = %v, %v, want 5", ret, err)
+	}
+}
+
+func TestTypedMismatch(t *testing.T) {
+	s := NewServer(10)
+	Register(s, NewKey[addReq, int]("add"), func(r addReq) int { return r.a + r.b })
+	serve(s)
+	defer close(s.ChanCall)
+
+	_, err := Call(s.Open(0), NewKey[string, int]("add"), "x")
+	if err == nil || !strings.Contains(err.Error(), "signature mismatch") {
+		t.Fatalf("err = %v, want signature mismatch", err)
+	}
+	_, err = Call(s.Open(0), NewKey[addReq, int]("missing"), addReq{})
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("err = %v, want not registered", err)
+	}
+
+	// a wrong argument through the any-based API fails the call instead of panicking
+	_, err = s.Call1("add", "x")
+	if err == nil || !strings.Contains(err.Error(), "argument mismatch") {
+		t.Fatalf("err = %v, want argument mismatch", err)
+	}
+}
+
+func TestTypedAsynCall(t *testing.T) {
+	s := NewServer(10)
+	add := NewKey[addReq, int]("add")
+	fail := NewKey[int, string]("fail")
+	Register(s, add, func(r addReq) int { return r.a + r.b })
+	Register(s, fail, func(int) string { panic(errors.New("boom")) })
+	serve(s)
+	defer close(s.ChanCall)
+
+	c := s.Open(10)
+	var sum int
+	var failErr error
+	AsynCall(c, add, addReq{4, 5}, func(r int, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		sum = r
+	})
+	AsynCall(c, fail, 1, func(_ string, err error) { failErr = err })
+	if c.Pending() != 2 {
+		t.Fatalf("pending = %v, want 2", c.Pending())
+	}
+	c.Close()
+
+	if sum != 9 {
+		t.Fatalf("sum = %v, want 9", sum)
+	}
+	if failErr == nil || !strings.Contains(failErr.Error(), "boom") {
+		t.Fatalf("err = %v, want the panic", failErr)
+	}
+	if !c.Idle() {
+		t.Fatal("client not idle")
+	}
+}
+
+func TestTypedGo(t *testing.T) {
+	s := NewServer(10)
+	done := make(chan string, 1)
+	notify := NewKey[string, struct{}]("notify")
+	Register(s, notify, func(msg string) struct{} {
+		done <- msg
+		return struct{}{}
+	})
+	serve(s)
+	defer close(s.ChanCall)
+
+	Go(s, notify, "hello")
+	if msg := <-done; msg != "hello" {
+		t.Fatalf("msg = %q, want hello", msg)
+	}
+}
+
+func BenchmarkTypedCall(b *testing.B) {
+	s := NewServer(10)
+	add := NewKey[addReq, int]("add")
+	Register(s, add, func(r addReq) int { return r.a + r.b })
+	serve(s)
+	defer close(s.ChanCall)
+	c := s.Open(0)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		Call(c, add, addReq{1, 2})
+	}
+}
+
+func BenchmarkAnyCall(b *testing.B) {
+	s := NewServer(10)
+	s.Register("add", func(args []any) any {
+		r := args[0].(addReq)
+		return r.a + r.b
+	})
+	serve(s)
+	defer close(s.ChanCall)
+	c := s.Open(0)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		c.Call1("add", addReq{1, 2})
+	}
+}
@@ -1,9 +1,11 @@
 package cluster
 
 import (
+	"encoding/binary"
 	"math"
 	"net"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/yinyihanbing/gserv/chanrpc"
@@ -13,10 +15,28 @@ import (
 	"github.com/yinyihanbing/gutils/logs"
 )
 
+// frame kinds, the first byte of every cluster message
+const (
+	frameMsg          byte = iota // message handled by Processor
+	frameRequest                  // rpc request
+	frameResponse                 // rpc response
+	frameHello                    // node identity, see Node
+	framePing                     // heartbeat, 8 bytes of send time
+	framePong                     // heartbeat answer, the ping payload
+	frameForward                  // client message forwarded by a gate, see session.go
+	framePush                     // message pushed by a backend to a client
+	frameSessionClose             // client closed, sent by the gate
+	frameKick                     // close a client, sent by a backend
+	frameForwardOpen              // first client message of a session forwarded to a backend, opens the session
+)
+
 var (
 	server  *network.TCPServer
 	clients []*network.TCPClient
 
+	agentsMutex sync.Mutex
+	agents      = make(map[string]*Agent) // link address -> agent
+
 	AgentChanRPC *chanrpc.Server
 	Processor    *protobuf.Processor
 )
@@ -29,36 +49,78 @@ func Init() {
 		server.Addr = conf.ListenAddr
 		server.MaxConnNum = int(math.MaxInt32)
 		server.PendingWriteNum = conf.PendingWriteNum
-		server.LenMsgLen = 2
+		server.LenMsgLen = 4
 		server.MaxMsgLen = math.MaxUint32
-		server.NewAgent = newAgent
+		server.FlushTimeout = conf.FlushTimeout
+		server.CertFile = conf.ClusterCertFile
+		server.KeyFile = conf.ClusterKeyFile
+		server.ClientCAFile = conf.ClusterCAFile
+		server.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newAgent(conn, conn.RemoteAddr().String(), false)
+		}
 
 		server.Start()
 
 		logs.Info("game cluster service startup: %v", conf.ListenAddr)
 	}
 
+	maxRequests := conf.RPCMaxRequests
+	if maxRequests <= 0 {
+		maxRequests = 1000
+		logs.Info("invalid rpcmaxrequests. resetting to default value: %v", maxRequests)
+	}
+	requestSlots = make(chan struct{}, maxRequests)
+
 	for _, addr := range conf.ConnAddrs {
-		client := new(network.TCPClient)
-		// configure client settings
-		client.Addr = addr
-		client.ConnNum = 1
-		client.ConnectInterval = 3 * time.Second
-		client.PendingWriteNum = conf.PendingWriteNum
-		client.LenMsgLen = 2
-		client.MaxMsgLen = math.MaxUint32
-		client.NewAgent = newAgent
-		client.AutoReconnect = true
-
-		client.Start()
-		clients = append(clients, client)
-
-		logs.Info("game client service startup: %v", addr)
+		clients = append(clients, dial(addr))
+	}
+
+	if DiscoverySource != nil {
+		startDiscovery()
+	}
+}
+
+// dial starts a client keeping a link to addr.
+func dial(addr string) *network.TCPClient {
+	client := new(network.TCPClient)
+	// configure client settings
+	client.Addr = addr
+	client.ConnNum = 1
+	client.ConnectInterval = 3 * time.Second
+	client.MaxConnectInterval = conf.MaxReconnectInterval
+	client.PendingWriteNum = conf.PendingWriteNum
+	client.LenMsgLen = 4
+	client.MaxMsgLen = math.MaxUint32
+	client.TLS = conf.ClusterCertFile != ""
+	client.CertFile = conf.ClusterCertFile
+	client.KeyFile = conf.ClusterKeyFile
+	client.CAFile = conf.ClusterCAFile
+	client.NewAgent = func(conn *network.TCPConn) network.Agent {
+		return newAgent(conn, addr, true)
+	}
+	client.AutoReconnect = true
+
+	setPeerState(addr, PeerConnecting, nil)
+	client.Start()
+
+	logs.Info("game client service startup: %v", addr)
+	return client
+}
+
+// StopAccept stops accepting new cluster connections, established links are kept.
+// this node is withdrawn from the discovery.
+func StopAccept() {
+	deregister()
+	if server != nil {
+		server.StopAccept()
 	}
 }
 
 // Destroy stops the server and closes all client connections.
 func Destroy() {
+	deregister()
+	stopDiscovery()
+
 	if server != nil {
 		server.Close()
 	}
@@ -68,46 +130,156 @@ func Destroy() {
 	}
 }
 
+// GetAgent returns the agent of the link to addr, an address of conf.ConnAddrs for the links
+// this node opened or the remote address for the accepted ones. nil if the link is down
+// goroutine safe
+func GetAgent(addr string) *Agent {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	return agents[addr]
+}
+
 // Agent represents a network connection agent.
 type Agent struct {
 	conn     *network.TCPConn // underlying TCP connection
+	addr     string           // link address, key of agents
+	outbound bool             // the link was dialed by this node
+	node     Node             // identity of the remote node, guarded by agentsMutex
 	userData interface{}      // user-specific data
+	linkHealth
+
+	// rpc calls in flight
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[uint64]chan *response
+	closed  bool
+
+	sessions map[uint64]*Session // sessions forwarded by the remote gate, guarded by mutex
 }
 
 // newAgent creates a new Agent instance.
-func newAgent(conn *network.TCPConn) network.Agent {
+func newAgent(conn *network.TCPConn, addr string, outbound bool) network.Agent {
 	a := new(Agent)
 	a.conn = conn
-	AgentChanRPC.Go("NewAgent", a)
+	a.addr = addr
+	a.outbound = outbound
+	a.pending = make(map[uint64]chan *response)
+	a.sessions = make(map[uint64]*Session)
+	a.lastRecv.Store(time.Now().UnixNano())
+	a.state.Store(int32(PeerUp))
+
+	agentsMutex.Lock()
+	agents[addr] = a
+	agentsMutex.Unlock()
+	setPeerState(addr, PeerUp, a)
+
+	if AgentChanRPC != nil {
+		AgentChanRPC.Go("NewAgent", a)
+	}
+	a.sendHello()
 	return a
 }
 
 // Run processes incoming messages for the agent.
 func (a *Agent) Run() {
+	if conf.HeartbeatInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go a.heartbeat(done, conf.HeartbeatInterval, conf.HeartbeatTimeout)
+	}
+
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
 			logs.Error("read message error: %v", err)
 			break
 		}
-		if Processor != nil {
-			msg, err := Processor.Unmarshal(data)
+		if len(data) == 0 {
+			logs.Error("empty cluster message")
+			break
+		}
+		a.received()
+
+		switch data[0] {
+		case frameMsg:
+			if Processor == nil {
+				continue
+			}
+			msg, err := Processor.Unmarshal(data[1:])
 			if err != nil {
 				logs.Error("unmarshal message error: %v", err)
-				break
+				return
 			}
-
 			err = Processor.Route(msg, a)
 			if err != nil {
 				logs.Error("route message error: %v", err)
-				break
+				return
 			}
+		case frameRequest:
+			req := new(request)
+			if err := decode(data[1:], req); err != nil {
+				logs.Error("decode cluster request error: %v", err)
+				return
+			}
+			a.startRequest(req)
+		case frameResponse:
+			resp := new(response)
+			if err := decode(data[1:], resp); err != nil {
+				logs.Error("decode cluster response error: %v", err)
+				return
+			}
+			a.handleResponse(resp)
+		case frameHello:
+			var node Node
+			if err := decode(data[1:], &node); err != nil {
+				logs.Error("decode cluster hello error: %v", err)
+				return
+			}
+			if !a.handleHello(node) {
+				return
+			}
+		case framePing:
+			a.handlePing(data)
+		case framePong:
+			a.handlePong(data)
+		case frameForward, frameForwardOpen, framePush, frameSessionClose, frameKick:
+			if len(data) < 9 {
+				logs.Error("invalid cluster session frame")
+				return
+			}
+			id := binary.BigEndian.Uint64(data[1:9])
+			switch data[0] {
+			case frameForward, frameForwardOpen:
+				a.handleForward(id, data[9:], data[0] == frameForwardOpen)
+			case framePush:
+				handlePush(id, data[9:])
+			case frameSessionClose:
+				a.handleSessionClose(id)
+			case frameKick:
+				handleKick(id)
+			}
+		default:
+			logs.Error("unknown cluster frame kind: %v", data[0])
+			return
 		}
 	}
 }
 
 // OnClose handles cleanup when the agent's connection is closed.
 func (a *Agent) OnClose() {
+	agentsMutex.Lock()
+	if agents[a.addr] == a {
+		delete(agents, a.addr)
+	}
+	agentsMutex.Unlock()
+
+	a.leave()
+	a.failPending()
+	dropBackend(a)
+	a.closeSessions()
+	a.state.Store(int32(PeerDown))
+	setPeerState(a.addr, PeerDown, a)
+
 	if AgentChanRPC != nil {
 		err := AgentChanRPC.Call0("CloseAgent", a)
 		if err != nil {
@@ -124,7 +296,7 @@ func (a *Agent) WriteMsg(msg interface{}) {
 			logs.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
 			return
 		}
-		err = a.conn.WriteMsg(data...)
+		err = a.conn.WriteMsg(append([][]byte{{frameMsg}}, data...)...)
 		if err != nil {
 			logs.Error("write message %v error: %v", reflect.TypeOf(msg), err)
 		}
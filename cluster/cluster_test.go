@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gserv/network"
+)
+
+// rawPeer plays a remote node over a plain connection, frames are written and read by hand.
+type rawPeer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (p *rawPeer) write(data []byte) {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := p.conn.Write(buf); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *rawPeer) send(kind byte, v any) {
+	data, err := encode(kind, v)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.write(data)
+}
+
+// read returns the next frame, nil if the link is closed.
+func (p *rawPeer) read() []byte {
+	p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var l [4]byte
+	if _, err := io.ReadFull(p.conn, l[:]); err != nil {
+		return nil
+	}
+	data := make([]byte, binary.BigEndian.Uint32(l[:]))
+	if _, err := io.ReadFull(p.conn, data); err != nil {
+		return nil
+	}
+	return data
+}
+
+// next skips the frames until one of the given kind, decoded into v if not nil.
+func (p *rawPeer) next(kind byte, v any) []byte {
+	for {
+		data := p.read()
+		if data == nil {
+			p.t.Fatalf("link closed waiting for frame %v", kind)
+		}
+		if data[0] != kind {
+			continue
+		}
+		if v != nil {
+			if err := decode(data[1:], v); err != nil {
+				p.t.Fatal(err)
+			}
+		}
+		return data
+	}
+}
+
+// closed reports whether the agent closed the link, the frames still queued are skipped.
+func (p *rawPeer) closed() bool {
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var b [512]byte
+		if _, err := p.conn.Read(b[:]); err != nil {
+			ne, ok := err.(net.Error)
+			return !ok || !ne.Timeout()
+		}
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// setConf changes a conf variable for the duration of the test.
+func setConf[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// accept starts a cluster server and connects a raw peer to it, the hello of the agent is read.
+// heartbeats are disabled unless conf.HeartbeatInterval is set by the test.
+func accept(t *testing.T) (*Agent, *rawPeer, Node) {
+	if conf.HeartbeatInterval == 5*time.Second {
+		setConf(t, &conf.HeartbeatInterval, 0)
+	}
+	agents := make(chan *Agent, 1)
+	s := &network.TCPServer{
+		Addr:            freeAddr(t),
+		MaxConnNum:      10,
+		PendingWriteNum: 100,
+		LenMsgLen:       4,
+		MaxMsgLen:       math.MaxUint32,
+		NewAgent: func(conn *network.TCPConn) network.Agent {
+			a := newAgent(conn, conn.RemoteAddr().String(), false)
+			agents <- a.(*Agent)
+			return a
+		},
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &rawPeer{t: t, conn: conn}
+
+	var hello Node
+	p.next(frameHello, &hello)
+	return <-agents, p, hello
+}
+
+// expose serves a chanrpc server exposed as the functions of the test.
+func expose(t *testing.T, s *chanrpc.Server, names ...string) {
+	for _, name := range names {
+		Expose(name, s)
+	}
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	t.Cleanup(func() {
+		for _, name := range names {
+			delete(exposed, name)
+		}
+		close(s.ChanCall)
+	})
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for range 100 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %v", what)
+}
@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gserv/network"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Discovery is a source of cluster nodes. it is refreshed every conf.DiscoveryInterval:
+// Register announces this node again, then the nodes returned by Nodes are dialed.
+// of two nodes, the one with the smaller name dials the other.
+type Discovery interface {
+	Register(self Node) error   // announces this node, called on each refresh
+	Deregister(self Node) error // withdraws this node, called when the node stops accepting
+	Nodes() ([]Node, error)     // returns the known nodes, this node included or not
+}
+
+// DiscoverySource is the discovery used by Init, nil means conf.ConnAddrs only.
+var DiscoverySource Discovery
+
+// FileDiscovery reads the nodes from a JSON file, a list of {"name", "type", "id", "addr"}.
+// the file is read on each refresh, so editing it changes the cluster membership.
+type FileDiscovery struct {
+	Path string
+}
+
+// Register does nothing, the file is maintained by hand.
+func (fd *FileDiscovery) Register(Node) error {
+	return nil
+}
+
+// Deregister does nothing, the file is maintained by hand.
+func (fd *FileDiscovery) Deregister(Node) error {
+	return nil
+}
+
+// Nodes reads the file.
+func (fd *FileDiscovery) Nodes() ([]Node, error) {
+	data, err := os.ReadFile(fd.Path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// dialer is a link opened to a discovered node.
+type dialer struct {
+	addr   string
+	client *network.TCPClient
+}
+
+var (
+	dialers        = make(map[string]*dialer) // node name -> dialer, owned by the discovery goroutine
+	discoverySig   chan struct{}
+	discoveryWg    sync.WaitGroup
+	deregisterOnce sync.Once
+)
+
+// startDiscovery refreshes the nodes until stopDiscovery is called.
+func startDiscovery() {
+	if conf.NodeName == "" {
+		logs.Fatal("cluster discovery requires conf.NodeName")
+	}
+	interval := discoveryInterval()
+	discoverySig = make(chan struct{})
+	discoveryWg.Add(1)
+	go func() {
+		defer discoveryWg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			refresh()
+			select {
+			case <-discoverySig:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func discoveryInterval() time.Duration {
+	if conf.DiscoveryInterval <= 0 {
+		return 10 * time.Second
+	}
+	return conf.DiscoveryInterval
+}
+
+// deregister withdraws this node from the discovery.
+func deregister() {
+	if DiscoverySource == nil {
+		return
+	}
+	deregisterOnce.Do(func() {
+		if err := DiscoverySource.Deregister(Self()); err != nil {
+			logs.Error("cluster deregister error: %v", err)
+		}
+	})
+}
+
+// stopDiscovery stops the refresh and closes the links to the discovered nodes.
+func stopDiscovery() {
+	if discoverySig == nil {
+		return
+	}
+	close(discoverySig)
+	discoveryWg.Wait()
+
+	for name, d := range dialers {
+		d.client.Close()
+		removePeer(d.addr)
+		delete(dialers, name)
+	}
+}
+
+// refresh announces this node and dials the new nodes, links to vanished nodes are closed.
+func refresh() {
+	self := Self()
+	if err := DiscoverySource.Register(self); err != nil {
+		logs.Error("cluster register error: %v", err)
+	}
+	found, err := DiscoverySource.Nodes()
+	if err != nil {
+		logs.Error("cluster discovery error: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, node := range found {
+		if node.Name == "" || node.Name == self.Name || node.Addr == "" || node.Name < self.Name {
+			continue
+		}
+		seen[node.Name] = true
+
+		if d, ok := dialers[node.Name]; ok {
+			if d.addr == node.Addr {
+				continue
+			}
+			logs.Info("cluster node %v moved from %v to %v", node.Name, d.addr, node.Addr)
+			d.client.Close()
+			removePeer(d.addr)
+		}
+		dialers[node.Name] = &dialer{addr: node.Addr, client: dial(node.Addr)}
+		logs.Info("cluster node %v discovered: %v", node.Name, node.Addr)
+	}
+
+	for name, d := range dialers {
+		if !seen[name] {
+			logs.Info("cluster node %v vanished from discovery: %v", name, d.addr)
+			d.client.Close()
+			removePeer(d.addr)
+			delete(dialers, name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/yinyihanbing/gserv/storage"
+)
+
+// RedisDiscovery keeps the nodes in redis: a hash of the identities and a sorted set of
+// the last announce time of each node. nodes that did not announce within TTL are ignored.
+type RedisDiscovery struct {
+	Cli *storage.RedisCli
+	Key string        // key prefix, "gserv:nodes" if empty
+	TTL time.Duration // time a node stays listed without announcing, 3 * conf.DiscoveryInterval if 0
+}
+
+func (rd *RedisDiscovery) keys() (info string, alive string) {
+	key := rd.Key
+	if key == "" {
+		key = "gserv:nodes"
+	}
+	return key + ":info", key + ":alive"
+}
+
+func (rd *RedisDiscovery) ttl() time.Duration {
+	if rd.TTL > 0 {
+		return rd.TTL
+	}
+	return 3 * discoveryInterval()
+}
+
+// Register stores the identity of this node and refreshes its announce time.
+func (rd *RedisDiscovery) Register(self Node) error {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	info, alive := rd.keys()
+	if _, err := rd.Cli.Do("HSET", info, self.Name, data); err != nil {
+		return err
+	}
+	_, err = rd.Cli.Do("ZADD", alive, time.Now().Unix(), self.Name)
+	return err
+}
+
+// Deregister removes this node.
+func (rd *RedisDiscovery) Deregister(self Node) error {
+	info, alive := rd.keys()
+	if _, err := rd.Cli.Do("ZREM", alive, self.Name); err != nil {
+		return err
+	}
+	_, err := rd.Cli.Do("HDEL", info, self.Name)
+	return err
+}
+
+// Nodes returns the nodes announced within TTL, the expired ones are removed.
+func (rd *RedisDiscovery) Nodes() ([]Node, error) {
+	info, alive := rd.keys()
+	expire := time.Now().Add(-rd.ttl()).Unix()
+
+	expired, err := redis.Strings(rd.Cli.Do("ZRANGEBYSCORE", alive, "-inf", expire))
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		if _, err := rd.Cli.Do("ZREMRANGEBYSCORE", alive, "-inf", expire); err != nil {
+			return nil, err
+		}
+		if _, err := rd.Cli.Do("HDEL", redis.Args{}.Add(info).AddFlat(expired)...); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := redis.Strings(rd.Cli.Do("ZRANGEBYSCORE", alive, expire+1, "+inf"))
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	values, err := redis.ByteSlices(rd.Cli.Do("HMGET", redis.Args{}.Add(info).AddFlat(names)...))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(values))
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		var node Node
+		if err := json.Unmarshal(v, &node); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
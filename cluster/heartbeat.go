@@ -0,0 +1,213 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// PeerState is the state of the link to a peer.
+//
+//	connecting -> up        the link is established
+//	up         -> suspect   nothing received for 2 heartbeat intervals
+//	suspect    -> up        a frame is received again
+//	any        -> down      the link is closed, after conf.HeartbeatTimeout of silence at the latest
+//	down       -> up        the link is established again, outbound links only
+type PeerState int
+
+const (
+	PeerConnecting PeerState = iota
+	PeerUp
+	PeerSuspect
+	PeerDown
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerConnecting:
+		return "connecting"
+	case PeerUp:
+		return "up"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDown:
+		return "down"
+	default:
+		return fmt.Sprintf("PeerState(%d)", int(s))
+	}
+}
+
+// PeerStatus describes the link to a peer.
+type PeerStatus struct {
+	Addr     string        // link address, see GetAgent
+	Node     Node          // identity of the peer, zero until the handshake is done
+	State    PeerState     // state of the link
+	Since    time.Time     // time of the last state change
+	RTT      time.Duration // round trip time of the last heartbeat
+	LastRecv time.Time     // time of the last frame received
+}
+
+func (ps *PeerStatus) String() string {
+	name := ps.Node.Name
+	if name == "" {
+		name = "-"
+	}
+	return fmt.Sprintf("%v (%v): %v since %v, rtt=%v", ps.Addr, name, ps.State, ps.Since.Format(time.DateTime), ps.RTT)
+}
+
+var (
+	peers           = make(map[string]*PeerStatus) // link address -> status, guarded by agentsMutex
+	peerSubscribers []*chanrpc.Server
+)
+
+// SubscribePeers delivers the link state changes to server, which must register
+// the function "PeerState", called with a PeerStatus.
+// must be called before Init
+func SubscribePeers(server *chanrpc.Server) {
+	peerSubscribers = append(peerSubscribers, server)
+}
+
+// Peers returns the status of the links, the outbound ones are kept while down.
+// goroutine safe
+func Peers() []PeerStatus {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	ret := make([]PeerStatus, 0, len(peers))
+	for _, ps := range peers {
+		ret = append(ret, *ps)
+	}
+	return ret
+}
+
+// setPeerState records a state change of the link to addr and notifies the subscribers.
+func setPeerState(addr string, state PeerState, a *Agent) {
+	agentsMutex.Lock()
+	ps := peers[addr]
+	if ps == nil {
+		ps = &PeerStatus{Addr: addr}
+		peers[addr] = ps
+	}
+	if a != nil {
+		ps.Node = a.node
+		ps.RTT = time.Duration(a.rtt.Load())
+		ps.LastRecv = time.Unix(0, a.lastRecv.Load())
+	}
+	changed := ps.State != state || ps.Since.IsZero()
+	if changed {
+		ps.State = state
+		ps.Since = time.Now()
+	}
+	status := *ps
+	if state == PeerDown && (a == nil || !a.outbound) {
+		delete(peers, addr)
+	}
+	agentsMutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if state == PeerSuspect || state == PeerDown {
+		logs.Warn("cluster peer %v", &status)
+	} else {
+		logs.Info("cluster peer %v", &status)
+	}
+	for _, s := range peerSubscribers {
+		s.Go("PeerState", status)
+	}
+}
+
+// removePeer forgets an outbound link that is not dialed anymore.
+func removePeer(addr string) {
+	agentsMutex.Lock()
+	delete(peers, addr)
+	agentsMutex.Unlock()
+}
+
+// heartbeat pings the peer every interval until done is closed.
+// the link is suspect after 2 silent intervals and destroyed after timeout (3 intervals if 0).
+func (a *Agent) heartbeat(done chan struct{}, interval time.Duration, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = 3 * interval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		silence := time.Since(time.Unix(0, a.lastRecv.Load()))
+		switch {
+		case silence >= timeout:
+			logs.Error("cluster link %v: no heartbeat for %v, closing", a.addr, silence.Truncate(time.Millisecond))
+			a.conn.Destroy()
+			return
+		case silence >= 2*interval:
+			a.setState(PeerSuspect)
+		}
+		a.sendPing()
+	}
+}
+
+// received records the arrival of a frame.
+func (a *Agent) received() {
+	a.lastRecv.Store(time.Now().UnixNano())
+	if PeerState(a.state.Load()) == PeerSuspect {
+		a.setState(PeerUp)
+	}
+}
+
+func (a *Agent) setState(state PeerState) {
+	if PeerState(a.state.Swap(int32(state))) != state {
+		setPeerState(a.addr, state, a)
+	}
+}
+
+func (a *Agent) sendPing() {
+	data := make([]byte, 9)
+	data[0] = framePing
+	binary.BigEndian.PutUint64(data[1:], uint64(time.Now().UnixNano()))
+	if err := a.conn.WriteMsg(data); err != nil {
+		logs.Error("write cluster ping error: %v", err)
+	}
+}
+
+// handlePing answers a ping with the same payload.
+func (a *Agent) handlePing(data []byte) {
+	pong := make([]byte, len(data))
+	pong[0] = framePong
+	copy(pong[1:], data[1:])
+	if err := a.conn.WriteMsg(pong); err != nil {
+		logs.Error("write cluster pong error: %v", err)
+	}
+}
+
+// handlePong measures the round trip time of a ping.
+func (a *Agent) handlePong(data []byte) {
+	if len(data) != 9 {
+		return
+	}
+	sent := int64(binary.BigEndian.Uint64(data[1:]))
+	a.rtt.Store(time.Now().UnixNano() - sent)
+}
+
+// RTT returns the round trip time of the last heartbeat, 0 before the first one.
+// goroutine safe
+func (a *Agent) RTT() time.Duration {
+	return time.Duration(a.rtt.Load())
+}
+
+// agent link health, embedded in Agent
+type linkHealth struct {
+	lastRecv atomic.Int64 // unix nano of the last frame received
+	rtt      atomic.Int64
+	state    atomic.Int32 // PeerState
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+)
+
+// peerEvents serves the link state changes delivered to a subscribed chanrpc server.
+func peerEvents(t *testing.T) chan PeerStatus {
+	events := make(chan PeerStatus, 10)
+	s := chanrpc.NewServer(10)
+	s.Register("PeerState", func(args []any) { events <- args[0].(PeerStatus) })
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	peerSubscribers = append(peerSubscribers, s)
+	t.Cleanup(func() {
+		peerSubscribers = nil
+		close(s.ChanCall)
+	})
+	return events
+}
+
+func expectState(t *testing.T, events chan PeerStatus, addr string, want PeerState) PeerStatus {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ps := <-events:
+			if ps.Addr != addr {
+				continue
+			}
+			if ps.State != want {
+				t.Fatalf("state = %v, want %v", ps.State, want)
+			}
+			return ps
+		case <-timeout:
+			t.Fatalf("no state change, want %v", want)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	setConf(t, &conf.HeartbeatInterval, 20*time.Millisecond)
+	setConf(t, &conf.HeartbeatTimeout, 150*time.Millisecond)
+	events := peerEvents(t)
+
+	a, p, _ := accept(t)
+	expectState(t, events, a.addr, PeerUp)
+
+	// the pings are answered, the rtt is measured
+	ping := p.next(framePing, nil)
+	if len(ping) != 9 {
+		t.Fatalf("ping = %v", ping)
+	}
+	time.Sleep(5 * time.Millisecond)
+	pong := bytes.Clone(ping)
+	pong[0] = framePong
+	p.write(pong)
+	waitFor(t, "rtt", func() bool { return a.RTT() >= 5*time.Millisecond })
+
+	// silent for 2 intervals: suspect, a frame brings the link back up
+	ps := expectState(t, events, a.addr, PeerSuspect)
+	if ps.RTT < 5*time.Millisecond || ps.LastRecv.IsZero() {
+		t.Fatalf("status = %v", &ps)
+	}
+	p.write(pong)
+	expectState(t, events, a.addr, PeerUp)
+
+	// silent for the timeout: the link is destroyed and forgotten, it was accepted
+	expectState(t, events, a.addr, PeerSuspect)
+	start := time.Now()
+	expectState(t, events, a.addr, PeerDown)
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("down %v after suspect", d)
+	}
+	if !p.closed() {
+		t.Fatal("silent link kept")
+	}
+	for _, ps := range Peers() {
+		if ps.Addr == a.addr {
+			t.Fatalf("accepted link kept in Peers: %v", &ps)
+		}
+	}
+}
+
+func TestHandlePing(t *testing.T) {
+	_, p, _ := accept(t)
+
+	ping := make([]byte, 9)
+	ping[0] = framePing
+	binary.BigEndian.PutUint64(ping[1:], 12345)
+	p.write(ping)
+	pong := p.next(framePong, nil)
+	if !bytes.Equal(pong[1:], ping[1:]) {
+		t.Fatalf("pong = %v, want the ping payload", pong)
+	}
+}
+
+func TestPeerStatus(t *testing.T) {
+	setConf(t, &conf.HeartbeatInterval, 0)
+	events := peerEvents(t)
+
+	// outbound links are kept while down, the accepted ones are forgotten
+	setPeerState("10.0.0.2:3000", PeerConnecting, nil)
+	expectState(t, events, "10.0.0.2:3000", PeerConnecting)
+	setPeerState("10.0.0.2:3000", PeerDown, &Agent{addr: "10.0.0.2:3000", outbound: true})
+	expectState(t, events, "10.0.0.2:3000", PeerDown)
+	setPeerState("10.0.0.3:3000", PeerDown, &Agent{addr: "10.0.0.3:3000"})
+
+	var found []string
+	for _, ps := range Peers() {
+		found = append(found, ps.Addr+" "+ps.State.String())
+	}
+	if len(found) != 1 || found[0] != "10.0.0.2:3000 down" {
+		t.Fatalf("peers = %v", found)
+	}
+	removePeer("10.0.0.2:3000")
+	if len(Peers()) != 0 {
+		t.Fatal("peer not removed")
+	}
+
+	// repeated states are not notified
+	setPeerState("10.0.0.4:3000", PeerConnecting, nil)
+	setPeerState("10.0.0.4:3000", PeerConnecting, nil)
+	expectState(t, events, "10.0.0.4:3000", PeerConnecting)
+	select {
+	case ps := <-events:
+		if ps.Addr == "10.0.0.4:3000" {
+			t.Fatalf("repeated state notified: %v", &ps)
+		}
+	case <-time.After(20 * time.Millisecond):
+	}
+	removePeer("10.0.0.4:3000")
+
+	if s := PeerState(9).String(); s != "PeerState(9)" {
+		t.Fatalf("String = %v", s)
+	}
+}
@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Node is the identity of a cluster node, sent to the peers in the handshake.
+type Node struct {
+	Name string `json:"name"` // unique node name
+	Type string `json:"type"` // node type, e.g. "battle" or "chat"
+	ID   int    `json:"id"`
+	Addr string `json:"addr"` // cluster address the peers dial
+}
+
+var (
+	nodes       = make(map[string]*Agent) // node name -> agent, guarded by agentsMutex
+	subscribers []*chanrpc.Server
+)
+
+// Self returns the identity of this node.
+func Self() Node {
+	addr := conf.NodeAddr
+	if addr == "" {
+		addr = conf.ListenAddr
+	}
+	return Node{Name: conf.NodeName, Type: conf.NodeType, ID: conf.NodeID, Addr: addr}
+}
+
+// Subscribe delivers the node events to server, which must register the functions
+// "NodeJoin" and "NodeLeave", both called with the *Agent of the node.
+// must be called before Init
+func Subscribe(server *chanrpc.Server) {
+	subscribers = append(subscribers, server)
+}
+
+// GetNode returns the agent of the live node with the given name, nil if it is not connected.
+// goroutine safe
+func GetNode(name string) *Agent {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	return nodes[name]
+}
+
+// GetNodesByType returns the agents of the live nodes of the given type.
+// goroutine safe
+func GetNodesByType(typ string) []*Agent {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	var ret []*Agent
+	for _, a := range nodes {
+		if a.node.Type == typ {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// Nodes returns the identity of the live nodes.
+// goroutine safe
+func Nodes() []Node {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+
+	ret := make([]Node, 0, len(nodes))
+	for _, a := range nodes {
+		ret = append(ret, a.node)
+	}
+	return ret
+}
+
+// Node returns the identity of the remote node, zero until the handshake is done.
+// goroutine safe
+func (a *Agent) Node() Node {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	return a.node
+}
+
+// sendHello sends the identity of this node, the first frame of every link.
+func (a *Agent) sendHello() {
+	data, err := encode(frameHello, Self())
+	if err != nil {
+		logs.Error("encode cluster hello error: %v", err)
+		return
+	}
+	if err := a.conn.WriteMsg(data); err != nil {
+		logs.Error("write cluster hello error: %v", err)
+	}
+}
+
+// handleHello registers the remote node, it returns false if the link must be closed.
+// two links between the same nodes are resolved by keeping the one dialed by the smaller name.
+func (a *Agent) handleHello(node Node) bool {
+	self := conf.NodeName
+	if node.Name != "" && node.Name == self {
+		logs.Error("cluster link %v: connected to itself", a.addr)
+		return false
+	}
+
+	agentsMutex.Lock()
+	a.node = node
+	if ps := peers[a.addr]; ps != nil {
+		ps.Node = node
+	}
+	if node.Name == "" {
+		agentsMutex.Unlock()
+		return true
+	}
+	old := nodes[node.Name]
+	if old != nil && old.preferred() && !a.preferred() {
+		agentsMutex.Unlock()
+		logs.Info("cluster node %v: duplicate link %v closed", node.Name, a.addr)
+		return false
+	}
+	nodes[node.Name] = a
+	agentsMutex.Unlock()
+
+	if old != nil {
+		logs.Info("cluster node %v: link %v replaced by %v", node.Name, old.addr, a.addr)
+		notify("NodeLeave", old)
+		old.Close()
+	}
+	logs.Info("cluster node %v joined: type=%v, id=%v, addr=%v", node.Name, node.Type, node.ID, a.addr)
+	rebalance()
+	notify("NodeJoin", a)
+	return true
+}
+
+// preferred reports whether the link was dialed by the node with the smaller name.
+// must be called with agentsMutex held
+func (a *Agent) preferred() bool {
+	if a.outbound {
+		return conf.NodeName < a.node.Name
+	}
+	return a.node.Name < conf.NodeName
+}
+
+// leave unregisters the remote node when its link is closed.
+func (a *Agent) leave() {
+	agentsMutex.Lock()
+	name := a.node.Name
+	registered := name != "" && nodes[name] == a
+	if registered {
+		delete(nodes, name)
+	}
+	agentsMutex.Unlock()
+
+	if registered {
+		logs.Info("cluster node %v left: addr=%v", name, a.addr)
+		rebalance()
+		notify("NodeLeave", a)
+	}
+}
+
+func notify(id string, a *Agent) {
+	for _, s := range subscribers {
+		s.Go(id, a)
+	}
+}
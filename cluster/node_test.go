@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+)
+
+// nodeEvents serves the node events delivered to a subscribed chanrpc server.
+func nodeEvents(t *testing.T) chan string {
+	events := make(chan string, 10)
+	s := chanrpc.NewServer(10)
+	s.Register("NodeJoin", func(args []any) { events <- "join " + args[0].(*Agent).Node().Name })
+	s.Register("NodeLeave", func(args []any) { events <- "leave " + args[0].(*Agent).Node().Name })
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	subscribers = append(subscribers, s)
+	t.Cleanup(func() {
+		subscribers = nil
+		close(s.ChanCall)
+	})
+	return events
+}
+
+func expectEvent(t *testing.T, events chan string, want string) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		if ev != want {
+			t.Fatalf("event = %v, want %v", ev, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event, want %v", want)
+	}
+}
+
+func TestHello(t *testing.T) {
+	setConf(t, &conf.NodeName, "gate1")
+	setConf(t, &conf.NodeType, "gate")
+	setConf(t, &conf.NodeID, 1)
+	setConf(t, &conf.NodeAddr, "10.0.0.1:3000")
+	events := nodeEvents(t)
+
+	a, p, hello := accept(t)
+	if hello != (Node{Name: "gate1", Type: "gate", ID: 1, Addr: "10.0.0.1:3000"}) {
+		t.Fatalf("hello = %+v", hello)
+	}
+	if a.Node().Name != "" || GetNode("battle1") != nil {
+		t.Fatal("node registered before its hello")
+	}
+
+	node := Node{Name: "battle1", Type: "battle", ID: 7, Addr: "10.0.0.2:3000"}
+	p.send(frameHello, node)
+	expectEvent(t, events, "join battle1")
+	if GetNode("battle1") != a || a.Node() != node {
+		t.Fatalf("GetNode = %v, node = %+v", GetNode("battle1"), a.Node())
+	}
+	if got := GetNodesByType("battle"); len(got) != 1 || got[0] != a {
+		t.Fatalf("GetNodesByType = %v", got)
+	}
+	if len(GetNodesByType("chat")) != 0 || len(Nodes()) != 1 || Nodes()[0] != node {
+		t.Fatalf("Nodes = %v", Nodes())
+	}
+
+	p.conn.Close()
+	expectEvent(t, events, "leave battle1")
+	if GetNode("battle1") != nil || len(Nodes()) != 0 {
+		t.Fatal("node kept after its link closed")
+	}
+}
+
+func TestHelloItself(t *testing.T) {
+	setConf(t, &conf.NodeName, "gate1")
+	_, p, _ := accept(t)
+
+	p.send(frameHello, Node{Name: "gate1"})
+	if !p.closed() {
+		t.Fatal("link to itself kept")
+	}
+	if GetNode("gate1") != nil {
+		t.Fatal("itself registered")
+	}
+}
+
+func TestHelloDuplicate(t *testing.T) {
+	setConf(t, &conf.NodeName, "gate1")
+	events := nodeEvents(t)
+
+	// both links are accepted by this node, the last one replaces the first
+	a1, p1, _ := accept(t)
+	p1.send(frameHello, Node{Name: "battle1"})
+	expectEvent(t, events, "join battle1")
+	a2, p2, _ := accept(t)
+	p2.send(frameHello, Node{Name: "battle1"})
+	expectEvent(t, events, "leave battle1")
+	expectEvent(t, events, "join battle1")
+
+	if GetNode("battle1") != a2 {
+		t.Fatal("new link not registered")
+	}
+	if !p1.closed() {
+		t.Fatal("replaced link kept")
+	}
+	// the replaced link leaves nothing behind when it closes
+	if GetNode("battle1") != a2 || a1.Node().Name != "battle1" {
+		t.Fatal("registry changed by the replaced link")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	setConf(t, &conf.NodeName, "b")
+	for _, tc := range []struct {
+		outbound bool
+		remote   string
+		want     bool
+	}{
+		{true, "c", true},  // b dialed c
+		{true, "a", false}, // a should dial b
+		{false, "a", true}, // a dialed b
+		{false, "c", false},
+	} {
+		a := &Agent{outbound: tc.outbound, node: Node{Name: tc.remote}}
+		if got := a.preferred(); got != tc.want {
+			t.Fatalf("outbound=%v remote=%v: preferred = %v", tc.outbound, tc.remote, got)
+		}
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	data := `[{"name": "battle1", "type": "battle", "id": 1, "addr": "10.0.0.2:3000"}, {"name": "chat1", "type": "chat", "addr": "10.0.0.3:3000"}]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fd := &FileDiscovery{Path: path}
+	nodes, err := fd.Nodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0] != (Node{Name: "battle1", Type: "battle", ID: 1, Addr: "10.0.0.2:3000"}) || nodes[1].Name != "chat1" {
+		t.Fatalf("nodes = %+v", nodes)
+	}
+	if fd.Register(Node{}) != nil || fd.Deregister(Node{}) != nil {
+		t.Fatal("file discovery registers")
+	}
+	if _, err := (&FileDiscovery{Path: path + ".missing"}).Nodes(); err == nil {
+		t.Fatal("missing file read")
+	}
+}
+
+// staticDiscovery returns a fixed node list and records the registrations.
+type staticDiscovery struct {
+	nodes      []Node
+	registered []Node
+}
+
+func (d *staticDiscovery) Register(self Node) error {
+	d.registered = append(d.registered, self)
+	return nil
+}
+func (d *staticDiscovery) Deregister(Node) error  { return nil }
+func (d *staticDiscovery) Nodes() ([]Node, error) { return d.nodes, nil }
+
+func TestRefresh(t *testing.T) {
+	setConf(t, &conf.NodeName, "m")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// the nodes with a smaller name dial this one, itself is skipped
+	d := &staticDiscovery{nodes: []Node{
+		{Name: "a", Addr: "127.0.0.1:1"},
+		{Name: "m", Addr: "127.0.0.1:2"},
+		{Name: "z", Addr: ln.Addr().String()},
+		{Name: "y"},
+	}}
+	setConf[Discovery](t, &DiscoverySource, d)
+	t.Cleanup(func() {
+		for name, d := range dialers {
+			d.client.Close()
+			removePeer(d.addr)
+			delete(dialers, name)
+		}
+	})
+
+	refresh()
+	if len(d.registered) != 1 || d.registered[0].Name != "m" {
+		t.Fatalf("registered = %v", d.registered)
+	}
+	if len(dialers) != 1 || dialers["z"] == nil {
+		t.Fatalf("dialers = %v", dialers)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("discovered node not dialed")
+	}
+
+	// a vanished node is not dialed anymore
+	d.nodes = nil
+	refresh()
+	if len(dialers) != 0 {
+		t.Fatalf("dialers = %v", dialers)
+	}
+	p := &rawPeer{t: t, conn: conn}
+	if !p.closed() {
+		t.Fatal("link to the vanished node kept")
+	}
+}
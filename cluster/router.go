@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+)
+
+var (
+	// ErrNoNode is returned by Router.SendTo when no node of the type is live.
+	ErrNoNode = errors.New("cluster router: no live node")
+	// ErrLocalKey is returned by Router.SendTo when the key is owned by this node.
+	ErrLocalKey = errors.New("cluster router: key owned by this node")
+)
+
+// KeyMove describes a tracked key whose owner changed.
+type KeyMove struct {
+	Key  any
+	From string // node name, "" if no node owned the key
+	To   string // node name, "" if no node owns the key anymore
+}
+
+// Router maps keys such as user or room ids to the live nodes of one type by consistent hashing.
+// this node takes part if it has the same type. the ring is rebuilt when a node joins or leaves,
+// so every node computes the same owner for a key.
+type Router struct {
+	nodeType    string
+	replicas    int
+	mutex       sync.RWMutex
+	ring        []vnode        // sorted by hash
+	tracked     map[any]string // tracked key -> owner
+	subscribers []*chanrpc.Server
+}
+
+// vnode is a virtual node on the ring.
+type vnode struct {
+	hash uint32
+	name string
+}
+
+var (
+	routers        []*Router // guarded by agentsMutex
+	rebalanceMutex sync.Mutex
+)
+
+// NewRouter creates a router over the nodes of nodeType, each placed replicas times on the ring (100 if 0).
+// goroutine safe
+func NewRouter(nodeType string, replicas int) *Router {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	r := &Router{
+		nodeType: nodeType,
+		replicas: replicas,
+		tracked:  make(map[any]string),
+	}
+
+	rebalanceMutex.Lock()
+	defer rebalanceMutex.Unlock()
+
+	agentsMutex.Lock()
+	routers = append(routers, r)
+	members := r.members()
+	agentsMutex.Unlock()
+
+	r.rebuild(members)
+	return r
+}
+
+// Subscribe delivers the moves of the tracked keys to server, which must register
+// the function "KeysMoved", called with a []KeyMove.
+func (r *Router) Subscribe(server *chanrpc.Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.subscribers = append(r.subscribers, server)
+}
+
+// Owner returns the name of the node owning key, "" if no node of the type is live.
+// goroutine safe
+func (r *Router) Owner(key any) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.owner(hashKey(key))
+}
+
+// Local reports whether this node owns key.
+// goroutine safe
+func (r *Router) Local(key any) bool {
+	return conf.NodeName != "" && r.Owner(key) == conf.NodeName
+}
+
+// Get returns the agent of the node owning key, nil if the key is owned by this node or no node is live.
+// goroutine safe
+func (r *Router) Get(key any) *Agent {
+	owner := r.Owner(key)
+	if owner == "" || owner == conf.NodeName {
+		return nil
+	}
+	return GetNode(owner)
+}
+
+// SendTo writes msg to the node owning key.
+// goroutine safe
+func (r *Router) SendTo(key any, msg any) error {
+	owner := r.Owner(key)
+	switch owner {
+	case "":
+		return ErrNoNode
+	case conf.NodeName:
+		return ErrLocalKey
+	}
+	a := GetNode(owner)
+	if a == nil {
+		return ErrNoNode
+	}
+	a.WriteMsg(msg)
+	return nil
+}
+
+// Track adds key to the keys reported by KeysMoved and returns its owner,
+// the key must be comparable, e.g. the ids of the players online on this node.
+// goroutine safe
+func (r *Router) Track(key any) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	owner := r.owner(hashKey(key))
+	r.tracked[key] = owner
+	return owner
+}
+
+// Untrack removes a key added by Track.
+// goroutine safe
+func (r *Router) Untrack(key any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.tracked, key)
+}
+
+// members returns the names of the live nodes of the router type.
+// must be called with agentsMutex held
+func (r *Router) members() []string {
+	var names []string
+	if conf.NodeName != "" && conf.NodeType == r.nodeType {
+		names = append(names, conf.NodeName)
+	}
+	for name, a := range nodes {
+		if a.node.Type == r.nodeType {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// rebuild replaces the ring and reports the tracked keys that moved.
+func (r *Router) rebuild(names []string) {
+	ring := make([]vnode, 0, len(names)*r.replicas)
+	for _, name := range names {
+		for i := range r.replicas {
+			ring = append(ring, vnode{hash: crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))), name: name})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].name < ring[j].name
+	})
+
+	r.mutex.Lock()
+	r.ring = ring
+	var moves []KeyMove
+	for key, from := range r.tracked {
+		if to := r.owner(hashKey(key)); to != from {
+			r.tracked[key] = to
+			moves = append(moves, KeyMove{Key: key, From: from, To: to})
+		}
+	}
+	subscribers := r.subscribers
+	r.mutex.Unlock()
+
+	if len(moves) == 0 {
+		return
+	}
+	for _, s := range subscribers {
+		s.Go("KeysMoved", moves)
+	}
+}
+
+// owner must be called with the mutex held.
+func (r *Router) owner(h uint32) string {
+	if len(r.ring) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+	if i == len(r.ring) {
+		i = 0
+	}
+	return r.ring[i].name
+}
+
+// rebalance rebuilds the rings after a membership change.
+func rebalance() {
+	rebalanceMutex.Lock()
+	defer rebalanceMutex.Unlock()
+
+	agentsMutex.Lock()
+	rs := routers
+	members := make([][]string, len(rs))
+	for i, r := range rs {
+		members[i] = r.members()
+	}
+	agentsMutex.Unlock()
+
+	for i, r := range rs {
+		r.rebuild(members[i])
+	}
+}
+
+func hashKey(key any) uint32 {
+	var b [8]byte
+	switch k := key.(type) {
+	case string:
+		return crc32.ChecksumIEEE([]byte(k))
+	case int:
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+	case int32:
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+	case int64:
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+	case uint:
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+	case uint32:
+		binary.BigEndian.PutUint64(b[:], uint64(k))
+	case uint64:
+		binary.BigEndian.PutUint64(b[:], k)
+	default:
+		return crc32.ChecksumIEEE([]byte(fmt.Sprint(k)))
+	}
+	return crc32.ChecksumIEEE(b[:])
+}
@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gserv/network/protobuf"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// newTestRouter creates a router forgotten at the end of the test.
+func newTestRouter(t *testing.T, nodeType string) *Router {
+	r := NewRouter(nodeType, 0)
+	t.Cleanup(func() {
+		agentsMutex.Lock()
+		routers = nil
+		agentsMutex.Unlock()
+	})
+	return r
+}
+
+func owners(r *Router, n int) map[int]string {
+	ret := make(map[int]string, n)
+	for key := range n {
+		ret[key] = r.Owner(key)
+	}
+	return ret
+}
+
+func TestRouterRing(t *testing.T) {
+	r := newTestRouter(t, "battle")
+	if r.Owner(1) != "" {
+		t.Fatal("owner without nodes")
+	}
+
+	r.rebuild([]string{"a", "b", "c"})
+	const n = 3000
+	before := owners(r, n)
+	count := make(map[string]int)
+	for _, owner := range before {
+		count[owner]++
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if count[name] < n/5 || count[name] > n/2 {
+			t.Fatalf("unbalanced ring: %v", count)
+		}
+	}
+
+	// the same members give the same ring whatever their order
+	r.rebuild([]string{"c", "a", "b"})
+	for key, owner := range owners(r, n) {
+		if before[key] != owner {
+			t.Fatalf("key %v: %v, was %v", key, owner, before[key])
+		}
+	}
+
+	// only the keys of a leaving node move
+	r.rebuild([]string{"a", "b"})
+	for key, owner := range owners(r, n) {
+		if before[key] != "c" && before[key] != owner {
+			t.Fatalf("key %v moved from %v to %v", key, before[key], owner)
+		}
+		if owner == "c" {
+			t.Fatal("key owned by the node left")
+		}
+	}
+
+	// a joining node only takes keys
+	r.rebuild([]string{"a", "b", "c", "d"})
+	for key, owner := range owners(r, n) {
+		if before[key] != owner && owner != "d" {
+			t.Fatalf("key %v moved from %v to %v", key, before[key], owner)
+		}
+	}
+}
+
+func TestRouterKeyTypes(t *testing.T) {
+	for _, pair := range [][2]any{{1, int64(1)}, {int32(7), uint64(7)}, {"user1", "user1"}} {
+		if hashKey(pair[0]) != hashKey(pair[1]) {
+			t.Fatalf("%T %v and %T %v hash differently", pair[0], pair[0], pair[1], pair[1])
+		}
+	}
+	if hashKey(1) == hashKey("1") || hashKey(struct{ a int }{1}) != hashKey(struct{ a int }{1}) {
+		t.Fatal("hashKey")
+	}
+}
+
+func TestRouterKeysMoved(t *testing.T) {
+	r := newTestRouter(t, "battle")
+	moved := make(chan []KeyMove, 10)
+	s := chanrpc.NewServer(10)
+	s.Register("KeysMoved", func(args []any) { moved <- args[0].([]KeyMove) })
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	defer close(s.ChanCall)
+	r.Subscribe(s)
+
+	r.rebuild([]string{"a", "b"})
+	var keyA, keyB int
+	for key := range 100 {
+		if r.Owner(key) == "a" {
+			keyA = key
+		} else {
+			keyB = key
+		}
+	}
+	if r.Track(keyA) != "a" || r.Track(keyB) != "b" {
+		t.Fatal("Track")
+	}
+	r.Track(-1)
+	r.Untrack(-1)
+
+	r.rebuild([]string{"b"})
+	select {
+	case moves := <-moved:
+		if len(moves) != 1 || moves[0] != (KeyMove{Key: keyA, From: "a", To: "b"}) {
+			t.Fatalf("moves = %+v", moves)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no KeysMoved")
+	}
+
+	r.rebuild(nil)
+	select {
+	case moves := <-moved:
+		if len(moves) != 2 || moves[0].To != "" {
+			t.Fatalf("moves = %+v", moves)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no KeysMoved")
+	}
+}
+
+func TestRouterSendTo(t *testing.T) {
+	setConf(t, &conf.NodeName, "gate1")
+	setConf(t, &conf.NodeType, "gate")
+	p := protobuf.NewProcessor()
+	p.Register(&wrapperspb.StringValue{})
+	setConf(t, &Processor, p)
+
+	r := newTestRouter(t, "battle")
+	if err := r.SendTo(1, &wrapperspb.StringValue{}); !errors.Is(err, ErrNoNode) {
+		t.Fatalf("err = %v, want ErrNoNode", err)
+	}
+
+	// the ring follows the node registry
+	a, peer, _ := accept(t)
+	peer.send(frameHello, Node{Name: "battle1", Type: "battle"})
+	waitFor(t, "battle1 in the ring", func() bool { return r.Owner(1) == "battle1" })
+	if r.Get(1) != a || r.Local(1) {
+		t.Fatal("Get or Local")
+	}
+	if err := r.SendTo(1, &wrapperspb.StringValue{Value: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	data := peer.next(frameMsg, nil)
+	msg, err := p.Unmarshal(data[1:])
+	if err != nil || msg.(*wrapperspb.StringValue).Value != "hi" {
+		t.Fatalf("msg = %v, %v", msg, err)
+	}
+
+	peer.conn.Close()
+	waitFor(t, "empty ring", func() bool { return r.Owner(1) == "" })
+}
+
+func TestRouterLocal(t *testing.T) {
+	setConf(t, &conf.NodeName, "battle0")
+	setConf(t, &conf.NodeType, "battle")
+
+	// this node takes part in the ring of its own type
+	r := newTestRouter(t, "battle")
+	if !r.Local("user1") || r.Get("user1") != nil {
+		t.Fatal("key not local")
+	}
+	if err := r.SendTo("user1", &wrapperspb.StringValue{}); !errors.Is(err, ErrLocalKey) {
+		t.Fatalf("err = %v, want ErrLocalKey", err)
+	}
+}
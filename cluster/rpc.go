@@ -0,0 +1,274 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+var (
+	// ErrLinkClosed is returned by the calls in flight when their cluster link drops.
+	ErrLinkClosed = errors.New("cluster link closed")
+	// ErrBusy is returned by the calls the remote node refused, conf.RPCMaxRequests requests being executed.
+	ErrBusy = errors.New("cluster node busy")
+)
+
+// requestSlots bounds the requests executed at once, its capacity is conf.RPCMaxRequests. set by Init
+var requestSlots chan struct{}
+
+// exposed maps a function name to the chanrpc server executing it.
+var exposed = make(map[string]*chanrpc.Server)
+
+// Expose lets the remote nodes call the function registered on server with the id name.
+// the call runs on the goroutine of the module owning server, arguments and results are
+// encoded with encoding/gob, so custom types must be registered with gob.Register.
+// must be called before Init
+func Expose(name string, server *chanrpc.Server) {
+	if _, ok := exposed[name]; ok {
+		logs.Fatal("cluster function %v is already exposed", name)
+	}
+	exposed[name] = server
+}
+
+// AsynCaller delivers the result of a call on the caller goroutine, implemented by
+// *chanrpc.Client and *module.Skeleton.
+type AsynCaller interface {
+	AsynCallFunc(call func() (any, error), cb any)
+}
+
+// request is a call sent to a remote node.
+type request struct {
+	Seq     uint64
+	Name    string
+	N       int           // 0, 1 or 2, the return kind expected by the caller as in chanrpc
+	Timeout time.Duration // time left to the caller, 0 means no deadline
+	Args    []any
+}
+
+// response is the result of a request.
+type response struct {
+	Seq    uint64
+	Ret    []any
+	Err    string
+	Failed bool
+	Busy   bool // the request was refused, see ErrBusy
+}
+
+// Call0 calls a function exposed by the remote node and waits for it until ctx is done.
+// conf.RPCTimeout applies if ctx has no deadline
+// goroutine safe
+func (a *Agent) Call0(ctx context.Context, name string, args ...any) error {
+	_, err := a.call(ctx, name, 0, args)
+	return err
+}
+
+// Call1 is like Call0 for a function returning one value.
+// goroutine safe
+func (a *Agent) Call1(ctx context.Context, name string, args ...any) (any, error) {
+	ret, err := a.call(ctx, name, 1, args)
+	if err != nil {
+		return nil, err
+	}
+	return ret[0], nil
+}
+
+// CallN is like Call0 for a function returning several values.
+// goroutine safe
+func (a *Agent) CallN(ctx context.Context, name string, args ...any) ([]any, error) {
+	return a.call(ctx, name, 2, args)
+}
+
+// AsynCall calls a function exposed by the remote node without blocking, the last argument is the
+// callback, one of func(error), func(any, error) or func([]any, error) as in chanrpc.Client.AsynCall.
+// the callback runs on the caller goroutine, conf.RPCTimeout applies
+func AsynCall(caller AsynCaller, a *Agent, name string, _args ...any) {
+	if len(_args) < 1 {
+		panic("callback function not found")
+	}
+
+	args := _args[:len(_args)-1]
+	cb := _args[len(_args)-1]
+	var call func() (any, error)
+	switch cb.(type) {
+	case func(error):
+		call = func() (any, error) {
+			return nil, a.Call0(context.Background(), name, args...)
+		}
+	case func(any, error):
+		call = func() (any, error) {
+			return a.Call1(context.Background(), name, args...)
+		}
+	case func([]any, error):
+		call = func() (any, error) {
+			return a.CallN(context.Background(), name, args...)
+		}
+	default:
+		panic("definition of callback function is invalid")
+	}
+	caller.AsynCallFunc(call, cb)
+}
+
+// call sends a request and waits for its response.
+func (a *Agent) call(ctx context.Context, name string, n int, args []any) ([]any, error) {
+	if _, ok := ctx.Deadline(); !ok && conf.Hot().RPCTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Hot().RPCTimeout)
+		defer cancel()
+	}
+
+	chanRet := make(chan *response, 1)
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return nil, fmt.Errorf("cluster call %v: %w", name, ErrLinkClosed)
+	}
+	a.seq++
+	seq := a.seq
+	a.pending[seq] = chanRet
+	a.mutex.Unlock()
+
+	defer func() {
+		a.mutex.Lock()
+		delete(a.pending, seq)
+		a.mutex.Unlock()
+	}()
+
+	req := &request{Seq: seq, Name: name, N: n, Args: args}
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(deadline)
+	}
+	data, err := encode(frameRequest, req)
+	if err != nil {
+		return nil, fmt.Errorf("cluster call %v: %v", name, err)
+	}
+	if err := a.conn.WriteMsg(data); err != nil {
+		return nil, fmt.Errorf("cluster call %v: %v", name, err)
+	}
+
+	select {
+	case resp := <-chanRet:
+		if resp == nil {
+			return nil, fmt.Errorf("cluster call %v: %w", name, ErrLinkClosed)
+		}
+		if resp.Busy {
+			return nil, fmt.Errorf("cluster call %v: %w", name, ErrBusy)
+		}
+		if resp.Failed {
+			return nil, fmt.Errorf("cluster call %v: %v", name, resp.Err)
+		}
+		if n == 1 && len(resp.Ret) != 1 {
+			return nil, fmt.Errorf("cluster call %v: invalid response", name)
+		}
+		return resp.Ret, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("cluster call %v: %w", name, ctx.Err())
+	}
+}
+
+// handleResponse hands a response to the waiting call, late responses are dropped.
+func (a *Agent) handleResponse(resp *response) {
+	a.mutex.Lock()
+	chanRet := a.pending[resp.Seq]
+	delete(a.pending, resp.Seq)
+	a.mutex.Unlock()
+
+	if chanRet != nil {
+		chanRet <- resp
+	}
+}
+
+// startRequest executes a request on its own goroutine if a slot is free, it is answered busy otherwise.
+func (a *Agent) startRequest(req *request) {
+	slots := requestSlots
+	select {
+	case slots <- struct{}{}:
+	default:
+		a.writeResponse(req.Name, &response{Seq: req.Seq, Failed: true, Busy: true, Err: ErrBusy.Error()})
+		return
+	}
+	go func() {
+		defer func() { <-slots }()
+		a.handleRequest(req)
+	}()
+}
+
+// handleRequest executes a request on the exposing module and writes the response.
+func (a *Agent) handleRequest(req *request) {
+	resp := &response{Seq: req.Seq}
+	ret, err := execRequest(req)
+	if err != nil {
+		resp.Failed, resp.Err = true, err.Error()
+	} else {
+		resp.Ret = ret
+	}
+	a.writeResponse(req.Name, resp)
+}
+
+func (a *Agent) writeResponse(name string, resp *response) {
+	data, err := encode(frameResponse, resp)
+	if err != nil {
+		logs.Error("cluster call %v: encode response error: %v", name, err)
+		data, _ = encode(frameResponse, &response{Seq: resp.Seq, Failed: true, Err: err.Error()})
+	}
+	if err := a.conn.WriteMsg(data); err != nil {
+		logs.Error("cluster call %v: write response error: %v", name, err)
+	}
+}
+
+func execRequest(req *request) ([]any, error) {
+	server := exposed[req.Name]
+	if server == nil {
+		return nil, fmt.Errorf("function %v: not exposed", req.Name)
+	}
+
+	ctx := context.Background()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
+	}
+
+	switch req.N {
+	case 0:
+		return nil, server.Call0Context(ctx, req.Name, req.Args...)
+	case 1:
+		ret, err := server.Call1Context(ctx, req.Name, req.Args...)
+		return []any{ret}, err
+	case 2:
+		return server.CallNContext(ctx, req.Name, req.Args...)
+	default:
+		return nil, fmt.Errorf("function %v: invalid return kind %v", req.Name, req.N)
+	}
+}
+
+// failPending fails the calls in flight, no call can be made after it.
+func (a *Agent) failPending() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.closed = true
+	for seq, chanRet := range a.pending {
+		chanRet <- nil
+		delete(a.pending, seq)
+	}
+}
+
+func encode(kind byte, v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(kind)
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
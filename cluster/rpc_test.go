@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+)
+
+func TestHandleRequest(t *testing.T) {
+	requestSlots = make(chan struct{}, 10)
+	s := chanrpc.NewServer(10)
+	s.Register("add", func(args []any) any { return args[0].(int) + args[1].(int) })
+	s.Register("fail", func(args []any) { panic("boom") })
+	expose(t, s, "add", "fail")
+	_, p, _ := accept(t)
+
+	var resp response
+	p.send(frameRequest, &request{Seq: 1, Name: "add", N: 1, Args: []any{1, 2}})
+	p.next(frameResponse, &resp)
+	if resp.Seq != 1 || resp.Failed || len(resp.Ret) != 1 || resp.Ret[0] != 3 {
+		t.Fatalf("add = %+v", resp)
+	}
+
+	for _, tc := range []struct {
+		req *request
+		err string
+	}{
+		{&request{Seq: 2, Name: "fail"}, "boom"},
+		{&request{Seq: 3, Name: "missing"}, "not exposed"},
+		{&request{Seq: 4, Name: "add", N: 7}, "invalid return kind"},
+	} {
+		resp = response{}
+		p.send(frameRequest, tc.req)
+		p.next(frameResponse, &resp)
+		if resp.Seq != tc.req.Seq || !resp.Failed || resp.Busy || !strings.Contains(resp.Err, tc.err) {
+			t.Fatalf("%v = %+v, want %q", tc.req.Name, resp, tc.err)
+		}
+	}
+}
+
+func TestHandleRequestBusy(t *testing.T) {
+	requestSlots = make(chan struct{}, 2)
+	release := make(chan struct{})
+	s := chanrpc.NewServer(10)
+	s.Register("block", func(args []any) { <-release })
+	s.Register("noop", func(args []any) {})
+	expose(t, s, "block", "noop")
+	_, p, _ := accept(t)
+
+	// the two slots are taken, the third request is refused without running
+	for seq := uint64(1); seq <= 3; seq++ {
+		p.send(frameRequest, &request{Seq: seq, Name: "block"})
+	}
+	var resp response
+	p.next(frameResponse, &resp)
+	if resp.Seq != 3 || !resp.Busy || !resp.Failed {
+		t.Fatalf("resp = %+v, want busy 3", resp)
+	}
+
+	close(release)
+	for range 2 {
+		resp = response{}
+		p.next(frameResponse, &resp)
+		if resp.Failed {
+			t.Fatalf("resp = %+v", resp)
+		}
+	}
+
+	// the slots are given back
+	waitFor(t, "free slots", func() bool { return len(requestSlots) == 0 })
+	p.send(frameRequest, &request{Seq: 4, Name: "noop"})
+	resp = response{}
+	p.next(frameResponse, &resp)
+	if resp.Seq != 4 || resp.Failed {
+		t.Fatalf("resp = %+v", resp)
+	}
+}
+
+func TestCall(t *testing.T) {
+	a, p, _ := accept(t)
+
+	type result struct {
+		ret any
+		err error
+	}
+	call := func(ctx context.Context, args ...any) chan result {
+		done := make(chan result, 1)
+		go func() {
+			ret, err := a.Call1(ctx, "f", args...)
+			done <- result{ret, err}
+		}()
+		return done
+	}
+
+	// answered
+	done := call(context.Background(), "x")
+	var req request
+	p.next(frameRequest, &req)
+	if req.Name != "f" || req.N != 1 || req.Args[0] != "x" || req.Timeout <= 0 {
+		t.Fatalf("request = %+v, want the rpc timeout", req)
+	}
+	p.send(frameResponse, &response{Seq: req.Seq, Ret: []any{"y"}})
+	if r := <-done; r.err != nil || r.ret != "y" {
+		t.Fatalf("call = %v, %v", r.ret, r.err)
+	}
+
+	// refused or failed remotely
+	done = call(context.Background())
+	p.next(frameRequest, &req)
+	p.send(frameResponse, &response{Seq: req.Seq, Failed: true, Busy: true, Err: ErrBusy.Error()})
+	if r := <-done; !errors.Is(r.err, ErrBusy) {
+		t.Fatalf("err = %v, want ErrBusy", r.err)
+	}
+	done = call(context.Background())
+	p.next(frameRequest, &req)
+	p.send(frameResponse, &response{Seq: req.Seq, Failed: true, Err: "boom"})
+	if r := <-done; r.err == nil || !strings.Contains(r.err.Error(), "boom") || errors.Is(r.err, ErrBusy) {
+		t.Fatalf("err = %v, want boom", r.err)
+	}
+
+	// not answered in time, the late response is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if r := <-call(ctx); !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", r.err)
+	}
+	p.next(frameRequest, &req)
+	p.send(frameResponse, &response{Seq: req.Seq})
+
+	// in flight when the link drops
+	done = call(context.Background())
+	p.next(frameRequest, &req)
+	p.conn.Close()
+	if r := <-done; !errors.Is(r.err, ErrLinkClosed) {
+		t.Fatalf("err = %v, want ErrLinkClosed", r.err)
+	}
+	if _, err := a.Call1(context.Background(), "f"); !errors.Is(err, ErrLinkClosed) {
+		t.Fatalf("err = %v, want ErrLinkClosed after the drop", err)
+	}
+}
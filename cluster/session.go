@@ -0,0 +1,254 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/network"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Gateway mode: a gate node forwards client messages to backend nodes together with a session id,
+// the backends answer through the session, see gate.Gate.Forward.
+//
+// gate side:    OpenSession, Agent.Forward, CloseSession
+// backend side: SessionProcessor, SessionChanRPC, Session
+//
+// the first message of a session forwarded to a backend opens the session there, a message
+// of a session the backend does not know is dropped: it was closed by its gate or its link.
+
+var (
+	// SessionProcessor decodes the client messages forwarded by the gates and encodes the
+	// messages written to a Session. it routes the messages with the *Session as user data
+	SessionProcessor network.Processor
+	// SessionChanRPC, if set, receives "NewSession" and "CloseSession" with the *Session
+	SessionChanRPC *chanrpc.Server
+)
+
+// gateSession is a client of this gate node.
+type gateSession struct {
+	conn     network.Conn
+	backends map[*Agent]struct{} // backends that received messages of the session
+}
+
+// ErrSessionClosed is returned by Agent.Forward for a session not open on this gate.
+var ErrSessionClosed = errors.New("cluster session closed")
+
+var (
+	sessionsMutex sync.Mutex
+	sessionSeq    uint64
+	gateSessions  = make(map[uint64]*gateSession)
+)
+
+// OpenSession registers a client connection of this gate node, it returns the session id
+// sent with the forwarded messages.
+// goroutine safe
+func OpenSession(conn network.Conn) uint64 {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sessionSeq++
+	gateSessions[sessionSeq] = &gateSession{conn: conn, backends: make(map[*Agent]struct{})}
+	return sessionSeq
+}
+
+// CloseSession unregisters a client connection and tells the backends it is closed.
+// goroutine safe
+func CloseSession(id uint64) {
+	sessionsMutex.Lock()
+	gs := gateSessions[id]
+	delete(gateSessions, id)
+	sessionsMutex.Unlock()
+
+	if gs == nil {
+		return
+	}
+	for backend := range gs.backends {
+		backend.writeSessionFrame(frameSessionClose, id)
+	}
+}
+
+// Forward sends a client message, as produced by the gate Processor, to the backend for a session.
+// the messages of a session must be forwarded from one goroutine, as the gate does, to keep their order.
+// goroutine safe
+func (a *Agent) Forward(sessionID uint64, data ...[]byte) error {
+	sessionsMutex.Lock()
+	gs := gateSessions[sessionID]
+	kind := frameForward
+	if gs != nil {
+		if _, ok := gs.backends[a]; !ok {
+			gs.backends[a] = struct{}{}
+			kind = frameForwardOpen
+		}
+	}
+	sessionsMutex.Unlock()
+
+	if gs == nil {
+		return fmt.Errorf("cluster session %v: %w", sessionID, ErrSessionClosed)
+	}
+	return a.conn.WriteMsg(append([][]byte{sessionHeader(kind, sessionID)}, data...)...)
+}
+
+// handlePush writes a message pushed by a backend to the client of the session.
+func handlePush(id uint64, data []byte) {
+	sessionsMutex.Lock()
+	gs := gateSessions[id]
+	sessionsMutex.Unlock()
+
+	if gs == nil {
+		return
+	}
+	if err := gs.conn.WriteMsg(data); err != nil {
+		logs.Error("write pushed message error: %v", err)
+	}
+}
+
+// handleKick closes the client of the session on behalf of a backend.
+func handleKick(id uint64) {
+	sessionsMutex.Lock()
+	gs := gateSessions[id]
+	sessionsMutex.Unlock()
+
+	if gs != nil {
+		gs.conn.Close()
+	}
+}
+
+// dropBackend forgets a backend whose link is closed, its sessions stay open on the gate.
+func dropBackend(a *Agent) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for _, gs := range gateSessions {
+		delete(gs.backends, a)
+	}
+}
+
+// Session is a client connected to a gate node, as seen by a backend node.
+type Session struct {
+	id       uint64
+	gate     *Agent
+	userData any
+}
+
+// ID returns the session id, unique per gate node.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Gate returns the agent of the gate node holding the client connection.
+func (s *Session) Gate() *Agent {
+	return s.gate
+}
+
+// WriteMsg marshals msg with SessionProcessor and sends it to the client.
+// goroutine safe
+func (s *Session) WriteMsg(msg any) {
+	if SessionProcessor == nil {
+		logs.Error("write message %v error: cluster SessionProcessor is not set", reflect.TypeOf(msg))
+		return
+	}
+	data, err := SessionProcessor.Marshal(msg)
+	if err != nil {
+		logs.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return
+	}
+	err = s.gate.conn.WriteMsg(append([][]byte{sessionHeader(framePush, s.id)}, data...)...)
+	if err != nil {
+		logs.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+	}
+}
+
+// Close asks the gate to close the client connection.
+func (s *Session) Close() {
+	s.gate.writeSessionFrame(frameKick, s.id)
+}
+
+// UserData returns the user data associated with the session.
+func (s *Session) UserData() any {
+	return s.userData
+}
+
+// SetUserData sets the user data associated with the session.
+func (s *Session) SetUserData(data any) {
+	s.userData = data
+}
+
+// handleForward routes a client message forwarded by a gate, open is set by the first message of the session.
+func (a *Agent) handleForward(id uint64, data []byte, open bool) {
+	a.mutex.Lock()
+	s := a.sessions[id]
+	isNew := s == nil
+	if isNew {
+		if !open {
+			// closed while the message was in flight, do not recreate it
+			a.mutex.Unlock()
+			logs.Debug("message of closed session %v dropped", id)
+			return
+		}
+		s = &Session{id: id, gate: a}
+		a.sessions[id] = s
+	}
+	a.mutex.Unlock()
+
+	if isNew && SessionChanRPC != nil {
+		SessionChanRPC.Go("NewSession", s)
+	}
+	if SessionProcessor == nil {
+		return
+	}
+
+	msg, err := SessionProcessor.Unmarshal(data)
+	if err != nil {
+		logs.Debug("unmarshal forwarded message error: %v", err)
+		return
+	}
+	if err := SessionProcessor.Route(msg, s); err != nil {
+		logs.Debug("route forwarded message error: %v", err)
+	}
+}
+
+// handleSessionClose ends a session closed by its gate.
+func (a *Agent) handleSessionClose(id uint64) {
+	a.mutex.Lock()
+	s := a.sessions[id]
+	delete(a.sessions, id)
+	a.mutex.Unlock()
+
+	if s != nil && SessionChanRPC != nil {
+		SessionChanRPC.Go("CloseSession", s)
+	}
+}
+
+// closeSessions ends the sessions of a gate whose link is closed.
+func (a *Agent) closeSessions() {
+	a.mutex.Lock()
+	sessions := a.sessions
+	a.sessions = make(map[uint64]*Session)
+	a.mutex.Unlock()
+
+	if SessionChanRPC == nil {
+		return
+	}
+	for _, s := range sessions {
+		SessionChanRPC.Go("CloseSession", s)
+	}
+}
+
+func (a *Agent) writeSessionFrame(kind byte, id uint64) {
+	if err := a.conn.WriteMsg(sessionHeader(kind, id)); err != nil {
+		logs.Error("write cluster session frame error: %v", err)
+	}
+}
+
+// sessionHeader is the frame kind followed by the session id.
+func sessionHeader(kind byte, id uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], id)
+	return b
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/network"
+	"github.com/yinyihanbing/gserv/network/protobuf"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// sessionFrame is a session frame as written by the peer: kind, session id, payload.
+func sessionFrame(kind byte, id uint64, payload ...[]byte) []byte {
+	return append(sessionHeader(kind, id), bytes.Join(payload, nil)...)
+}
+
+// backendSetup sets the backend side processor and chanrpc server, it returns the messages
+// routed to the sessions and the session events.
+func backendSetup(t *testing.T) (*protobuf.Processor, chan string, chan string) {
+	routed := make(chan string, 10)
+	events := make(chan string, 10)
+
+	p := protobuf.NewProcessor()
+	p.Register(&wrapperspb.StringValue{})
+	p.SetHandler(&wrapperspb.StringValue{}, func(args []any) {
+		routed <- args[0].(*wrapperspb.StringValue).Value
+	})
+	setConf[network.Processor](t, &SessionProcessor, p)
+
+	s := chanrpc.NewServer(10)
+	s.Register("NewSession", func(args []any) { events <- "new" })
+	s.Register("CloseSession", func(args []any) { events <- "close" })
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	t.Cleanup(func() { close(s.ChanCall) })
+	setConf(t, &SessionChanRPC, s)
+	return p, routed, events
+}
+
+func expectNothing(t *testing.T, chans ...chan string) {
+	t.Helper()
+	for _, c := range chans {
+		select {
+		case v := <-c:
+			t.Fatalf("unexpected %v", v)
+		case <-time.After(30 * time.Millisecond):
+		}
+	}
+}
+
+func TestBackendSession(t *testing.T) {
+	p, routed, events := backendSetup(t)
+	a, peer, _ := accept(t)
+
+	msg := func(s string) []byte {
+		data, err := p.Marshal(&wrapperspb.StringValue{Value: s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Join(data, nil)
+	}
+
+	// the first message opens the session
+	peer.write(sessionFrame(frameForwardOpen, 1, msg("login")))
+	expectEvent(t, events, "new")
+	expectEvent(t, routed, "login")
+	peer.write(sessionFrame(frameForward, 1, msg("move")))
+	expectEvent(t, routed, "move")
+
+	// the backend answers through the session
+	a.mutex.Lock()
+	s := a.sessions[1]
+	a.mutex.Unlock()
+	if s == nil || s.ID() != 1 || s.Gate() != a {
+		t.Fatalf("session = %+v", s)
+	}
+	s.WriteMsg(&wrapperspb.StringValue{Value: "welcome"})
+	push := peer.next(framePush, nil)
+	if !bytes.Equal(push, sessionFrame(framePush, 1, msg("welcome"))) {
+		t.Fatalf("push = %v", push)
+	}
+	s.Close()
+	if kick := peer.next(frameKick, nil); binary.BigEndian.Uint64(kick[1:]) != 1 {
+		t.Fatalf("kick = %v", kick)
+	}
+
+	// a message in flight when the gate closed the session does not recreate it
+	peer.write(sessionFrame(frameSessionClose, 1))
+	expectEvent(t, events, "close")
+	peer.write(sessionFrame(frameForward, 1, msg("late")))
+	peer.write(sessionFrame(frameForward, 2, msg("unknown")))
+	expectNothing(t, events, routed)
+	a.mutex.Lock()
+	n := len(a.sessions)
+	a.mutex.Unlock()
+	if n != 0 {
+		t.Fatalf("%v zombie sessions", n)
+	}
+
+	// the sessions of a closed link are closed
+	peer.write(sessionFrame(frameForwardOpen, 3, msg("again")))
+	expectEvent(t, events, "new")
+	expectEvent(t, routed, "again")
+	peer.conn.Close()
+	expectEvent(t, events, "close")
+}
+
+func TestBackendSessionInvalidFrame(t *testing.T) {
+	_, p, _ := accept(t)
+	p.write([]byte{frameForward, 1, 2})
+	if !p.closed() {
+		t.Fatal("link kept after a truncated session frame")
+	}
+}
+
+// clientConn is a client connection of the gate, recording what it receives.
+type clientConn struct {
+	mu     sync.Mutex
+	msgs   [][]byte
+	closed bool
+}
+
+func (c *clientConn) ReadMsg() ([]byte, error) { return nil, errors.New("not readable") }
+func (c *clientConn) WriteMsg(args ...[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, bytes.Join(args, nil))
+	return nil
+}
+func (c *clientConn) LocalAddr() net.Addr  { return nil }
+func (c *clientConn) RemoteAddr() net.Addr { return nil }
+func (c *clientConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+func (c *clientConn) Destroy() { c.Close() }
+
+func TestGateSession(t *testing.T) {
+	a, backend, _ := accept(t)
+	client := new(clientConn)
+	id := OpenSession(client)
+	t.Cleanup(func() { CloseSession(id) })
+
+	// the first message to a backend opens the session there
+	if err := a.Forward(id, []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if f := backend.next(frameForwardOpen, nil); !bytes.Equal(f, sessionFrame(frameForwardOpen, id, []byte("ab"))) {
+		t.Fatalf("frame = %v", f)
+	}
+	a.Forward(id, []byte("c"))
+	if f := backend.read(); !bytes.Equal(f, sessionFrame(frameForward, id, []byte("c"))) {
+		t.Fatalf("frame = %v", f)
+	}
+
+	// the backend pushes to the client and kicks it
+	backend.write(sessionFrame(framePush, id, []byte("hello")))
+	backend.write(sessionFrame(frameKick, id))
+	waitFor(t, "kick", func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.closed
+	})
+	if len(client.msgs) != 1 || string(client.msgs[0]) != "hello" {
+		t.Fatalf("client received %q", client.msgs)
+	}
+
+	// closing tells the backends, the session cannot be forwarded anymore
+	CloseSession(id)
+	if f := backend.next(frameSessionClose, nil); binary.BigEndian.Uint64(f[1:]) != id {
+		t.Fatalf("frame = %v", f)
+	}
+	if err := a.Forward(id, []byte("late")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("err = %v, want ErrSessionClosed", err)
+	}
+}
+
+func TestGateSessionBackendReconnect(t *testing.T) {
+	a1, backend1, _ := accept(t)
+	id := OpenSession(new(clientConn))
+	t.Cleanup(func() { CloseSession(id) })
+
+	a1.Forward(id, []byte("x"))
+	backend1.next(frameForwardOpen, nil)
+
+	// the backend forgot the session with the link, the new link opens it again
+	backend1.conn.Close()
+	waitFor(t, "backend dropped", func() bool {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+		return len(gateSessions[id].backends) == 0
+	})
+	a2, backend2, _ := accept(t)
+	a2.Forward(id, []byte("y"))
+	if f := backend2.next(frameForwardOpen, nil); !bytes.Equal(f, sessionFrame(frameForwardOpen, id, []byte("y"))) {
+		t.Fatalf("frame = %v", f)
+	}
+}
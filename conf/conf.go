@@ -1,16 +1,55 @@
 package conf
 
+import (
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
 // LenStackBuf defines the length of the stack buffer.
 var (
 	LenStackBuf = 4096
 
+	// log configuration
+	LogLevel = logs.LevelDebug // log level applied by Load and Reload, see logs.LevelDebug
+
+	// reload configuration
+	ReloadInterval time.Duration // interval of the config file watcher, 0 disables it
+
 	// console configuration
 	ConsolePort   int                // port for console access
 	ConsolePrompt string = "Gserv# " // default console prompt
 	ProfilePath   string             // path for profile data
 
 	// cluster configuration
-	ListenAddr      string   // address to listen for incoming connections
-	ConnAddrs       []string // list of connection addresses
-	PendingWriteNum int      // number of pending writes allowed
+	ListenAddr      string                           // address to listen for incoming connections
+	ConnAddrs       []string                         // list of connection addresses
+	PendingWriteNum int                              // number of pending writes allowed
+	FlushTimeout    time.Duration = 3 * time.Second  // time allowed for links to flush pending writes on close
+	RPCTimeout      time.Duration = 10 * time.Second // timeout of cluster calls made without a deadline, 0 means wait forever
+	RPCMaxRequests  int           = 1000             // cluster requests from the peers executed at once, more are answered busy
+
+	// cluster TLS, the links are plaintext if ClusterCertFile is empty
+	ClusterCertFile string // certificate of this node, presented to both the nodes it dials and the ones dialing it
+	ClusterKeyFile  string // key of ClusterCertFile
+	ClusterCAFile   string // CA certificates verifying the peers, enables mutual TLS. the system ones verify the servers if empty
+
+	// cluster link health
+	HeartbeatInterval    time.Duration = 5 * time.Second  // interval of the link heartbeats, 0 disables them
+	HeartbeatTimeout     time.Duration = 15 * time.Second // a link silent for this long is closed, suspect after 2 intervals
+	MaxReconnectInterval time.Duration = time.Minute      // cap of the reconnect backoff, 3s doubled per failed attempt
+
+	// node identity, exchanged with the cluster peers on connect
+	NodeName          string                           // unique node name, e.g. "battle1"
+	NodeType          string                           // node type, e.g. "battle" or "chat"
+	NodeID            int                              // node id
+	NodeAddr          string                           // cluster address announced to the peers, ListenAddr if empty
+	DiscoveryInterval time.Duration = 10 * time.Second // interval of the cluster discovery refresh
+
+	// health check configuration
+	HealthCheckInterval time.Duration // interval of the module watchdog ping, 0 disables the watchdog
+	HealthCheckTimeout  time.Duration // time a module has to answer a ping before it is reported as stalled
+
+	// shutdown configuration
+	ShutdownTimeout time.Duration = 30 * time.Second // total time allowed for Stop, 0 means wait forever
 )
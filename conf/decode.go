@@ -0,0 +1,309 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// tagOptions holds the parsed `conf` tag of a field.
+type tagOptions struct {
+	skip     bool
+	required bool
+	secret   bool
+	hot      bool
+	min      *float64
+	max      *float64
+}
+
+func parseTag(sf reflect.StructField) tagOptions {
+	var opts tagOptions
+	for _, opt := range strings.Split(sf.Tag.Get("conf"), ",") {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == "-":
+			opts.skip = true
+		case opt == "required":
+			opts.required = true
+		case opt == "secret":
+			opts.secret = true
+		case opt == "hot":
+			opts.hot = true
+		case strings.HasPrefix(opt, "min="):
+			if n, err := strconv.ParseFloat(opt[4:], 64); err == nil {
+				opts.min = &n
+			}
+		case strings.HasPrefix(opt, "max="):
+			if n, err := strconv.ParseFloat(opt[4:], 64); err == nil {
+				opts.max = &n
+			}
+		}
+	}
+	return opts
+}
+
+// configurable reports whether a field can be set from a file.
+func configurable(sf reflect.StructField, opts tagOptions) bool {
+	return sf.IsExported() && !opts.skip && decodable(sf.Type)
+}
+
+func decodable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return decodable(t.Elem())
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && decodable(t.Elem())
+	case reflect.Struct:
+		for i := range t.NumField() {
+			if sf := t.Field(i); sf.IsExported() && !decodable(sf.Type) && !parseTag(sf).skip {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// normalize makes "max_conn_num", "max-conn-num" and "MaxConnNum" equal.
+func normalize(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+func envName(parts ...string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(strings.Join(parts, "_")))
+}
+
+// decodeStruct sets the fields of v from m, unknown keys are errors.
+func decodeStruct(path string, m map[string]any, v reflect.Value) []error {
+	var errs []error
+	t := v.Type()
+	fields := make(map[string]int, t.NumField())
+	for i := range t.NumField() {
+		if sf := t.Field(i); sf.IsExported() && !parseTag(sf).skip {
+			fields[normalize(sf.Name)] = i
+		}
+	}
+
+	for key, raw := range m {
+		i, ok := fields[normalize(key)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%v.%v: unknown key", path, key))
+			continue
+		}
+		sf := t.Field(i)
+		name := path + "." + sf.Name
+		if !decodable(sf.Type) {
+			errs = append(errs, fmt.Errorf("%v: cannot be configured from a file", name))
+			continue
+		}
+		if err := decodeValue(name, raw, v.Field(i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// decodeValue sets v from a value produced by the json, yaml or toml decoders or from an environment string.
+func decodeValue(path string, raw any, v reflect.Value) error {
+	if v.Type() == durationType {
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("%v: duration string like \"10s\" expected, got %v", path, raw)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%v: invalid duration %q", path, s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("%v: string expected, got %v", path, raw)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		switch b := raw.(type) {
+		case bool:
+			v.SetBool(b)
+		case string:
+			pb, err := strconv.ParseBool(b)
+			if err != nil {
+				return fmt.Errorf("%v: bool expected, got %q", path, b)
+			}
+			v.SetBool(pb)
+		default:
+			return fmt.Errorf("%v: bool expected, got %v", path, raw)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := toFloat(raw)
+		if err != nil || n != math.Trunc(n) || v.OverflowInt(int64(n)) {
+			return fmt.Errorf("%v: integer expected, got %v", path, raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := toFloat(raw)
+		if err != nil || n < 0 || n != math.Trunc(n) || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("%v: unsigned integer expected, got %v", path, raw)
+		}
+		v.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		n, err := toFloat(raw)
+		if err != nil {
+			return fmt.Errorf("%v: number expected, got %v", path, raw)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		var items []any
+		switch r := raw.(type) {
+		case []any:
+			items = r
+		case string:
+			for _, s := range strings.Split(r, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					items = append(items, s)
+				}
+			}
+		default:
+			return fmt.Errorf("%v: list expected, got %v", path, raw)
+		}
+		sl := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(fmt.Sprintf("%v[%v]", path, i), item, sl.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(sl)
+	case reflect.Map:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%v: table expected, got %v", path, raw)
+		}
+		mv := reflect.MakeMapWithSize(v.Type(), len(m))
+		for key, item := range m {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(path+"."+key, item, ev); err != nil {
+				return err
+			}
+			mv.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
+		}
+		v.Set(mv)
+	case reflect.Struct:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%v: table expected, got %v", path, raw)
+		}
+		if errs := decodeStruct(path, m, v); len(errs) > 0 {
+			return errs[0]
+		}
+	default:
+		return fmt.Errorf("%v: cannot be configured from a file", path)
+	}
+	return nil
+}
+
+func toFloat(raw any) (float64, error) {
+	switch n := raw.(type) {
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	default:
+		return 0, fmt.Errorf("not a number: %v", raw)
+	}
+}
+
+// applyEnv overrides the fields of v with the matching environment variables.
+func applyEnv(prefix string, path string, v reflect.Value) []error {
+	var errs []error
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !configurable(sf, parseTag(sf)) {
+			continue
+		}
+		name := envName(prefix, sf.Name)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			errs = append(errs, applyEnv(name, path+"."+sf.Name, fv)...)
+			continue
+		}
+		if fv.Kind() == reflect.Map {
+			continue
+		}
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := decodeValue(path+"."+sf.Name, s, fv); err != nil {
+			errs = append(errs, fmt.Errorf("%w (from %v)", err, name))
+		}
+	}
+	return errs
+}
+
+// validate checks the conf tags of v.
+func validate(path string, v reflect.Value) []error {
+	var errs []error
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		opts := parseTag(sf)
+		if !configurable(sf, opts) {
+			continue
+		}
+		name := path + "." + sf.Name
+		fv := v.Field(i)
+
+		if opts.required && fv.IsZero() {
+			errs = append(errs, fmt.Errorf("%v: required", name))
+			continue
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			errs = append(errs, validate(name, fv)...)
+			continue
+		}
+
+		var n float64
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(fv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(fv.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = fv.Float()
+		case reflect.String, reflect.Slice, reflect.Map:
+			n = float64(fv.Len())
+		default:
+			continue
+		}
+		if opts.min != nil && n < *opts.min {
+			errs = append(errs, fmt.Errorf("%v: must be >= %v, got %v", name, *opts.min, fv.Interface()))
+		}
+		if opts.max != nil && n > *opts.max {
+			errs = append(errs, fmt.Errorf("%v: must be <= %v, got %v", name, *opts.max, fv.Interface()))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,353 @@
+package conf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/yinyihanbing/gutils/logs"
+	"gopkg.in/yaml.v3"
+)
+
+// CoreSection is the file section holding the package level variables of conf.
+const CoreSection = "gserv"
+
+// EnvPrefix prefixes the environment variables overriding file values,
+// e.g. GSERV_GATE_MAXCONNNUM overrides MaxConnNum of the "gate" section.
+var EnvPrefix = "GSERV"
+
+// Validator is implemented by bound structs that need checks beyond the conf tags.
+type Validator interface {
+	Validate() error
+}
+
+// coreConfig mirrors the package level variables so they can be loaded like any bound struct.
+type coreConfig struct {
+	LenStackBuf          int           `conf:"min=0"`
+	LogLevel             int           `conf:"min=0,max=7,hot"`
+	ReloadInterval       time.Duration `conf:"min=0"`
+	ConsolePort          int           `conf:"min=0,max=65535"`
+	ConsolePrompt        string        `conf:"hot"`
+	ProfilePath          string        `conf:"hot"`
+	ListenAddr           string
+	ConnAddrs            []string
+	PendingWriteNum      int           `conf:"min=0"`
+	FlushTimeout         time.Duration `conf:"min=0"`
+	RPCTimeout           time.Duration `conf:"min=0,hot"`
+	RPCMaxRequests       int           `conf:"min=0"`
+	ClusterCertFile      string
+	ClusterKeyFile       string
+	ClusterCAFile        string
+	HeartbeatInterval    time.Duration `conf:"min=0"`
+	HeartbeatTimeout     time.Duration `conf:"min=0"`
+	MaxReconnectInterval time.Duration `conf:"min=0"`
+	NodeName             string
+	NodeType             string
+	NodeID               int
+	NodeAddr             string
+	DiscoveryInterval    time.Duration `conf:"min=0"`
+	HealthCheckInterval  time.Duration `conf:"min=0"`
+	HealthCheckTimeout   time.Duration `conf:"min=0"`
+	ShutdownTimeout      time.Duration `conf:"min=0,hot"`
+}
+
+// HotSettings holds the package level settings Reload may change while the server runs.
+type HotSettings struct {
+	LogLevel        int
+	ConsolePrompt   string
+	ProfilePath     string
+	RPCTimeout      time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// hot is set by Reload, nil until the first reload changing a hot setting.
+var hot atomic.Pointer[HotSettings]
+
+// Hot returns the running hot settings: the values applied by the last Reload, or the
+// package level variables if none. readers running beside Reload must use it instead of the variables.
+// goroutine safe
+func Hot() HotSettings {
+	if h := hot.Load(); h != nil {
+		return *h
+	}
+	return HotSettings{
+		LogLevel:        LogLevel,
+		ConsolePrompt:   ConsolePrompt,
+		ProfilePath:     ProfilePath,
+		RPCTimeout:      RPCTimeout,
+		ShutdownTimeout: ShutdownTimeout,
+	}
+}
+
+// currentCore returns the running core settings, the hot ones as reported by Hot.
+func currentCore() *coreConfig {
+	h := Hot()
+	return &coreConfig{
+		LenStackBuf:          LenStackBuf,
+		LogLevel:             h.LogLevel,
+		ReloadInterval:       ReloadInterval,
+		ConsolePort:          ConsolePort,
+		ConsolePrompt:        h.ConsolePrompt,
+		ProfilePath:          h.ProfilePath,
+		ListenAddr:           ListenAddr,
+		ConnAddrs:            ConnAddrs,
+		PendingWriteNum:      PendingWriteNum,
+		FlushTimeout:         FlushTimeout,
+		RPCTimeout:           h.RPCTimeout,
+		RPCMaxRequests:       RPCMaxRequests,
+		ClusterCertFile:      ClusterCertFile,
+		ClusterKeyFile:       ClusterKeyFile,
+		ClusterCAFile:        ClusterCAFile,
+		HeartbeatInterval:    HeartbeatInterval,
+		HeartbeatTimeout:     HeartbeatTimeout,
+		MaxReconnectInterval: MaxReconnectInterval,
+		NodeName:             NodeName,
+		NodeType:             NodeType,
+		NodeID:               NodeID,
+		NodeAddr:             NodeAddr,
+		DiscoveryInterval:    DiscoveryInterval,
+		HealthCheckInterval:  HealthCheckInterval,
+		HealthCheckTimeout:   HealthCheckTimeout,
+		ShutdownTimeout:      h.ShutdownTimeout,
+	}
+}
+
+// store writes the package level variables, it runs before the server starts.
+func (c *coreConfig) store() {
+	if c.LogLevel != Hot().LogLevel {
+		logs.SetLevel(c.LogLevel)
+	}
+	hot.Store(nil)
+
+	LenStackBuf = c.LenStackBuf
+	LogLevel = c.LogLevel
+	ReloadInterval = c.ReloadInterval
+	ConsolePort = c.ConsolePort
+	ConsolePrompt = c.ConsolePrompt
+	ProfilePath = c.ProfilePath
+	ListenAddr = c.ListenAddr
+	ConnAddrs = c.ConnAddrs
+	PendingWriteNum = c.PendingWriteNum
+	FlushTimeout = c.FlushTimeout
+	RPCTimeout = c.RPCTimeout
+	RPCMaxRequests = c.RPCMaxRequests
+	ClusterCertFile = c.ClusterCertFile
+	ClusterKeyFile = c.ClusterKeyFile
+	ClusterCAFile = c.ClusterCAFile
+	HeartbeatInterval = c.HeartbeatInterval
+	HeartbeatTimeout = c.HeartbeatTimeout
+	MaxReconnectInterval = c.MaxReconnectInterval
+	NodeName = c.NodeName
+	NodeType = c.NodeType
+	NodeID = c.NodeID
+	NodeAddr = c.NodeAddr
+	DiscoveryInterval = c.DiscoveryInterval
+	HealthCheckInterval = c.HealthCheckInterval
+	HealthCheckTimeout = c.HealthCheckTimeout
+	ShutdownTimeout = c.ShutdownTimeout
+}
+
+// publish makes the hot settings of c visible through Hot, the package level variables are kept.
+func (c *coreConfig) publish() {
+	if c.LogLevel != Hot().LogLevel {
+		logs.SetLevel(c.LogLevel)
+	}
+	hot.Store(&HotSettings{
+		LogLevel:        c.LogLevel,
+		ConsolePrompt:   c.ConsolePrompt,
+		ProfilePath:     c.ProfilePath,
+		RPCTimeout:      c.RPCTimeout,
+		ShutdownTimeout: c.ShutdownTimeout,
+	})
+}
+
+type binding struct {
+	section string
+	target  reflect.Value // pointer to the bound struct
+	running reflect.Value // private copy of the values given to the struct, compared by Reload
+}
+
+var bindings []*binding
+
+// Bind attaches a struct to a file section, e.g. Bind("gate", gate) or Bind("db", &dbConfig).
+// Fields are matched by name ignoring case and underscores, `conf` tags add checks:
+// required, min=N, max=N, secret (masked by Dump), hot (handed to OnReload by Reload) and - (ignored).
+// must be called before Load
+func Bind(section string, v any) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("conf section %v: struct pointer required", section))
+	}
+	if section == CoreSection {
+		panic(fmt.Sprintf("conf section %v: reserved", section))
+	}
+	for _, b := range bindings {
+		if b.section == section {
+			panic(fmt.Sprintf("conf section %v: already bound", section))
+		}
+	}
+	bindings = append(bindings, &binding{section: section, target: rv})
+}
+
+// Load reads a JSON, YAML or TOML file (chosen by extension), applies the environment
+// overrides and validates the result. nothing is modified if an error is returned
+func Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := LoadBytes(data, strings.TrimPrefix(filepath.Ext(path), ".")); err != nil {
+		return err
+	}
+
+	reloadMutex.Lock()
+	loadedPath = path
+	reloadMutex.Unlock()
+	return nil
+}
+
+// LoadBytes is like Load for in-memory data, format is json, yaml, yml or toml.
+func LoadBytes(data []byte, format string) error {
+	sections, err := parse(data, format)
+	if err != nil {
+		return err
+	}
+
+	core, values, err := decodeAll(sections)
+	if err != nil {
+		return err
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	core.store()
+	for i, b := range bindings {
+		b.target.Elem().Set(values[i])
+		b.running = values[i]
+	}
+	return nil
+}
+
+// parse decodes the file content into one generic map per section.
+func parse(data []byte, format string) (map[string]any, error) {
+	sections := make(map[string]any)
+	var err error
+	switch strings.ToLower(format) {
+	case "json":
+		err = json.Unmarshal(data, &sections)
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, &sections)
+	case "toml":
+		err = toml.Unmarshal(data, &sections)
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %v config: %v", format, err)
+	}
+	return sections, nil
+}
+
+// decodeAll decodes every section into a copy of its target, applies the environment
+// overrides and validates the copies. it returns one value per binding.
+func decodeAll(sections map[string]any) (*coreConfig, []reflect.Value, error) {
+	var errs []error
+
+	known := map[string]bool{CoreSection: true}
+	for _, b := range bindings {
+		known[b.section] = true
+	}
+	for name := range sections {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%v: unknown section", name))
+		}
+	}
+
+	core := currentCore()
+	errs = append(errs, decodeSection(CoreSection, sections[CoreSection], reflect.ValueOf(core).Elem())...)
+
+	values := make([]reflect.Value, len(bindings))
+	for i, b := range bindings {
+		// start from the values last given to the struct, the struct itself may be in use
+		v := reflect.New(b.target.Elem().Type()).Elem()
+		if b.running.IsValid() {
+			v.Set(b.running)
+		} else {
+			v.Set(b.target.Elem())
+		}
+		errs = append(errs, decodeSection(b.section, sections[b.section], v)...)
+		values[i] = v
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return core, values, nil
+}
+
+// decodeSection fills v from the section data and the environment, then validates it.
+func decodeSection(section string, data any, v reflect.Value) []error {
+	var errs []error
+	if data != nil {
+		m, ok := data.(map[string]any)
+		if !ok {
+			return []error{fmt.Errorf("%v: table expected, got %T", section, data)}
+		}
+		errs = append(errs, decodeStruct(section, m, v)...)
+	}
+	errs = append(errs, applyEnv(envName(EnvPrefix, section), section, v)...)
+	errs = append(errs, validate(section, v)...)
+	if val, ok := v.Addr().Interface().(Validator); ok {
+		if err := val.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", section, err))
+		}
+	}
+	return errs
+}
+
+// Dump returns the effective configuration, one "section.Field = value" per line,
+// including the hot settings applied by Reload. fields tagged secret are masked
+// goroutine safe
+func Dump() string {
+	var lines []string
+	dumpStruct(CoreSection, reflect.ValueOf(currentCore()).Elem(), &lines)
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	for _, b := range bindings {
+		if b.running.IsValid() {
+			dumpStruct(b.section, b.running, &lines)
+		} else {
+			dumpStruct(b.section, b.target.Elem(), &lines)
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+func dumpStruct(path string, v reflect.Value, lines *[]string) {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		opts := parseTag(sf)
+		if !configurable(sf, opts) {
+			continue
+		}
+		fv := v.Field(i)
+		name := path + "." + sf.Name
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			dumpStruct(name, fv, lines)
+			continue
+		}
+		if opts.secret && !fv.IsZero() {
+			*lines = append(*lines, name+" = ******")
+			continue
+		}
+		*lines = append(*lines, fmt.Sprintf("%v = %v", name, fv.Interface()))
+	}
+}
@@ -0,0 +1,188 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type dbConfig struct {
+	Addr     string        `conf:"required"`
+	Password string        `conf:"secret"`
+	MaxConn  int           `conf:"min=1,max=100,hot"`
+	Timeout  time.Duration `conf:"min=0"`
+	Tags     []string
+	Internal int `conf:"-"`
+	Limits   struct {
+		Rate  float64
+		Burst int `conf:"min=0"`
+	}
+}
+
+func (c *dbConfig) Validate() error {
+	if c.Addr == "invalid" {
+		return errors.New("addr rejected")
+	}
+	return nil
+}
+
+// reset forgets the bindings and restores the package level variables.
+func reset(t *testing.T) {
+	core := currentCore()
+	saved := bindings
+	bindings = nil
+	t.Cleanup(func() {
+		core.store()
+		bindings = saved
+		reloadMutex.Lock()
+		loadedPath = ""
+		subscribers = nil
+		reloadMutex.Unlock()
+	})
+}
+
+func TestLoadFormats(t *testing.T) {
+	for format, data := range map[string]string{
+		"json": `{"gserv": {"RPCTimeout": "3s"}, "db": {"addr": "127.0.0.1", "max_conn": 10, "timeout": "2s", "tags": ["a", "b"], "limits": {"rate": 1.5, "burst": 4}}}`,
+		"yaml": "gserv:\n  RPCTimeout: 3s\ndb:\n  addr: 127.0.0.1\n  max_conn: 10\n  timeout: 2s\n  tags: [a, b]\n  limits:\n    rate: 1.5\n    burst: 4\n",
+		"toml": "[gserv]\nRPCTimeout = \"3s\"\n[db]\naddr = \"127.0.0.1\"\nmax_conn = 10\ntimeout = \"2s\"\ntags = [\"a\", \"b\"]\n[db.limits]\nrate = 1.5\nburst = 4\n",
+	} {
+		t.Run(format, func(t *testing.T) {
+			reset(t)
+			var db dbConfig
+			Bind("db", &db)
+			if err := LoadBytes([]byte(data), format); err != nil {
+				t.Fatal(err)
+			}
+			if db.Addr != "127.0.0.1" || db.MaxConn != 10 || db.Timeout != 2*time.Second ||
+				strings.Join(db.Tags, ",") != "a,b" || db.Limits.Rate != 1.5 || db.Limits.Burst != 4 {
+				t.Fatalf("db = %+v", db)
+			}
+			if RPCTimeout != 3*time.Second {
+				t.Fatalf("RPCTimeout = %v", RPCTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	reset(t)
+	var db dbConfig
+	Bind("db", &db)
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	if err := os.WriteFile(path, []byte("db:\n  addr: localhost\n  max_conn: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if db.Addr != "localhost" {
+		t.Fatalf("addr = %v", db.Addr)
+	}
+	if err := Load(filepath.Join(t.TempDir(), "server.ini")); err == nil {
+		t.Fatal("missing file loaded")
+	}
+	if err := LoadBytes([]byte("x"), "ini"); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	reset(t)
+	var db dbConfig
+	Bind("db", &db)
+	t.Setenv("GSERV_DB_MAXCONN", "42")
+	t.Setenv("GSERV_DB_LIMITS_BURST", "7")
+	t.Setenv("GSERV_GSERV_NODENAME", "node-env")
+
+	if err := LoadBytes([]byte(`{"db": {"addr": "a", "max_conn": 10}}`), "json"); err != nil {
+		t.Fatal(err)
+	}
+	if db.MaxConn != 42 || db.Limits.Burst != 7 {
+		t.Fatalf("db = %+v, want the environment values", db)
+	}
+	if NodeName != "node-env" {
+		t.Fatalf("NodeName = %v", NodeName)
+	}
+
+	t.Setenv("GSERV_DB_MAXCONN", "many")
+	err := LoadBytes([]byte(`{"db": {"addr": "a"}}`), "json")
+	if err == nil || !strings.Contains(err.Error(), "GSERV_DB_MAXCONN") {
+		t.Fatalf("err = %v, want the variable name", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	reset(t)
+	db := dbConfig{Addr: "keep", MaxConn: 5}
+	Bind("db", &db)
+	oldLevel := LogLevel
+
+	for _, tc := range []struct {
+		data string
+		errs []string
+	}{
+		{`{"db": {"addr": ""}}`, []string{"db.Addr: required"}},
+		{`{"db": {"addr": "a", "max_conn": 0}}`, []string{"db.MaxConn: must be >= 1"}},
+		{`{"db": {"addr": "a", "max_conn": 101}}`, []string{"db.MaxConn: must be <= 100"}},
+		{`{"db": {"addr": "a", "limits": {"burst": -1}}}`, []string{"db.Limits.Burst: must be >= 0"}},
+		{`{"db": {"addr": "a", "timeout": "soon"}}`, []string{"db.Timeout: invalid duration"}},
+		{`{"db": {"addr": "a", "internal": 1}}`, []string{"db.internal: unknown key"}},
+		{`{"db": {"addr": "invalid"}}`, []string{"db: addr rejected"}},
+		{`{"cache": {}, "gserv": {"LogLevel": 9}, "db": {"addr": "a"}}`, []string{"cache: unknown section", "gserv.LogLevel: must be <= 7"}},
+	} {
+		err := LoadBytes([]byte(tc.data), "json")
+		if err == nil {
+			t.Fatalf("%v: loaded", tc.data)
+		}
+		for _, s := range tc.errs {
+			if !strings.Contains(err.Error(), s) {
+				t.Fatalf("%v: err = %v, want %q", tc.data, err, s)
+			}
+		}
+	}
+
+	// a failed load modifies nothing
+	if db.Addr != "keep" || db.MaxConn != 5 || LogLevel != oldLevel {
+		t.Fatalf("db = %+v, LogLevel = %v after failed loads", db, LogLevel)
+	}
+}
+
+func TestBindPanics(t *testing.T) {
+	reset(t)
+	Bind("db", &dbConfig{})
+	for name, f := range map[string]func(){
+		"not a pointer": func() { Bind("a", dbConfig{}) },
+		"reserved":      func() { Bind(CoreSection, &dbConfig{}) },
+		"twice":         func() { Bind("db", &dbConfig{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: no panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestDump(t *testing.T) {
+	reset(t)
+	db := dbConfig{Addr: "a", Password: "hunter2", MaxConn: 3}
+	Bind("db", &db)
+
+	s := Dump()
+	for _, want := range []string{"db.Addr = a", "db.Password = ******", "db.MaxConn = 3", "db.Limits.Burst = 0", "gserv.RPCTimeout = "} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("dump lacks %q:\n%v", want, s)
+		}
+	}
+	if strings.Contains(s, "hunter2") || strings.Contains(s, "Internal") {
+		t.Fatalf("dump leaks:\n%v", s)
+	}
+}
@@ -0,0 +1,275 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Hot reloadable settings, applied by Reload without a restart:
+//
+//	gserv.LogLevel, gserv.ConsolePrompt, gserv.ProfilePath, gserv.ShutdownTimeout, gserv.RPCTimeout
+//	gate.MaxConnNum, gate.PendingWriteNum (new connections only)
+//	storage.DbConfig.QueueLimitCount (the DbQueue memory queue limit)
+//	any field of a bound struct tagged `conf:"hot"`
+//
+// Reload never writes into running state: the package variables keep their loaded values
+// and the hot ones are published through Hot, a bound struct receives its hot changes through
+// OnReload (applied under its own lock) or its subscribers (applied on the module goroutine).
+//
+// Every other setting requires a restart, Reload reports and logs the changes but keeps
+// the running value. this includes the listen and connect addresses, the cluster
+// PendingWriteNum and the other storage configs.
+
+// Change describes one setting that differs between the running and the reloaded config.
+type Change struct {
+	Section string
+	Field   string
+	Old     any
+	New     any
+	Hot     bool // the new value is handed to OnReload and the subscribers, false means a restart is required
+	secret  bool
+}
+
+func (c Change) String() string {
+	old, cur := c.Old, c.New
+	if c.secret {
+		old, cur = "******", "******"
+	}
+	s := fmt.Sprintf("%v.%v: %v -> %v", c.Section, c.Field, old, cur)
+	if !c.Hot {
+		s += " (restart required)"
+	}
+	return s
+}
+
+// Reloader is implemented by bound structs that apply their hot settings themselves,
+// OnReload is called by Reload on the reloading goroutine with the hot changes. the struct
+// is not modified by Reload, OnReload must copy Change.New under the lock of its readers.
+type Reloader interface {
+	OnReload(changes []Change)
+}
+
+// Notifier is implemented by *chanrpc.Server, it lets a module receive the changes on its own goroutine.
+type Notifier interface {
+	Go(id any, args ...any)
+}
+
+type subscriber struct {
+	section string
+	n       Notifier
+	id      any
+}
+
+var (
+	reloadMutex sync.Mutex
+	loadedPath  string // path given to the last successful Load
+	subscribers []*subscriber
+
+	watcherMutex sync.Mutex
+	watcherSig   chan struct{}
+	watcherWg    sync.WaitGroup
+)
+
+// Subscribe sends the applied changes of a section to n after each Reload, as n.Go(id, []Change).
+// an empty section subscribes to every section. for a module:
+//
+//	conf.Subscribe("gate", skeleton.ChanRPCServer, "ConfigChanged")
+//	skeleton.RegisterChanRPC("ConfigChanged", func(args []any) { changes := args[0].([]conf.Change) })
+func Subscribe(section string, n Notifier, id any) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	subscribers = append(subscribers, &subscriber{section: section, n: n, id: id})
+}
+
+// Reload re-reads the file given to Load, applies the hot settings that changed and notifies
+// the subscribers. it returns every change, including the ones that require a restart.
+// nothing is modified if an error is returned
+// goroutine safe
+func Reload() ([]Change, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if loadedPath == "" {
+		return nil, errors.New("no config file loaded")
+	}
+	data, err := os.ReadFile(loadedPath)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := parse(data, strings.TrimPrefix(filepath.Ext(loadedPath), "."))
+	if err != nil {
+		return nil, err
+	}
+	core, values, err := decodeAll(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply the hot settings
+	var all []Change
+	applied := make(map[string][]Change)
+
+	changes := diff(CoreSection, reflect.ValueOf(currentCore()).Elem(), reflect.ValueOf(core).Elem())
+	all = append(all, changes...)
+	applied[CoreSection] = hotOnly(changes)
+	if len(applied[CoreSection]) > 0 {
+		core.publish()
+	}
+
+	reloaders := make(map[string]Reloader)
+	for i, b := range bindings {
+		if !b.running.IsValid() {
+			b.running = reflect.New(b.target.Elem().Type()).Elem()
+			b.running.Set(b.target.Elem())
+		}
+		changes := diff(b.section, b.running, values[i])
+		all = append(all, changes...)
+		applied[b.section] = hotOnly(changes)
+		if r, ok := b.target.Interface().(Reloader); ok {
+			reloaders[b.section] = r
+		}
+	}
+
+	for _, c := range all {
+		if c.Hot {
+			logs.Info("config reloaded %v", c)
+		} else {
+			logs.Warn("config changed %v", c)
+		}
+	}
+
+	// notify
+	for section, changes := range applied {
+		if len(changes) == 0 {
+			continue
+		}
+		if r := reloaders[section]; r != nil {
+			r.OnReload(changes)
+		}
+		for _, s := range subscribers {
+			if s.section == "" || s.section == section {
+				s.n.Go(s.id, changes)
+			}
+		}
+	}
+	return all, nil
+}
+
+// diff compares the top level fields of running and loaded, the hot ones are copied into running.
+// running must be a private copy, the bound structs only get their values through OnReload.
+func diff(section string, running reflect.Value, loaded reflect.Value) []Change {
+	var changes []Change
+	t := running.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		opts := parseTag(sf)
+		if !configurable(sf, opts) {
+			continue
+		}
+		old, cur := running.Field(i), loaded.Field(i)
+		if reflect.DeepEqual(old.Interface(), cur.Interface()) {
+			continue
+		}
+		changes = append(changes, Change{
+			Section: section,
+			Field:   sf.Name,
+			Old:     old.Interface(),
+			New:     cur.Interface(),
+			Hot:     opts.hot,
+			secret:  opts.secret,
+		})
+		if opts.hot {
+			old.Set(cur)
+		}
+	}
+	return changes
+}
+
+func hotOnly(changes []Change) []Change {
+	var ret []Change
+	for _, c := range changes {
+		if c.Hot {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Watch calls Reload each time the modification time of the loaded file changes,
+// the file is checked every interval. errors are logged and the running config is kept.
+func Watch(interval time.Duration) {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+
+	if watcherSig != nil {
+		logs.Fatal("config watcher is already running")
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+		logs.Info("invalid reload interval. resetting to default value: %v", interval)
+	}
+
+	reloadMutex.Lock()
+	path := loadedPath
+	reloadMutex.Unlock()
+	if path == "" {
+		logs.Error("config watcher not started: no config file loaded")
+		return
+	}
+
+	watcherSig = make(chan struct{})
+	watcherWg.Add(1)
+	go watch(path, interval, watcherSig)
+}
+
+// StopWatch stops the watcher started by Watch.
+func StopWatch() {
+	watcherMutex.Lock()
+	defer watcherMutex.Unlock()
+
+	if watcherSig == nil {
+		return
+	}
+	close(watcherSig)
+	watcherWg.Wait()
+	watcherSig = nil
+}
+
+func watch(path string, interval time.Duration, closeSig chan struct{}) {
+	defer watcherWg.Done()
+
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-closeSig:
+			return
+		case <-t.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				logs.Error("config watcher: %v", err)
+				continue
+			}
+			if fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			if _, err := Reload(); err != nil {
+				logs.Error("config reload failed, keeping the running config: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolConfig applies its hot settings under its own lock, as the bound structs of a server must.
+type poolConfig struct {
+	Addr    string
+	MaxConn int `conf:"hot"`
+
+	mu      sync.Mutex
+	maxConn int
+	changes []Change
+}
+
+func (c *poolConfig) OnReload(changes []Change) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range changes {
+		if ch.Field == "MaxConn" {
+			c.maxConn = ch.New.(int)
+		}
+	}
+	c.changes = append(c.changes, changes...)
+}
+
+func (c *poolConfig) max() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxConn
+}
+
+type notifier chan []Change
+
+func (n notifier) Go(id any, args ...any) { n <- args[0].([]Change) }
+
+func writeConfig(t *testing.T, path string, rpcTimeout string, addr string, maxConn int) {
+	data := `{"gserv": {"RPCTimeout": "` + rpcTimeout + `"}, "pool": {"addr": "` + addr + `", "max_conn": ` + itoa(maxConn) + `}}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func itoa(n int) string {
+	var b []byte
+	for {
+		b = append([]byte{byte('0' + n%10)}, b...)
+		if n /= 10; n == 0 {
+			return string(b)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	reset(t)
+	var pool poolConfig
+	Bind("pool", &pool)
+	n := make(notifier, 10)
+	Subscribe("pool", n, "changed")
+
+	if _, err := Reload(); err == nil {
+		t.Fatal("reload without a loaded file")
+	}
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	writeConfig(t, path, "1s", "a", 10)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	pool.maxConn = pool.MaxConn
+
+	writeConfig(t, path, "2s", "b", 20)
+	changes, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := "gserv.RPCTimeout: 1s -> 2s,pool.Addr: a -> b (restart required),pool.MaxConn: 10 -> 20"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("changes = %v, want %v", strings.Join(got, ","), want)
+	}
+
+	// the running values are left alone, the hot ones are published
+	if pool.MaxConn != 10 || pool.Addr != "a" || RPCTimeout != time.Second {
+		t.Fatalf("running values modified: %v %v %v", pool.MaxConn, pool.Addr, RPCTimeout)
+	}
+	if Hot().RPCTimeout != 2*time.Second {
+		t.Fatalf("Hot().RPCTimeout = %v", Hot().RPCTimeout)
+	}
+	if pool.max() != 20 || len(pool.changes) != 1 {
+		t.Fatalf("OnReload: max = %v, changes = %v", pool.max(), pool.changes)
+	}
+	select {
+	case cs := <-n:
+		if len(cs) != 1 || cs[0].Field != "MaxConn" {
+			t.Fatalf("notified %v", cs)
+		}
+	default:
+		t.Fatal("subscriber not notified")
+	}
+
+	// an unchanged file only reports the restart still required
+	if changes, err := Reload(); err != nil || len(changes) != 1 || changes[0].Field != "Addr" {
+		t.Fatalf("changes = %v, err = %v", changes, err)
+	}
+
+	// an invalid file keeps the running config
+	if err := os.WriteFile(path, []byte(`{"gserv": {"RPCTimeout": "-1s"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reload(); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if Hot().RPCTimeout != 2*time.Second || pool.max() != 20 {
+		t.Fatal("running config modified by a failed reload")
+	}
+
+	// Load resets the published values
+	writeConfig(t, path, "3s", "a", 10)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if Hot().RPCTimeout != 3*time.Second || RPCTimeout != 3*time.Second {
+		t.Fatalf("after Load: %v %v", Hot().RPCTimeout, RPCTimeout)
+	}
+}
+
+func TestReloadConcurrentReaders(t *testing.T) {
+	reset(t)
+	var pool poolConfig
+	Bind("pool", &pool)
+	path := filepath.Join(t.TempDir(), "server.json")
+	writeConfig(t, path, "1s", "a", 1)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// run with -race: the readers must not see Reload writing
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = Hot().RPCTimeout
+				_ = pool.max()
+				_ = RPCTimeout
+			}
+		}
+	}()
+	for i := range 20 {
+		writeConfig(t, path, itoa(i+1)+"ms", "a", i+2)
+		if _, err := Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if Hot().RPCTimeout != 20*time.Millisecond || pool.max() != 21 {
+		t.Fatalf("last reload not applied: %v %v", Hot().RPCTimeout, pool.max())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	reset(t)
+	var pool poolConfig
+	Bind("pool", &pool)
+	n := make(notifier, 10)
+	Subscribe("", n, "changed")
+	path := filepath.Join(t.TempDir(), "server.json")
+	writeConfig(t, path, "1s", "a", 1)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	Watch(10 * time.Millisecond)
+	defer StopWatch()
+	time.Sleep(20 * time.Millisecond)
+	writeConfig(t, path, "1s", "a", 5)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case cs := <-n:
+		if len(cs) != 1 || cs[0].New != 5 {
+			t.Fatalf("notified %v", cs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("change not detected")
+	}
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/yinyihanbing/gserv/chanrpc"
 	"github.com/yinyihanbing/gserv/conf"
+	"github.com/yinyihanbing/gserv/module"
+	"github.com/yinyihanbing/gserv/network"
 	"github.com/yinyihanbing/gutils/logs"
 )
 
@@ -16,6 +18,10 @@ var commands = []Command{
 	new(CommandHelp),
 	new(CommandCPUProf),
 	new(CommandProf),
+	new(CommandHealth),
+	new(CommandConfig),
+	new(CommandReload),
+	new(CommandIPFilter),
 }
 
 // Command interface defines the structure for console commands.
@@ -147,7 +153,7 @@ func (c *CommandCPUProf) run(args []string) string {
 // profileName generates a unique profile file name based on the current timestamp.
 func profileName() string {
 	now := time.Now()
-	return path.Join(conf.ProfilePath,
+	return path.Join(conf.Hot().ProfilePath,
 		fmt.Sprintf("%d%02d%02d_%02d_%02d_%02d",
 			now.Year(),
 			now.Month(),
@@ -217,3 +223,145 @@ func (c *CommandProf) run(args []string) string {
 
 	return fn
 }
+
+// CommandHealth shows the module health reported by the watchdog.
+type CommandHealth struct{}
+
+func (c *CommandHealth) name() string {
+	return "health"
+}
+
+func (c *CommandHealth) help() string {
+	return "shows the health of the modules"
+}
+
+func (c *CommandHealth) run([]string) string {
+	status := module.Health()
+	if status == nil {
+		return "module watchdog is not running"
+	}
+
+	output := ""
+	for i, hs := range status {
+		if i > 0 {
+			output += "\r\n"
+		}
+		output += hs.String()
+	}
+	return output
+}
+
+// CommandConfig shows the effective configuration.
+type CommandConfig struct{}
+
+func (c *CommandConfig) name() string {
+	return "config"
+}
+
+func (c *CommandConfig) help() string {
+	return "shows the effective configuration"
+}
+
+func (c *CommandConfig) run([]string) string {
+	return conf.Dump()
+}
+
+// CommandReload reloads the configuration file.
+type CommandReload struct{}
+
+func (c *CommandReload) name() string {
+	return "reload"
+}
+
+func (c *CommandReload) help() string {
+	return "reloads the configuration file, applies the hot settings"
+}
+
+func (c *CommandReload) run([]string) string {
+	changes, err := conf.Reload()
+	if err != nil {
+		return err.Error()
+	}
+	if len(changes) == 0 {
+		return "no changes"
+	}
+
+	output := ""
+	for i, c := range changes {
+		if i > 0 {
+			output += "\r\n"
+		}
+		output += c.String()
+	}
+	return output
+}
+
+// CommandIPFilter edits the allow and deny lists of the running servers.
+type CommandIPFilter struct{}
+
+func (c *CommandIPFilter) name() string {
+	return "ipfilter"
+}
+
+func (c *CommandIPFilter) help() string {
+	return "shows and edits the ip allow and deny lists of the servers"
+}
+
+// usage returns the usage instructions for the ipfilter command.
+func (c *CommandIPFilter) usage() string {
+	return "ipfilter shows the ip filters of the running servers, the changes apply\r\n" +
+		"to all of them and are lost on restart\r\n\r\n" +
+		"usage: ipfilter list|allow|deny|remove [address or cidr]\r\n" +
+		"  list   - limits, lists and counters of the filters\r\n" +
+		"  allow  - accepts the address, only the allowed addresses are accepted\r\n" +
+		"  deny   - refuses the address, active connections are kept\r\n" +
+		"  remove - removes the address from the allow and deny lists"
+}
+
+func (c *CommandIPFilter) run(args []string) string {
+	if len(args) == 0 {
+		return c.usage()
+	}
+	filters := network.IPFilters()
+	if len(filters) == 0 {
+		return "no server uses an ip filter"
+	}
+
+	if args[0] == "list" {
+		output := ""
+		for i, f := range filters {
+			if i > 0 {
+				output += "\r\n\r\n"
+			}
+			output += f.String()
+		}
+		return output
+	}
+
+	if len(args) != 2 {
+		return c.usage()
+	}
+	removed := false
+	for _, f := range filters {
+		var err error
+		switch args[0] {
+		case "allow":
+			err = f.Allow(args[1])
+		case "deny":
+			err = f.Deny(args[1])
+		case "remove":
+			var ok bool
+			ok, err = f.Remove(args[1])
+			removed = removed || ok
+		default:
+			return c.usage()
+		}
+		if err != nil {
+			return err.Error()
+		}
+	}
+	if args[0] == "remove" && !removed {
+		return args[1] + " is not in the lists"
+	}
+	return "ok"
+}
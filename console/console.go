@@ -54,8 +54,8 @@ func newAgent(conn *network.TCPConn) network.Agent {
 func (a *Agent) Run() {
 	for {
 		// Display the console prompt if configured.
-		if conf.ConsolePrompt != "" {
-			a.conn.Write([]byte(conf.ConsolePrompt))
+		if prompt := conf.Hot().ConsolePrompt; prompt != "" {
+			a.conn.Write([]byte(prompt))
 		}
 
 		// Read a line of input from the console.
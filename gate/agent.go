@@ -11,6 +11,10 @@ type Agent interface {
 	// msg: the message to be sent.
 	WriteMsg(msg any)
 
+	// WriteDroppableMsg sends a message the drop_droppable backpressure policy may drop,
+	// e.g. a position update superseded by the next one.
+	WriteDroppableMsg(msg any)
+
 	// LocalAddr returns the local network address of the agent.
 	LocalAddr() net.Addr
 
@@ -29,4 +33,14 @@ type Agent interface {
 	// SetUserData sets user-defined data for the agent.
 	// data: the data to associate with the agent.
 	SetUserData(data any)
+
+	// Authenticate marks the agent as authenticated and stops its login timeout.
+	// identity: the identity of the client, e.g. the account id.
+	Authenticate(identity any)
+
+	// Authenticated reports whether Authenticate has been called.
+	Authenticated() bool
+
+	// Identity returns the identity given to Authenticate, nil before.
+	Identity() any
 }
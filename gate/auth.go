@@ -0,0 +1,90 @@
+package gate
+
+import (
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Authentication phase. an agent not authenticated within Gate.LoginTimeout is destroyed.
+// with Gate.AuthHandler or Gate.AllowPreAuth, until the game code calls Agent.Authenticate,
+// only the messages allowed by AllowPreAuth are routed, the other ones go to AuthHandler.
+// with LoginTimeout alone every message is routed, the login handler calls Authenticate.
+
+// AllowPreAuth allows messages to be routed before the agent is authenticated, e.g. the login
+// and heartbeat messages. a message is given as for SetMsgLimit.
+// must be called before Run
+func (gate *Gate) AllowPreAuth(msgs ...any) {
+	if gate.preAuth == nil {
+		gate.preAuth = make(map[any]bool)
+	}
+	for _, msg := range msgs {
+		gate.preAuth[msgKey(msg)] = true
+	}
+}
+
+// authEnabled reports whether the messages of unauthenticated agents are filtered.
+func (gate *Gate) authEnabled() bool {
+	return gate.AuthHandler != nil || len(gate.preAuth) > 0
+}
+
+// startLogin arms the login timeout of a new agent.
+func (a *agent) startLogin() {
+	if a.gate.LoginTimeout <= 0 {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.loginTimer = time.AfterFunc(a.gate.LoginTimeout, func() {
+		if !a.Authenticated() {
+			logs.Debug("agent %v not authenticated in %v, closing", a.RemoteAddr(), a.gate.LoginTimeout)
+			a.Destroy()
+		}
+	})
+}
+
+// stopLogin disarms the login timeout.
+// must be called with the agent mutex held
+func (a *agent) stopLogin() {
+	if a.loginTimer != nil {
+		a.loginTimer.Stop()
+		a.loginTimer = nil
+	}
+}
+
+// allowAuth reports whether a message may be routed, the messages received before
+// authentication and not allowed by AllowPreAuth are passed to AuthHandler.
+func (a *agent) allowAuth(msg any) bool {
+	if !a.gate.authEnabled() || a.Authenticated() || a.gate.preAuth[msgKey(msg)] {
+		return true
+	}
+	if a.gate.AuthHandler != nil {
+		a.gate.AuthHandler(a, msg)
+	} else {
+		logs.Debug("message %v from unauthenticated agent %v dropped", msgKey(msg), a.RemoteAddr())
+	}
+	return false
+}
+
+// Authenticate marks the agent as authenticated, identity is e.g. the account id.
+func (a *agent) Authenticate(identity any) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.authenticated = true
+	a.identity = identity
+	a.stopLogin()
+}
+
+// Authenticated reports whether Authenticate has been called.
+func (a *agent) Authenticated() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.authenticated
+}
+
+// Identity returns the identity given to Authenticate, nil before.
+func (a *agent) Identity() any {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.identity
+}
@@ -0,0 +1,85 @@
+package gate
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestAuth(t *testing.T) {
+	handled := make(chan any, 10)
+	tg := newTestGate(t, &Gate{AuthHandler: func(a Agent, msg any) { handled <- msg }})
+	tg.AllowPreAuth(&wrapperspb.StringValue{})
+	conn, a, _ := tg.connect(t)
+
+	// before authentication only the login goes through
+	conn.in <- tg.intMsg(t, 1)
+	conn.in <- tg.msg(t, "login")
+	expect(t, tg.msgs, "login")
+	select {
+	case msg := <-handled:
+		if msg.(*wrapperspb.Int32Value).Value != 1 {
+			t.Fatalf("AuthHandler got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AuthHandler not called")
+	}
+	if a.Authenticated() || a.Identity() != nil {
+		t.Fatal("authenticated")
+	}
+
+	a.Authenticate("user1")
+	if !a.Authenticated() || a.Identity() != "user1" {
+		t.Fatal("not authenticated")
+	}
+	conn.in <- tg.intMsg(t, 2)
+	expect(t, tg.msgs, "2")
+	if len(handled) != 0 {
+		t.Fatal("AuthHandler called after authentication")
+	}
+}
+
+func TestAuthDrop(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	tg.AllowPreAuth(&wrapperspb.StringValue{})
+	conn, _, done := tg.connect(t)
+
+	// without AuthHandler the other messages are dropped, the connection is kept
+	conn.in <- tg.intMsg(t, 1)
+	conn.in <- tg.msg(t, "login")
+	expect(t, tg.msgs, "login")
+	select {
+	case <-done:
+		t.Fatal("agent closed")
+	default:
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	tg := newTestGate(t, &Gate{LoginTimeout: 50 * time.Millisecond})
+
+	// with the timeout alone every message is routed, including the login
+	conn1, a1, done1 := tg.connect(t)
+	conn1.in <- tg.msg(t, "login")
+	conn1.in <- tg.intMsg(t, 1)
+	expect(t, tg.msgs, "login")
+	expect(t, tg.msgs, "1")
+	a1.Authenticate("user1")
+
+	_, _, done2 := tg.connect(t)
+	select {
+	case <-done2:
+	case <-time.After(time.Second):
+		t.Fatal("agent kept after the login timeout")
+	}
+	expect(t, tg.events, "close")
+
+	// the authenticated agent stays
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done1:
+		t.Fatal("authenticated agent closed")
+	default:
+	}
+}
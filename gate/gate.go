@@ -1,53 +1,161 @@
 package gate
 
 import (
+	"context"
+	"errors"
 	"net"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/cluster"
+	"github.com/yinyihanbing/gserv/conf"
 	"github.com/yinyihanbing/gserv/network"
+	"github.com/yinyihanbing/gserv/network/protobuf"
 	"github.com/yinyihanbing/gutils/logs"
 )
 
 type Gate struct {
-	MaxConnNum      int
-	PendingWriteNum int
+	MaxConnNum      int `conf:"min=0,hot"`
+	PendingWriteNum int `conf:"min=0,hot"`
 	MaxMsgLen       uint32
 	Processor       network.Processor
 	AgentChanRPC    *chanrpc.Server
+	CloseTimeout    time.Duration `conf:"min=0"` // timeout of the CloseAgent call, 0 means wait forever
+	FlushTimeout    time.Duration `conf:"min=0"` // time allowed for agents to flush pending writes on close
+	ReadTimeout     time.Duration `conf:"min=0"` // agents sending nothing for this long are closed, 0 waits forever
+	WriteTimeout    time.Duration `conf:"min=0"` // agents not reading their messages for this long are closed, 0 waits forever
+	Heartbeat       bool          // empty messages are heartbeats, answered by the gate and never routed
+	ReleaseMsg      bool          // the tcp read buffers are recycled once routed, see network.ReleaseMsg. the Processor must not keep references to them
+
+	// per-message compression and encryption negotiated with the clients
+	Transform network.TransformOptions
+
+	// write queue policy of the websocket and tcp connections, see WriteDroppableMsg
+	Backpressure    network.Backpressure
+	OnHighWatermark func(a Agent, pending int) `conf:"-"` // called on the writing goroutine when the queue of an agent reaches Backpressure.HighWatermark, it must not write to the agent
+
+	// session resumption, see resume.go
+	ResumeGrace     time.Duration `conf:"min=0"` // time an agent survives its connection, 0 disables resumption
+	ResumeBufferLen int           `conf:"min=0"` // messages kept for replay per agent, 64 if 0
+
+	// flood protection, see SetMsgLimit
+	Limit   RateLimit
+	OnLimit func(a Agent, violations int) `conf:"-"` // called on the agent goroutine for each message exceeding a limit, e.g. to ban a.RemoteAddr()
+
+	// per-IP limits and allow and deny lists of the clients, the lists can be edited
+	// at runtime with the ipfilter console command
+	IPFilter network.IPFilterOptions
+
+	// authentication, see auth.go
+	LoginTimeout time.Duration          `conf:"min=0"` // time allowed to authenticate, 0 means no limit
+	AuthHandler  func(a Agent, msg any) `conf:"-"`     // called on the agent goroutine for the unauthenticated messages not allowed by AllowPreAuth, nil drops them
 
 	// websocket
-	WSAddr      string
-	HTTPTimeout time.Duration
-	CertFile    string
-	KeyFile     string
+	WSAddr       string
+	HTTPTimeout  time.Duration `conf:"min=0"`
+	PingInterval time.Duration `conf:"min=0"` // interval of the websocket pings, 0 sends none
+	CertFile     string
+	KeyFile      string
+	// reverse proxies whose X-Forwarded-For header gives the client address, see network.WSServer.TrustedProxies.
+	// breaking change: the header is no longer honoured from other peers, a gate behind a reverse proxy
+	// must list it, otherwise all its clients share the proxy address
+	WSTrustedProxies []string
 
 	// tcp
-	TCPAddr      string
-	LenMsgLen    int
-	LittleEndian bool
+	TCPAddr         string
+	LenMsgLen       int `conf:"min=0,max=4"`
+	LittleEndian    bool
+	TCPCertFile     string // TLS certificate, the tcp connections are plaintext if empty
+	TCPKeyFile      string
+	TCPClientCAFile string // CA certificates verifying the client certificates, enables mutual TLS
+	// load balancers sending a PROXY protocol header, see network.TCPServer.ProxyProtocol
+	TCPProxyProtocol []string
+
+	// kcp, reliable udp. message boundaries are kept by the transport, LenMsgLen does not apply.
+	// Backpressure and WriteTimeout neither: a connection exceeding PendingWriteNum segments or
+	// not acknowledging them is destroyed
+	KCPAddr string
+	KCP     network.KCPOptions
+
+	mu         sync.Mutex
+	wsServer   *network.WSServer
+	tcpServer  *network.TCPServer
+	kcpServer  *network.KCPServer
+	forwarding bool              // some messages are forwarded to backends, agents get a cluster session
+	sessions   map[string]*agent // resumable agents by token
+	agents     map[*agent]struct{}
+	conns      map[network.Conn]*agent // agents by connection, for OnHighWatermark
+	msgLimits  map[any]msgLimit        // message key -> limit
+	preAuth    map[any]bool            // message keys allowed before authentication
+	limitStats limitStats
+}
+
+// Validate checks the settings that conf tags cannot express, it is called by conf.Load.
+func (gate *Gate) Validate() error {
+	if gate.WSAddr == "" && gate.TCPAddr == "" && gate.KCPAddr == "" {
+		return errors.New("WSAddr, TCPAddr or KCPAddr is required")
+	}
+	if (gate.CertFile == "") != (gate.KeyFile == "") {
+		return errors.New("CertFile and KeyFile must be set together")
+	}
+	if (gate.TCPCertFile == "") != (gate.TCPKeyFile == "") {
+		return errors.New("TCPCertFile and TCPKeyFile must be set together")
+	}
+	if gate.TCPClientCAFile != "" && gate.TCPCertFile == "" {
+		return errors.New("TCPClientCAFile requires TCPCertFile")
+	}
+	if gate.LenMsgLen == 3 {
+		return errors.New("LenMsgLen must be 1, 2 or 4")
+	}
+	if err := gate.Backpressure.Validate(); err != nil {
+		return err
+	}
+	if err := gate.IPFilter.Validate(); err != nil {
+		return err
+	}
+	return gate.Limit.validate()
 }
 
-// Run starts the websocket and TCP servers if configured, and waits for a close signal.
+// Run starts the websocket, TCP and KCP servers if configured, and waits for a close signal.
 func (gate *Gate) Run(closeSig chan bool) {
+	backpressure := gate.Backpressure
+	if gate.OnHighWatermark != nil {
+		backpressure.OnHighWatermark = gate.onHighWatermark
+	}
+	// shared by the servers, the per-IP limits count the connections of all of them
+	ipFilter, err := network.NewIPFilter(gate.IPFilter)
+	if err != nil {
+		logs.Fatal("invalid ipfilter: %v", err)
+	}
+	// the limits are hot, OnReload may change them while the servers start
+	gate.mu.Lock()
+	maxConnNum, pendingWriteNum := gate.MaxConnNum, gate.PendingWriteNum
+	gate.mu.Unlock()
+
 	var wsServer *network.WSServer
 	if gate.WSAddr != "" {
 		// initialize websocket server
 		wsServer = new(network.WSServer)
 		wsServer.Addr = gate.WSAddr
-		wsServer.MaxConnNum = gate.MaxConnNum
-		wsServer.PendingWriteNum = gate.PendingWriteNum
+		wsServer.MaxConnNum = maxConnNum
+		wsServer.PendingWriteNum = pendingWriteNum
 		wsServer.MaxMsgLen = gate.MaxMsgLen
 		wsServer.HTTPTimeout = gate.HTTPTimeout
 		wsServer.CertFile = gate.CertFile
 		wsServer.KeyFile = gate.KeyFile
+		wsServer.FlushTimeout = gate.FlushTimeout
+		wsServer.ReadTimeout = gate.ReadTimeout
+		wsServer.WriteTimeout = gate.WriteTimeout
+		wsServer.PingInterval = gate.PingInterval
+		wsServer.Heartbeat = gate.Heartbeat
+		wsServer.Transform = gate.Transform
+		wsServer.Backpressure = backpressure
+		wsServer.IPFilter = ipFilter
+		wsServer.TrustedProxies = gate.WSTrustedProxies
 		wsServer.NewAgent = func(conn *network.WSConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
 		}
 	}
 
@@ -56,17 +164,43 @@ func (gate *Gate) Run(closeSig chan bool) {
 		// initialize tcp server
 		tcpServer = new(network.TCPServer)
 		tcpServer.Addr = gate.TCPAddr
-		tcpServer.MaxConnNum = gate.MaxConnNum
-		tcpServer.PendingWriteNum = gate.PendingWriteNum
+		tcpServer.MaxConnNum = maxConnNum
+		tcpServer.PendingWriteNum = pendingWriteNum
 		tcpServer.LenMsgLen = gate.LenMsgLen
 		tcpServer.MaxMsgLen = gate.MaxMsgLen
 		tcpServer.LittleEndian = gate.LittleEndian
+		tcpServer.FlushTimeout = gate.FlushTimeout
+		tcpServer.ReadTimeout = gate.ReadTimeout
+		tcpServer.WriteTimeout = gate.WriteTimeout
+		tcpServer.Heartbeat = gate.Heartbeat
+		tcpServer.Transform = gate.Transform
+		tcpServer.Backpressure = backpressure
+		tcpServer.IPFilter = ipFilter
+		tcpServer.CertFile = gate.TCPCertFile
+		tcpServer.KeyFile = gate.TCPKeyFile
+		tcpServer.ClientCAFile = gate.TCPClientCAFile
+		tcpServer.ProxyProtocol = gate.TCPProxyProtocol
 		tcpServer.NewAgent = func(conn *network.TCPConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
+		}
+	}
+
+	var kcpServer *network.KCPServer
+	if gate.KCPAddr != "" {
+		// initialize kcp server
+		kcpServer = new(network.KCPServer)
+		kcpServer.Addr = gate.KCPAddr
+		kcpServer.MaxConnNum = maxConnNum
+		kcpServer.PendingWriteNum = pendingWriteNum
+		kcpServer.MaxMsgLen = gate.MaxMsgLen
+		kcpServer.FlushTimeout = gate.FlushTimeout
+		kcpServer.ReadTimeout = gate.ReadTimeout
+		kcpServer.Heartbeat = gate.Heartbeat
+		kcpServer.Transform = gate.Transform
+		kcpServer.IPFilter = ipFilter
+		kcpServer.KCPOptions = gate.KCP
+		kcpServer.NewAgent = func(conn *network.KCPConn) network.Agent {
+			return gate.newAgent(conn)
 		}
 	}
 
@@ -80,6 +214,20 @@ func (gate *Gate) Run(closeSig chan bool) {
 		tcpServer.Start()
 		logs.Info("game tcp service startup: %v", tcpServer.Addr)
 	}
+	// start kcp server if configured
+	if kcpServer != nil {
+		kcpServer.Start()
+		logs.Info("game kcp service startup: %v", kcpServer.Addr)
+	}
+	gate.mu.Lock()
+	gate.wsServer = wsServer
+	gate.tcpServer = tcpServer
+	gate.kcpServer = kcpServer
+	if gate.MaxConnNum != maxConnNum || gate.PendingWriteNum != pendingWriteNum {
+		gate.applyLimits()
+	}
+	gate.mu.Unlock()
+
 	// wait for close signal
 	<-closeSig
 	// stop websocket server if running
@@ -92,15 +240,203 @@ func (gate *Gate) Run(closeSig chan bool) {
 		tcpServer.Close()
 		logs.Info("game tcp service stopped: %v", tcpServer.Addr)
 	}
+	// stop kcp server if running
+	if kcpServer != nil {
+		kcpServer.Close()
+		logs.Info("game kcp service stopped: %v", kcpServer.Addr)
+	}
+	// end the agents waiting for a resume
+	gate.closeSessions()
+}
+
+// StopAccept stops accepting new connections, active agents keep running until the gate is closed.
+func (gate *Gate) StopAccept() {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	if gate.wsServer != nil {
+		gate.wsServer.StopAccept()
+		logs.Info("game ws service stopped accepting: %v", gate.wsServer.Addr)
+	}
+	if gate.tcpServer != nil {
+		gate.tcpServer.StopAccept()
+		logs.Info("game tcp service stopped accepting: %v", gate.tcpServer.Addr)
+	}
+	if gate.kcpServer != nil {
+		gate.kcpServer.StopAccept()
+		logs.Info("game kcp service stopped accepting: %v", gate.kcpServer.Addr)
+	}
+}
+
+// OnReload applies the reloaded connection limits to the running servers, it is called by conf.Reload.
+func (gate *Gate) OnReload(changes []conf.Change) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	for _, c := range changes {
+		switch c.Field {
+		case "MaxConnNum":
+			gate.MaxConnNum = c.New.(int)
+		case "PendingWriteNum":
+			gate.PendingWriteNum = c.New.(int)
+		}
+	}
+	gate.applyLimits()
+}
+
+// applyLimits passes the connection limits to the running servers, gate.mu must be held.
+func (gate *Gate) applyLimits() {
+	if gate.MaxConnNum > 0 {
+		if gate.wsServer != nil {
+			gate.wsServer.SetMaxConnNum(gate.MaxConnNum)
+		}
+		if gate.tcpServer != nil {
+			gate.tcpServer.SetMaxConnNum(gate.MaxConnNum)
+		}
+		if gate.kcpServer != nil {
+			gate.kcpServer.SetMaxConnNum(gate.MaxConnNum)
+		}
+	}
+	if gate.PendingWriteNum > 0 {
+		if gate.wsServer != nil {
+			gate.wsServer.SetPendingWriteNum(gate.PendingWriteNum)
+		}
+		if gate.tcpServer != nil {
+			gate.tcpServer.SetPendingWriteNum(gate.PendingWriteNum)
+		}
+		if gate.kcpServer != nil {
+			gate.kcpServer.SetPendingWriteNum(gate.PendingWriteNum)
+		}
+	}
+}
+
+// WriteStats returns the outcomes of the writes finding a full queue, summed over the servers.
+// the kcp connections are always destroyed, they only count as Disconnected.
+// goroutine safe
+func (gate *Gate) WriteStats() network.WriteStats {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+
+	var all []network.WriteStats
+	if gate.wsServer != nil {
+		all = append(all, gate.wsServer.WriteStats())
+	}
+	if gate.tcpServer != nil {
+		all = append(all, gate.tcpServer.WriteStats())
+	}
+	if gate.kcpServer != nil {
+		all = append(all, gate.kcpServer.WriteStats())
+	}
+	var stats network.WriteStats
+	for _, s := range all {
+		stats.Blocked += s.Blocked
+		stats.Dropped += s.Dropped
+		stats.Disconnected += s.Disconnected
+		stats.HighWatermarks += s.HighWatermarks
+	}
+	return stats
+}
+
+// bindConn records the agent of a session connection.
+func (gate *Gate) bindConn(conn network.Conn, a *agent) {
+	gate.mu.Lock()
+	if gate.conns == nil {
+		gate.conns = make(map[network.Conn]*agent)
+	}
+	gate.conns[conn] = a
+	gate.mu.Unlock()
+}
+
+func (gate *Gate) unbindConn(conn network.Conn) {
+	gate.mu.Lock()
+	delete(gate.conns, conn)
+	gate.mu.Unlock()
+}
+
+// onHighWatermark passes the high watermarks of the connections to OnHighWatermark.
+func (gate *Gate) onHighWatermark(conn network.Conn, pending int) {
+	gate.mu.Lock()
+	a := gate.conns[conn]
+	gate.mu.Unlock()
+	if a != nil {
+		gate.OnHighWatermark(a, pending)
+	}
+}
+
+// Forward sends the messages with the given id to a backend node instead of routing them locally,
+// backend picks the node for an agent, nil drops the message. the backend receives them through
+// cluster.SessionProcessor and answers through the cluster.Session.
+// p must be the gate Processor, must be called before Run
+func (gate *Gate) Forward(p *protobuf.Processor, id uint16, backend func(a Agent) *cluster.Agent) {
+	gate.forwarding = true
+	p.SetRawHandler(id, func(args []any) {
+		a := args[2].(*agent)
+		b := backend(a)
+		if b == nil {
+			logs.Debug("no backend for message %v, dropped", id)
+			return
+		}
+		if err := b.Forward(a.sessionID, p.MarshalRaw(id, args[1].([]byte))...); err != nil {
+			logs.Error("forward message %v error: %v", id, err)
+		}
+	})
 }
 
 // OnDestroy is a placeholder for cleanup logic when the gate is destroyed.
 func (gate *Gate) OnDestroy() {}
 
 type agent struct {
-	conn     network.Conn
-	gate     *Gate
-	userData any
+	conn          network.Conn // nil if the agent is resumable, the connection is held by the session
+	gate          *Gate
+	session       *session
+	sessionID     uint64 // cluster session id, 0 if the gate does not forward
+	userData      any
+	limiter       *limiter // nil if no rate limit is configured
+	mutex         sync.Mutex
+	closed        bool
+	groups        map[*Group]struct{}
+	authenticated bool
+	identity      any
+	loginTimer    *time.Timer
+}
+
+// newAgent creates the network agent of a new connection.
+func (gate *Gate) newAgent(conn network.Conn) network.Agent {
+	if gate.ResumeGrace > 0 {
+		return &resumeConn{gate: gate, conn: conn}
+	}
+	a := &agent{conn: conn, gate: gate}
+	gate.open(a)
+	return a
+}
+
+// open registers a new agent, opens its cluster session and notifies AgentChanRPC.
+func (gate *Gate) open(a *agent) {
+	gate.mu.Lock()
+	if gate.agents == nil {
+		gate.agents = make(map[*agent]struct{})
+	}
+	gate.agents[a] = struct{}{}
+	if a.conn != nil {
+		if gate.conns == nil {
+			gate.conns = make(map[network.Conn]*agent)
+		}
+		gate.conns[a.conn] = a
+	}
+	gate.mu.Unlock()
+	a.limiter = gate.newLimiter()
+	a.startLogin()
+
+	if gate.forwarding {
+		if a.session != nil {
+			a.sessionID = cluster.OpenSession(sessionConn{a})
+		} else {
+			a.sessionID = cluster.OpenSession(a.conn)
+		}
+	}
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("NewAgent", a)
+	}
 }
 
 // Run is the main loop for reading and processing messages from the connection.
@@ -110,26 +446,68 @@ func (a *agent) Run() {
 		if err != nil {
 			break
 		}
-		if a.gate.Processor != nil {
-			// unmarshal and route the message
-			msg, err := a.gate.Processor.Unmarshal(data)
-			if err != nil {
-				logs.Debug("unmarshal message error: %v", err)
-				break
-			}
-			err = a.gate.Processor.Route(msg, a)
-			if err != nil {
-				logs.Debug("route message error: %v", err)
-				break
-			}
+		if !a.route(data) {
+			break
 		}
 	}
 }
 
+// route unmarshals and routes a message, it returns false if the connection must be closed.
+func (a *agent) route(data []byte) bool {
+	if a.gate.Processor == nil {
+		return true
+	}
+	if !a.allowData(len(data)) {
+		return a.gate.Limit.Action != LimitDisconnect
+	}
+	msg, err := a.gate.Processor.Unmarshal(data)
+	if err != nil {
+		logs.Debug("unmarshal message error: %v", err)
+		return false
+	}
+	if !a.allowMsg(msg) {
+		return a.gate.Limit.Action != LimitDisconnect
+	}
+	if !a.allowAuth(msg) {
+		return true
+	}
+	err = a.gate.Processor.Route(msg, a)
+	if err != nil {
+		logs.Debug("route message error: %v", err)
+		return false
+	}
+	// raw messages keep referencing data
+	if _, raw := msg.(protobuf.MsgRaw); a.gate.ReleaseMsg && !raw {
+		network.ReleaseMsg(data)
+	}
+	return true
+}
+
 // OnClose handles the closure of the agent and notifies the RPC server if configured.
 func (a *agent) OnClose() {
+	a.gate.mu.Lock()
+	delete(a.gate.agents, a)
+	if a.conn != nil {
+		delete(a.gate.conns, a.conn)
+	}
+	a.gate.mu.Unlock()
+	a.leaveGroups()
+	a.mutex.Lock()
+	a.stopLogin()
+	a.mutex.Unlock()
+
+	if a.sessionID != 0 {
+		cluster.CloseSession(a.sessionID)
+	}
 	if a.gate.AgentChanRPC != nil {
-		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
+		var err error
+		if a.gate.CloseTimeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), a.gate.CloseTimeout)
+			err = a.gate.AgentChanRPC.Call0Context(ctx, "CloseAgent", a)
+			cancel()
+		} else {
+			err = a.gate.AgentChanRPC.Call0("CloseAgent", a)
+		}
 		if err != nil {
 			logs.Error("chanrpc error: %v", err)
 		}
@@ -138,39 +516,91 @@ func (a *agent) OnClose() {
 
 // WriteMsg marshals the message and writes it to the connection.
 func (a *agent) WriteMsg(msg any) {
+	a.write(msg, false)
+}
+
+// WriteDroppableMsg marshals the message and writes it to the connection, the drop_droppable
+// backpressure policy may drop it. resumable agents never drop messages.
+func (a *agent) WriteDroppableMsg(msg any) {
+	a.write(msg, true)
+}
+
+func (a *agent) write(msg any, droppable bool) {
 	if a.gate.Processor != nil {
 		data, err := a.gate.Processor.Marshal(msg)
 		if err != nil {
 			logs.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
 			return
 		}
+		a.writeRaw(msg, data, droppable)
+	}
+}
+
+// writeRaw writes a marshaled message, msg is only used to report errors.
+func (a *agent) writeRaw(msg any, data [][]byte, droppable bool) {
+	var err error
+	if a.session != nil {
+		err = a.send(data...)
+	} else if dc, ok := a.conn.(interface{ WriteDroppableMsg(args ...[]byte) error }); ok && droppable {
+		err = dc.WriteDroppableMsg(data...)
+	} else {
 		err = a.conn.WriteMsg(data...)
-		if err != nil {
-			logs.Error("write message %v error: %v", reflect.TypeOf(msg), err)
-		}
+	}
+	if err != nil {
+		logs.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+	}
+}
+
+// msgKey identifies a message type: the uint16 ID of a protobuf raw message, the type otherwise.
+func msgKey(msg any) any {
+	switch m := msg.(type) {
+	case uint16:
+		return m
+	case protobuf.MsgRaw:
+		return m.ID()
+	default:
+		return reflect.TypeOf(msg)
 	}
 }
 
 // LocalAddr returns the local address of the connection.
 func (a *agent) LocalAddr() net.Addr {
-	return a.conn.LocalAddr()
+	return a.transport().LocalAddr()
 }
 
 // RemoteAddr returns the remote address of the connection.
 func (a *agent) RemoteAddr() net.Addr {
-	return a.conn.RemoteAddr()
+	return a.transport().RemoteAddr()
 }
 
-// Close closes the connection.
+// Close closes the connection, a resumable agent is closed without grace period.
 func (a *agent) Close() {
+	if a.session != nil {
+		a.end(false)
+		return
+	}
 	a.conn.Close()
 }
 
-// Destroy destroys the connection.
+// Destroy destroys the connection, a resumable agent is closed without grace period.
 func (a *agent) Destroy() {
+	if a.session != nil {
+		a.end(true)
+		return
+	}
 	a.conn.Destroy()
 }
 
+// transport returns the connection, the last bound one for a resumable agent.
+func (a *agent) transport() network.Conn {
+	if a.session == nil {
+		return a.conn
+	}
+	a.session.mutex.Lock()
+	defer a.session.mutex.Unlock()
+	return a.session.conn
+}
+
 // UserData returns the user data associated with the agent.
 func (a *agent) UserData() any {
 	return a.userData
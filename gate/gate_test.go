@@ -0,0 +1,218 @@
+package gate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gserv/network/protobuf"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testConn is an in-memory connection: the test feeds its messages and reads what the gate wrote.
+type testConn struct {
+	in     chan []byte
+	out    chan []byte
+	done   chan struct{}
+	once   sync.Once
+	remote net.Addr
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		in:     make(chan []byte, 100),
+		out:    make(chan []byte, 100),
+		done:   make(chan struct{}),
+		remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000},
+	}
+}
+
+func (c *testConn) ReadMsg() ([]byte, error) {
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.done:
+		return nil, errors.New("closed")
+	}
+}
+
+func (c *testConn) WriteMsg(args ...[]byte) error {
+	select {
+	case <-c.done:
+		return errors.New("closed")
+	default:
+	}
+	c.out <- bytes.Join(args, nil)
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000} }
+func (c *testConn) RemoteAddr() net.Addr { return c.remote }
+func (c *testConn) Close()               { c.once.Do(func() { close(c.done) }) }
+func (c *testConn) Destroy()             { c.Close() }
+
+func (c *testConn) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// read returns the next message written by the gate.
+func (c *testConn) read(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case data := <-c.out:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("nothing written")
+		return nil
+	}
+}
+
+// expectSilence checks that the gate writes nothing more.
+func (c *testConn) expectSilence(t *testing.T) {
+	t.Helper()
+	select {
+	case data := <-c.out:
+		t.Fatalf("unexpected write %v", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// serve runs the agent of conn as the network servers do, the returned channel is closed once it is done.
+func serve(gate *Gate, conn *testConn) chan struct{} {
+	done := make(chan struct{})
+	na := gate.newAgent(conn)
+	go func() {
+		na.Run()
+		conn.Close()
+		na.OnClose()
+		close(done)
+	}()
+	return done
+}
+
+// testGate is a gate routing wrapperspb.StringValue and Int32Value messages, the handlers and the agent
+// events are reported on channels.
+type testGate struct {
+	*Gate
+	p      *protobuf.Processor
+	msgs   chan string // values of the messages routed
+	events chan string // "new" and "close"
+	agents chan *agent // agents given to NewAgent
+}
+
+func newTestGate(t *testing.T, gate *Gate) *testGate {
+	tg := &testGate{
+		Gate:   gate,
+		p:      protobuf.NewProcessor(),
+		msgs:   make(chan string, 100),
+		events: make(chan string, 100),
+		agents: make(chan *agent, 100),
+	}
+	tg.p.Register(&wrapperspb.StringValue{})
+	tg.p.Register(&wrapperspb.Int32Value{})
+	tg.p.SetHandler(&wrapperspb.StringValue{}, func(args []any) {
+		tg.msgs <- args[0].(*wrapperspb.StringValue).Value
+	})
+	tg.p.SetHandler(&wrapperspb.Int32Value{}, func(args []any) {
+		tg.msgs <- fmt.Sprint(args[0].(*wrapperspb.Int32Value).Value)
+	})
+	gate.Processor = tg.p
+
+	s := chanrpc.NewServer(100)
+	s.Register("NewAgent", func(args []any) {
+		tg.events <- "new"
+		tg.agents <- args[0].(*agent)
+	})
+	s.Register("CloseAgent", func(args []any) { tg.events <- "close" })
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	t.Cleanup(func() { close(s.ChanCall) })
+	gate.AgentChanRPC = s
+	return tg
+}
+
+// msg marshals a StringValue as the gate Processor does.
+func (tg *testGate) msg(t *testing.T, s string) []byte {
+	data, err := tg.p.Marshal(&wrapperspb.StringValue{Value: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Join(data, nil)
+}
+
+func expect(t *testing.T, c chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-c:
+		if got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout, want %v", want)
+	}
+}
+
+func expectNone(t *testing.T, c chan string) {
+	t.Helper()
+	select {
+	case got := <-c:
+		t.Fatalf("unexpected %v", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAgent(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	conn := newTestConn()
+	done := serve(tg.Gate, conn)
+	expect(t, tg.events, "new")
+	a := <-tg.agents
+
+	conn.in <- tg.msg(t, "hello")
+	expect(t, tg.msgs, "hello")
+	a.WriteMsg(&wrapperspb.StringValue{Value: "world"})
+	if got := conn.read(t); !bytes.Equal(got, tg.msg(t, "world")) {
+		t.Fatalf("written %v", got)
+	}
+	if a.RemoteAddr().String() != "10.0.0.1:1000" {
+		t.Fatalf("RemoteAddr = %v", a.RemoteAddr())
+	}
+
+	// an invalid message closes the connection
+	conn.in <- []byte{0xff, 0xff}
+	<-done
+	expect(t, tg.events, "close")
+}
+
+func TestValidate(t *testing.T) {
+	for i, c := range []struct {
+		gate  *Gate
+		valid bool
+	}{
+		{&Gate{}, false},
+		{&Gate{TCPAddr: ":3563"}, true},
+		{&Gate{WSAddr: ":3653", CertFile: "cert.pem"}, false},
+		{&Gate{WSAddr: ":3653", CertFile: "cert.pem", KeyFile: "key.pem"}, true},
+		{&Gate{TCPAddr: ":3563", TCPKeyFile: "key.pem"}, false},
+		{&Gate{TCPAddr: ":3563", TCPClientCAFile: "ca.pem"}, false},
+		{&Gate{TCPAddr: ":3563", TCPCertFile: "cert.pem", TCPKeyFile: "key.pem", TCPClientCAFile: "ca.pem"}, true},
+		{&Gate{TCPAddr: ":3563", LenMsgLen: 3}, false},
+	} {
+		if err := c.gate.Validate(); (err == nil) != c.valid {
+			t.Fatalf("case %v: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package gate
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Group is a set of agents receiving the same messages, e.g. the players of a room.
+// a message is marshaled once per broadcast, agents leave their groups when they are closed.
+type Group struct {
+	gate    *Gate
+	mutex   sync.RWMutex
+	members map[*agent]struct{}
+}
+
+// NewGroup creates an empty group of agents of the gate.
+func (gate *Gate) NewGroup() *Group {
+	return &Group{gate: gate, members: make(map[*agent]struct{})}
+}
+
+// Join adds an agent to the group, a closed agent is ignored.
+// goroutine safe
+func (g *Group) Join(a Agent) {
+	ag, ok := a.(*agent)
+	if !ok {
+		logs.Error("join group error: %v is not a gate agent", reflect.TypeOf(a))
+		return
+	}
+
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+	if ag.closed {
+		return
+	}
+	if ag.groups == nil {
+		ag.groups = make(map[*Group]struct{})
+	}
+	ag.groups[g] = struct{}{}
+
+	g.mutex.Lock()
+	g.members[ag] = struct{}{}
+	g.mutex.Unlock()
+}
+
+// Leave removes an agent from the group.
+// goroutine safe
+func (g *Group) Leave(a Agent) {
+	ag, ok := a.(*agent)
+	if !ok {
+		return
+	}
+
+	ag.mutex.Lock()
+	defer ag.mutex.Unlock()
+	delete(ag.groups, g)
+
+	g.mutex.Lock()
+	delete(g.members, ag)
+	g.mutex.Unlock()
+}
+
+// Len returns the number of agents in the group.
+// goroutine safe
+func (g *Group) Len() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return len(g.members)
+}
+
+// Broadcast writes msg to every agent of the group.
+// goroutine safe
+func (g *Group) Broadcast(msg any) {
+	g.BroadcastExcept(msg)
+}
+
+// BroadcastExcept writes msg to every agent of the group but the given ones.
+// goroutine safe
+func (g *Group) BroadcastExcept(msg any, except ...Agent) {
+	data, ok := g.gate.marshal(msg)
+	if !ok {
+		return
+	}
+
+	g.mutex.RLock()
+	members := make([]*agent, 0, len(g.members))
+	for a := range g.members {
+		if !excluded(a, except) {
+			members = append(members, a)
+		}
+	}
+	g.mutex.RUnlock()
+
+	for _, a := range members {
+		a.writeRaw(msg, data, false)
+	}
+}
+
+// Broadcast writes msg to every agent connected to the gate.
+// goroutine safe
+func (gate *Gate) Broadcast(msg any) {
+	data, ok := gate.marshal(msg)
+	if !ok {
+		return
+	}
+
+	gate.mu.Lock()
+	agents := make([]*agent, 0, len(gate.agents))
+	for a := range gate.agents {
+		agents = append(agents, a)
+	}
+	gate.mu.Unlock()
+
+	for _, a := range agents {
+		a.writeRaw(msg, data, false)
+	}
+}
+
+// marshal encodes a broadcast message once for all the agents.
+func (gate *Gate) marshal(msg any) ([][]byte, bool) {
+	if gate.Processor == nil {
+		return nil, false
+	}
+	data, err := gate.Processor.Marshal(msg)
+	if err != nil {
+		logs.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return nil, false
+	}
+	return data, true
+}
+
+// leaveGroups removes a closed agent from its groups.
+func (a *agent) leaveGroups() {
+	a.mutex.Lock()
+	a.closed = true
+	groups := a.groups
+	a.groups = nil
+	a.mutex.Unlock()
+
+	for g := range groups {
+		g.mutex.Lock()
+		delete(g.members, a)
+		g.mutex.Unlock()
+	}
+}
+
+func excluded(a *agent, except []Agent) bool {
+	for _, e := range except {
+		if e == Agent(a) {
+			return true
+		}
+	}
+	return false
+}
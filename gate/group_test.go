@@ -0,0 +1,93 @@
+package gate
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// connect serves a new connection, it returns the connection, its agent and the end of its agent.
+func (tg *testGate) connect(t *testing.T) (*testConn, *agent, chan struct{}) {
+	t.Helper()
+	conn := newTestConn()
+	done := serve(tg.Gate, conn)
+	expect(t, tg.events, "new")
+	return conn, <-tg.agents, done
+}
+
+func TestGroup(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	conn1, a1, _ := tg.connect(t)
+	conn2, a2, done2 := tg.connect(t)
+	conn3, a3, _ := tg.connect(t)
+
+	g := tg.NewGroup()
+	g.Join(a1)
+	g.Join(a2)
+	g.Join(a2)
+	if g.Len() != 2 {
+		t.Fatalf("Len = %v, want 2", g.Len())
+	}
+
+	want := tg.msg(t, "all")
+	g.Broadcast(&wrapperspb.StringValue{Value: "all"})
+	for _, conn := range []*testConn{conn1, conn2} {
+		if got := conn.read(t); !bytes.Equal(got, want) {
+			t.Fatalf("written %v", got)
+		}
+	}
+	conn3.expectSilence(t)
+
+	g.BroadcastExcept(&wrapperspb.StringValue{Value: "others"}, a1, a3)
+	if got := conn2.read(t); !bytes.Equal(got, tg.msg(t, "others")) {
+		t.Fatalf("written %v", got)
+	}
+	conn1.expectSilence(t)
+
+	// agents leave, closed agents cannot join
+	g.Leave(a1)
+	conn2.Close()
+	<-done2
+	expect(t, tg.events, "close")
+	g.Join(a2)
+	if g.Len() != 0 {
+		t.Fatalf("Len = %v, want 0", g.Len())
+	}
+
+	// the gate broadcast reaches every connected agent
+	tg.Broadcast(&wrapperspb.StringValue{Value: "gate"})
+	for _, conn := range []*testConn{conn1, conn3} {
+		if got := conn.read(t); !bytes.Equal(got, tg.msg(t, "gate")) {
+			t.Fatalf("written %v", got)
+		}
+	}
+}
+
+func TestGroupSlowMember(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	conn1, a1, _ := tg.connect(t)
+	_, a2, _ := tg.connect(t)
+
+	// conn1 blocks its writer until the test reads
+	conn1.out = make(chan []byte)
+	g := tg.NewGroup()
+	g.Join(a1)
+	go g.Broadcast(&wrapperspb.StringValue{Value: "slow"})
+
+	// the group is not locked while writing
+	joined := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		g.Join(a2)
+		g.Leave(a2)
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatal("group locked by a slow member")
+	}
+	conn1.read(t)
+}
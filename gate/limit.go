@@ -0,0 +1,231 @@
+package gate
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// LimitAction is what the gate does with a message exceeding a rate limit.
+type LimitAction string
+
+const (
+	LimitDrop       LimitAction = "drop"       // the message is discarded
+	LimitDelay      LimitAction = "delay"      // reading from the connection pauses until the message is allowed
+	LimitDisconnect LimitAction = "disconnect" // the agent is destroyed
+)
+
+// RateLimit limits the messages received from each agent with token buckets, a zero rate is unlimited.
+type RateLimit struct {
+	MsgRate   float64     `conf:"min=0"` // messages per second
+	MsgBurst  int         `conf:"min=0"` // messages accepted at once, MsgRate (at least 1) if 0
+	ByteRate  float64     `conf:"min=0"` // bytes per second
+	ByteBurst int         `conf:"min=0"` // bytes accepted at once, ByteRate if 0
+	Action    LimitAction // "drop" if empty
+}
+
+// LimitStats counts the messages exceeding a rate limit since the gate started.
+type LimitStats struct {
+	Dropped      uint64
+	Delayed      uint64
+	Disconnected uint64
+}
+
+func (s LimitStats) String() string {
+	return fmt.Sprintf("dropped=%v, delayed=%v, disconnected=%v", s.Dropped, s.Delayed, s.Disconnected)
+}
+
+// msgLimit is a rate limit of one message type.
+type msgLimit struct {
+	rate  float64
+	burst int
+}
+
+// limitStats is the atomic form of LimitStats.
+type limitStats struct {
+	dropped      atomic.Uint64
+	delayed      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+func (r *RateLimit) validate() error {
+	switch r.Action {
+	case "", LimitDrop, LimitDelay, LimitDisconnect:
+		return nil
+	default:
+		return errors.New("Limit.Action must be drop, delay or disconnect")
+	}
+}
+
+func (r *RateLimit) enabled() bool {
+	return r.MsgRate > 0 || r.ByteRate > 0
+}
+
+// SetMsgLimit limits a message type per agent, on top of the Limit rates. msg is a registered
+// message, e.g. &msg.Chat{}, or the uint16 ID of a protobuf message with a raw handler.
+// must be called before Run
+func (gate *Gate) SetMsgLimit(msg any, rate float64, burst int) {
+	if gate.msgLimits == nil {
+		gate.msgLimits = make(map[any]msgLimit)
+	}
+	gate.msgLimits[msgKey(msg)] = msgLimit{rate: rate, burst: burst}
+}
+
+// LimitStats returns the rate limit counters.
+// goroutine safe
+func (gate *Gate) LimitStats() LimitStats {
+	return LimitStats{
+		Dropped:      gate.limitStats.dropped.Load(),
+		Delayed:      gate.limitStats.delayed.Load(),
+		Disconnected: gate.limitStats.disconnected.Load(),
+	}
+}
+
+// limiter holds the token buckets of an agent.
+type limiter struct {
+	mutex      sync.Mutex
+	msgs       *bucket
+	bytes      *bucket
+	perMsg     map[any]*bucket
+	violations int
+}
+
+func (gate *Gate) newLimiter() *limiter {
+	if !gate.Limit.enabled() && len(gate.msgLimits) == 0 {
+		return nil
+	}
+	l := new(limiter)
+	if gate.Limit.MsgRate > 0 {
+		l.msgs = newBucket(gate.Limit.MsgRate, gate.Limit.MsgBurst)
+	}
+	if gate.Limit.ByteRate > 0 {
+		l.bytes = newBucket(gate.Limit.ByteRate, gate.Limit.ByteBurst)
+	}
+	if len(gate.msgLimits) > 0 {
+		l.perMsg = make(map[any]*bucket, len(gate.msgLimits))
+		for key, ml := range gate.msgLimits {
+			l.perMsg[key] = newBucket(ml.rate, ml.burst)
+		}
+	}
+	return l
+}
+
+// allowData applies the agent wide limits to a received message of n bytes,
+// it returns false if the message must be discarded.
+func (a *agent) allowData(n int) bool {
+	if a.limiter == nil {
+		return true
+	}
+	l := a.limiter
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	w1, w2 := take(l.msgs, 1), take(l.bytes, float64(n))
+	if w1 == 0 && w2 == 0 {
+		return true
+	}
+	if a.violate() != LimitDelay {
+		return false
+	}
+	if w1 > 0 {
+		l.msgs.force(1)
+	}
+	if w2 > 0 {
+		l.bytes.force(float64(n))
+	}
+	time.Sleep(max(w1, w2))
+	return true
+}
+
+// allowMsg applies the limit of the message type, it returns false if the message must be discarded.
+func (a *agent) allowMsg(msg any) bool {
+	if a.limiter == nil || a.limiter.perMsg == nil {
+		return true
+	}
+	l := a.limiter
+	b := l.perMsg[msgKey(msg)]
+	if b == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	w := take(b, 1)
+	if w == 0 {
+		return true
+	}
+	if a.violate() != LimitDelay {
+		return false
+	}
+	b.force(1)
+	time.Sleep(w)
+	return true
+}
+
+// violate counts a message exceeding a limit, calls OnLimit and returns the action to apply.
+// the agent is destroyed on disconnect, the caller waits on delay.
+// must be called with the limiter mutex held
+func (a *agent) violate() LimitAction {
+	gate := a.gate
+	a.limiter.violations++
+	if gate.OnLimit != nil {
+		gate.OnLimit(a, a.limiter.violations)
+	}
+
+	switch gate.Limit.Action {
+	case LimitDelay:
+		gate.limitStats.delayed.Add(1)
+		return LimitDelay
+	case LimitDisconnect:
+		gate.limitStats.disconnected.Add(1)
+		logs.Debug("agent %v exceeded the rate limit, disconnected", a.RemoteAddr())
+		a.Destroy()
+		return LimitDisconnect
+	default:
+		gate.limitStats.dropped.Add(1)
+		return LimitDrop
+	}
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	b := &bucket{rate: rate, burst: float64(burst), last: time.Now()}
+	if b.burst <= 0 {
+		b.burst = max(rate, 1)
+	}
+	b.tokens = b.burst
+	return b
+}
+
+// take removes n tokens if available, otherwise it returns how long to wait for them.
+func take(b *bucket, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// force removes n tokens, the balance may become negative.
+func (b *bucket) force(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
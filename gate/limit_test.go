@@ -0,0 +1,147 @@
+package gate
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func (tg *testGate) intMsg(t *testing.T, v int32) []byte {
+	data, err := tg.p.Marshal(&wrapperspb.Int32Value{Value: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Join(data, nil)
+}
+
+func TestBucket(t *testing.T) {
+	b := newBucket(10, 2)
+	if take(b, 1) != 0 || take(b, 1) != 0 {
+		t.Fatal("burst refused")
+	}
+	if w := take(b, 1); w < 90*time.Millisecond || w > 100*time.Millisecond {
+		t.Fatalf("wait = %v, want 100ms", w)
+	}
+	time.Sleep(110 * time.Millisecond)
+	if take(b, 1) != 0 {
+		t.Fatal("token not refilled")
+	}
+
+	// the burst defaults to the rate, at least 1
+	if b := newBucket(5, 0); b.burst != 5 {
+		t.Fatalf("burst = %v, want 5", b.burst)
+	}
+	if b := newBucket(0.5, 0); b.burst != 1 {
+		t.Fatalf("burst = %v, want 1", b.burst)
+	}
+	if take(nil, 100) != 0 {
+		t.Fatal("nil bucket limited")
+	}
+}
+
+func TestLimitValidate(t *testing.T) {
+	for action, valid := range map[LimitAction]bool{"": true, LimitDrop: true, LimitDelay: true, LimitDisconnect: true, "ban": false} {
+		gate := &Gate{TCPAddr: "127.0.0.1:0", Limit: RateLimit{MsgRate: 1, Action: action}}
+		if err := gate.Validate(); (err == nil) != valid {
+			t.Fatalf("action %q: %v", action, err)
+		}
+	}
+}
+
+func TestLimitDrop(t *testing.T) {
+	var violations []int
+	tg := newTestGate(t, &Gate{
+		Limit:   RateLimit{MsgRate: 0.1, MsgBurst: 2},
+		OnLimit: func(a Agent, n int) { violations = append(violations, n) },
+	})
+	conn, _, done := tg.connect(t)
+	for i := range 4 {
+		conn.in <- tg.intMsg(t, int32(i))
+	}
+	expect(t, tg.msgs, "0")
+	expect(t, tg.msgs, "1")
+	expectNone(t, tg.msgs)
+
+	// the connection is kept
+	conn.Close()
+	<-done
+	if s := tg.LimitStats(); s != (LimitStats{Dropped: 2}) {
+		t.Fatalf("stats %v", s)
+	}
+	if len(violations) != 2 || violations[1] != 2 {
+		t.Fatalf("OnLimit calls %v", violations)
+	}
+}
+
+func TestLimitBytes(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	data := tg.msg(t, "0123456789")
+	tg.Limit = RateLimit{ByteRate: 0.1, ByteBurst: 2*len(data) + 1}
+	conn, _, _ := tg.connect(t)
+	for range 3 {
+		conn.in <- data
+	}
+	expect(t, tg.msgs, "0123456789")
+	expect(t, tg.msgs, "0123456789")
+	expectNone(t, tg.msgs)
+}
+
+func TestLimitDelay(t *testing.T) {
+	tg := newTestGate(t, &Gate{Limit: RateLimit{MsgRate: 20, MsgBurst: 1, Action: LimitDelay}})
+	conn, _, _ := tg.connect(t)
+	start := time.Now()
+	for i := range 3 {
+		conn.in <- tg.intMsg(t, int32(i))
+	}
+	for _, want := range []string{"0", "1", "2"} {
+		expect(t, tg.msgs, want)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("3 messages in %v at 20/s", d)
+	}
+	if s := tg.LimitStats(); s.Delayed != 2 || s.Dropped != 0 {
+		t.Fatalf("stats %v", s)
+	}
+}
+
+func TestLimitDisconnect(t *testing.T) {
+	tg := newTestGate(t, &Gate{Limit: RateLimit{MsgRate: 0.1, MsgBurst: 1, Action: LimitDisconnect}})
+	conn, _, done := tg.connect(t)
+	conn.in <- tg.intMsg(t, 1)
+	conn.in <- tg.intMsg(t, 2)
+	expect(t, tg.msgs, "1")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("agent kept")
+	}
+	expectNone(t, tg.msgs)
+	if s := tg.LimitStats(); s.Disconnected != 1 {
+		t.Fatalf("stats %v", s)
+	}
+}
+
+func TestMsgLimit(t *testing.T) {
+	tg := newTestGate(t, &Gate{})
+	tg.SetMsgLimit(&wrapperspb.StringValue{}, 0.1, 1)
+	conn, _, _ := tg.connect(t)
+
+	// only the limited type is dropped
+	conn.in <- tg.msg(t, "a")
+	conn.in <- tg.msg(t, "b")
+	conn.in <- tg.intMsg(t, 1)
+	conn.in <- tg.intMsg(t, 2)
+	for _, want := range []string{"a", "1", "2"} {
+		expect(t, tg.msgs, want)
+	}
+	if s := tg.LimitStats(); s.Dropped != 1 {
+		t.Fatalf("stats %v", s)
+	}
+
+	// each agent has its own buckets
+	conn2, _, _ := tg.connect(t)
+	conn2.in <- tg.msg(t, "c")
+	expect(t, tg.msgs, "c")
+}
@@ -0,0 +1,362 @@
+package gate
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gserv/network"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// Session resumption, enabled by Gate.ResumeGrace. the agent outlives its connection for the
+// grace period: messages written meanwhile are buffered and a new connection presenting the
+// resume token takes over the agent, NewAgent and CloseAgent are called once per session.
+//
+// every message is framed by the gate, the first byte is the frame kind:
+//
+//	client -> gate  new     [1]                                  first frame, opens a session
+//	client -> gate  resume  [2][token 16][last seq received 8]   first frame, resumes a session
+//	gate -> client  accept  [3][token 16][resumed 1][last seq received 8]
+//	both ways       data    [0][seq 8][message]
+//
+// sequence numbers are big endian and start at 1 in each direction. on resume the gate replays
+// the messages after the last one received by the client, if they are still buffered (the last
+// ResumeBufferLen messages), otherwise a new session is opened and accept has resumed set to 0.
+// the client resends its own messages after the last one received by the gate, duplicates are
+// dropped.
+const (
+	frameData byte = iota
+	frameNew
+	frameResume
+	frameAccept
+)
+
+const tokenLen = 16
+
+var errSessionExpired = errors.New("gate session expired")
+
+// session is the resumable state of an agent.
+type session struct {
+	token    string
+	mutex    sync.Mutex
+	conn     network.Conn // last bound connection
+	attached bool
+	closing  bool   // closed by the server, no grace period
+	expired  bool   // CloseAgent has been called
+	epoch    uint64 // incremented by each bind, invalidates the pending expiry
+	sendSeq  uint64
+	recvSeq  uint64
+	sent     [][]byte // last frames written, the one of sendSeq last
+	maxSent  int
+}
+
+// resumeConn is the network agent of a connection when sessions are resumable,
+// it binds the connection to a new or resumed session.
+type resumeConn struct {
+	gate *Gate
+	conn network.Conn
+	a    *agent
+}
+
+func (rc *resumeConn) Run() {
+	data, err := rc.conn.ReadMsg()
+	if err != nil {
+		return
+	}
+	rc.a = rc.gate.bindSession(rc.conn, data)
+	if rc.a == nil {
+		return
+	}
+	rc.gate.bindConn(rc.conn, rc.a)
+
+	for {
+		data, err := rc.conn.ReadMsg()
+		if err != nil {
+			break
+		}
+		if len(data) < 9 || data[0] != frameData {
+			logs.Debug("invalid session frame from %v", rc.conn.RemoteAddr())
+			break
+		}
+		if !rc.a.received(binary.BigEndian.Uint64(data[1:9])) {
+			continue
+		}
+		if !rc.a.route(data[9:]) {
+			break
+		}
+	}
+}
+
+func (rc *resumeConn) OnClose() {
+	if rc.a != nil {
+		rc.gate.unbindConn(rc.conn)
+		rc.a.detach(rc.conn)
+	}
+}
+
+// bindSession handles the first frame of a connection, it returns nil if the connection must be closed.
+func (gate *Gate) bindSession(conn network.Conn, hello []byte) *agent {
+	switch {
+	case len(hello) == 1 && hello[0] == frameNew:
+		return gate.openSession(conn)
+	case len(hello) == 1+tokenLen+8 && hello[0] == frameResume:
+		token := string(hello[1 : 1+tokenLen])
+		ack := binary.BigEndian.Uint64(hello[1+tokenLen:])
+
+		gate.mu.Lock()
+		a := gate.sessions[token]
+		gate.mu.Unlock()
+		if a != nil && a.resume(conn, ack) {
+			return a
+		}
+		logs.Debug("session of %v not resumable, opening a new one", conn.RemoteAddr())
+		return gate.openSession(conn)
+	default:
+		logs.Debug("invalid session handshake from %v", conn.RemoteAddr())
+		return nil
+	}
+}
+
+// openSession creates the agent of a new session bound to conn.
+func (gate *Gate) openSession(conn network.Conn) *agent {
+	token := make([]byte, tokenLen)
+	if _, err := rand.Read(token); err != nil {
+		logs.Error("generate session token error: %v", err)
+		return nil
+	}
+	maxSent := gate.ResumeBufferLen
+	if maxSent <= 0 {
+		maxSent = 64
+	}
+
+	a := &agent{gate: gate, session: &session{
+		token:    string(token),
+		conn:     conn,
+		attached: true,
+		epoch:    1,
+		maxSent:  maxSent,
+	}}
+	gate.mu.Lock()
+	if gate.sessions == nil {
+		gate.sessions = make(map[string]*agent)
+	}
+	gate.sessions[a.session.token] = a
+	gate.mu.Unlock()
+
+	a.session.mutex.Lock()
+	a.accept(false)
+	a.session.mutex.Unlock()
+
+	gate.open(a)
+	return a
+}
+
+// closeSessions ends the detached sessions once the servers are closed.
+func (gate *Gate) closeSessions() {
+	gate.mu.Lock()
+	agents := make([]*agent, 0, len(gate.sessions))
+	for _, a := range gate.sessions {
+		agents = append(agents, a)
+	}
+	gate.mu.Unlock()
+
+	for _, a := range agents {
+		s := a.session
+		s.mutex.Lock()
+		s.closing = true
+		epoch := s.epoch
+		s.mutex.Unlock()
+		a.expire(epoch)
+	}
+}
+
+// resume binds conn to the session and replays the messages after ack,
+// it returns false if some of them are not buffered anymore.
+func (a *agent) resume(conn network.Conn, ack uint64) bool {
+	s := a.session
+	s.mutex.Lock()
+	missed := s.sendSeq - ack
+	if s.expired || s.closing || ack > s.sendSeq || missed > uint64(len(s.sent)) {
+		s.mutex.Unlock()
+		return false
+	}
+	var old network.Conn
+	if s.attached {
+		old = s.conn
+	}
+	s.conn = conn
+	s.attached = true
+	s.epoch++
+	a.accept(true)
+	for _, frame := range s.sent[len(s.sent)-int(missed):] {
+		if err := conn.WriteMsg(frame); err != nil {
+			logs.Error("replay session message error: %v", err)
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	logs.Debug("session of %v resumed, %v messages replayed", conn.RemoteAddr(), missed)
+	return true
+}
+
+// accept sends the token to the client.
+// must be called with the session mutex held
+func (a *agent) accept(resumed bool) {
+	s := a.session
+	frame := make([]byte, 1+tokenLen+1+8)
+	frame[0] = frameAccept
+	copy(frame[1:], s.token)
+	if resumed {
+		frame[1+tokenLen] = 1
+	}
+	binary.BigEndian.PutUint64(frame[2+tokenLen:], s.recvSeq)
+	if err := s.conn.WriteMsg(frame); err != nil {
+		logs.Error("write session accept error: %v", err)
+	}
+}
+
+// detach unbinds a closed connection, the session expires after the grace period.
+func (a *agent) detach(conn network.Conn) {
+	s := a.session
+	s.mutex.Lock()
+	if !s.attached || s.conn != conn {
+		s.mutex.Unlock()
+		return
+	}
+	s.attached = false
+	epoch := s.epoch
+	closing := s.closing
+	s.mutex.Unlock()
+
+	if closing {
+		a.expire(epoch)
+		return
+	}
+	time.AfterFunc(a.gate.ResumeGrace, func() {
+		a.expire(epoch)
+	})
+}
+
+// expire ends the session if it has not been bound again since epoch.
+func (a *agent) expire(epoch uint64) {
+	s := a.session
+	s.mutex.Lock()
+	if s.attached || s.expired || s.epoch != epoch {
+		s.mutex.Unlock()
+		return
+	}
+	s.expired = true
+	s.sent = nil
+	s.mutex.Unlock()
+
+	a.gate.mu.Lock()
+	delete(a.gate.sessions, s.token)
+	a.gate.mu.Unlock()
+
+	a.OnClose()
+}
+
+// end closes the session without grace period.
+func (a *agent) end(destroy bool) {
+	s := a.session
+	s.mutex.Lock()
+	s.closing = true
+	conn, attached, epoch := s.conn, s.attached, s.epoch
+	s.mutex.Unlock()
+
+	if !attached {
+		// not on the caller goroutine, it may be the one serving CloseAgent
+		go a.expire(epoch)
+		return
+	}
+	if destroy {
+		conn.Destroy()
+	} else {
+		conn.Close()
+	}
+}
+
+// received reports whether an inbound message is new.
+func (a *agent) received(seq uint64) bool {
+	s := a.session
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seq <= s.recvSeq {
+		return false
+	}
+	s.recvSeq = seq
+	return true
+}
+
+// send numbers a message, buffers it for replay and writes it if a connection is bound.
+func (a *agent) send(args ...[]byte) error {
+	size := 9
+	for _, b := range args {
+		size += len(b)
+	}
+
+	s := a.session
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.expired {
+		return errSessionExpired
+	}
+	s.sendSeq++
+	frame := make([]byte, 9, size)
+	frame[0] = frameData
+	binary.BigEndian.PutUint64(frame[1:], s.sendSeq)
+	for _, b := range args {
+		frame = append(frame, b...)
+	}
+
+	if len(s.sent) == s.maxSent {
+		s.sent[0] = nil
+		s.sent = s.sent[1:]
+	}
+	s.sent = append(s.sent, frame)
+
+	if !s.attached {
+		return nil
+	}
+	return s.conn.WriteMsg(frame)
+}
+
+// sessionConn is the connection of a resumable agent as seen by the cluster,
+// pushed messages go through the session whatever connection it is bound to.
+type sessionConn struct {
+	a *agent
+}
+
+func (sc sessionConn) ReadMsg() ([]byte, error) {
+	return nil, errors.New("gate session is write only")
+}
+
+func (sc sessionConn) WriteMsg(args ...[]byte) error {
+	return sc.a.send(args...)
+}
+
+func (sc sessionConn) LocalAddr() net.Addr {
+	return sc.a.LocalAddr()
+}
+
+func (sc sessionConn) RemoteAddr() net.Addr {
+	return sc.a.RemoteAddr()
+}
+
+func (sc sessionConn) Close() {
+	sc.a.Close()
+}
+
+func (sc sessionConn) Destroy() {
+	sc.a.Destroy()
+}
@@ -0,0 +1,206 @@
+package gate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func dataFrame(seq uint64, msg []byte) []byte {
+	frame := make([]byte, 9, 9+len(msg))
+	frame[0] = frameData
+	binary.BigEndian.PutUint64(frame[1:], seq)
+	return append(frame, msg...)
+}
+
+func resumeFrame(token string, ack uint64) []byte {
+	frame := append([]byte{frameResume}, token...)
+	return binary.BigEndian.AppendUint64(frame, ack)
+}
+
+// readAccept reads the accept frame, it returns the token, the resumed flag and the last seq received.
+func readAccept(t *testing.T, conn *testConn) (string, bool, uint64) {
+	t.Helper()
+	frame := conn.read(t)
+	if len(frame) != 1+tokenLen+1+8 || frame[0] != frameAccept {
+		t.Fatalf("accept = %v", frame)
+	}
+	return string(frame[1 : 1+tokenLen]), frame[1+tokenLen] == 1, binary.BigEndian.Uint64(frame[2+tokenLen:])
+}
+
+func write(a *agent, s string) {
+	a.WriteMsg(&wrapperspb.StringValue{Value: s})
+}
+
+func TestResume(t *testing.T) {
+	tg := newTestGate(t, &Gate{ResumeGrace: time.Minute})
+
+	// new session
+	conn1 := newTestConn()
+	done1 := serve(tg.Gate, conn1)
+	conn1.in <- []byte{frameNew}
+	token, resumed, ack := readAccept(t, conn1)
+	if resumed || ack != 0 {
+		t.Fatalf("resumed = %v, ack = %v", resumed, ack)
+	}
+	expect(t, tg.events, "new")
+	a := <-tg.agents
+
+	conn1.in <- dataFrame(1, tg.msg(t, "m1"))
+	conn1.in <- dataFrame(2, tg.msg(t, "m2"))
+	expect(t, tg.msgs, "m1")
+	expect(t, tg.msgs, "m2")
+	write(a, "s1")
+	if got := conn1.read(t); !bytes.Equal(got, dataFrame(1, tg.msg(t, "s1"))) {
+		t.Fatalf("written %v", got)
+	}
+
+	// the connection drops, the agent survives and buffers its messages
+	conn1.Close()
+	<-done1
+	write(a, "s2")
+	write(a, "s3")
+	expectNone(t, tg.events)
+
+	// resumed by a new connection: the messages after the client ack are replayed
+	conn2 := newTestConn()
+	serve(tg.Gate, conn2)
+	conn2.in <- resumeFrame(token, 1)
+	token2, resumed, ack := readAccept(t, conn2)
+	if token2 != token || !resumed || ack != 2 {
+		t.Fatalf("token kept = %v, resumed = %v, ack = %v", token2 == token, resumed, ack)
+	}
+	if got := conn2.read(t); !bytes.Equal(got, dataFrame(2, tg.msg(t, "s2"))) {
+		t.Fatalf("replayed %v", got)
+	}
+	if got := conn2.read(t); !bytes.Equal(got, dataFrame(3, tg.msg(t, "s3"))) {
+		t.Fatalf("replayed %v", got)
+	}
+
+	// the client resends what the gate did not ack, duplicates are dropped
+	conn2.in <- dataFrame(2, tg.msg(t, "m2"))
+	conn2.in <- dataFrame(3, tg.msg(t, "m3"))
+	expect(t, tg.msgs, "m3")
+	expectNone(t, tg.msgs)
+	expectNone(t, tg.events)
+
+	// the agent writes to the new connection
+	write(a, "s4")
+	if got := conn2.read(t); !bytes.Equal(got, dataFrame(4, tg.msg(t, "s4"))) {
+		t.Fatalf("written %v", got)
+	}
+
+	// a resume while attached takes over the connection
+	conn3 := newTestConn()
+	serve(tg.Gate, conn3)
+	conn3.in <- resumeFrame(token, 4)
+	if _, resumed, _ := readAccept(t, conn3); !resumed {
+		t.Fatal("not resumed")
+	}
+	conn3.expectSilence(t)
+	if !conn2.isClosed() {
+		t.Fatal("old connection kept")
+	}
+	expectNone(t, tg.events)
+
+	// closed by the server: no grace period
+	a.Close()
+	expect(t, tg.events, "close")
+}
+
+func TestResumeTooLate(t *testing.T) {
+	tg := newTestGate(t, &Gate{ResumeGrace: 30 * time.Millisecond})
+
+	conn1 := newTestConn()
+	done1 := serve(tg.Gate, conn1)
+	conn1.in <- []byte{frameNew}
+	token, _, _ := readAccept(t, conn1)
+	expect(t, tg.events, "new")
+	conn1.Close()
+	<-done1
+
+	// the grace period is over: CloseAgent, and the token opens a new session
+	expect(t, tg.events, "close")
+	conn2 := newTestConn()
+	serve(tg.Gate, conn2)
+	conn2.in <- resumeFrame(token, 0)
+	token2, resumed, _ := readAccept(t, conn2)
+	if resumed || token2 == token {
+		t.Fatal("expired session resumed")
+	}
+	expect(t, tg.events, "new")
+}
+
+func TestResumeBufferOverflow(t *testing.T) {
+	tg := newTestGate(t, &Gate{ResumeGrace: 30 * time.Millisecond, ResumeBufferLen: 2})
+
+	conn1 := newTestConn()
+	done1 := serve(tg.Gate, conn1)
+	conn1.in <- []byte{frameNew}
+	token, _, _ := readAccept(t, conn1)
+	expect(t, tg.events, "new")
+	a := <-tg.agents
+	conn1.Close()
+	<-done1
+
+	// 3 messages missed, 2 kept: the client cannot catch up
+	for _, s := range []string{"s1", "s2", "s3"} {
+		write(a, s)
+	}
+	conn2 := newTestConn()
+	serve(tg.Gate, conn2)
+	conn2.in <- resumeFrame(token, 0)
+	if _, resumed, _ := readAccept(t, conn2); resumed {
+		t.Fatal("resumed with missing messages")
+	}
+	expect(t, tg.events, "new")
+	conn2.expectSilence(t)
+
+	// the old session expires at the end of its grace period
+	expect(t, tg.events, "close")
+}
+
+func TestResumeInvalidHandshake(t *testing.T) {
+	tg := newTestGate(t, &Gate{ResumeGrace: time.Minute})
+	for _, hello := range [][]byte{{frameData}, {frameResume, 1, 2}, tg.msg(t, "no handshake")} {
+		conn := newTestConn()
+		done := serve(tg.Gate, conn)
+		conn.in <- hello
+		<-done
+		conn.expectSilence(t)
+	}
+	expectNone(t, tg.events)
+
+	// a data frame must carry a sequence number
+	conn := newTestConn()
+	done := serve(tg.Gate, conn)
+	conn.in <- []byte{frameNew}
+	readAccept(t, conn)
+	expect(t, tg.events, "new")
+	conn.in <- []byte{frameData, 1}
+	<-done
+}
+
+func TestCloseSessions(t *testing.T) {
+	tg := newTestGate(t, &Gate{ResumeGrace: time.Minute})
+	conn := newTestConn()
+	done := serve(tg.Gate, conn)
+	conn.in <- []byte{frameNew}
+	readAccept(t, conn)
+	expect(t, tg.events, "new")
+	conn.Close()
+	<-done
+
+	// the gate stops: the detached sessions end without waiting for their grace period
+	tg.closeSessions()
+	expect(t, tg.events, "close")
+	tg.mu.Lock()
+	n := len(tg.sessions)
+	tg.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%v sessions left", n)
+	}
+}
@@ -1,14 +1,15 @@
-module gserv
+module github.com/yinyihanbing/gserv
 
 go 1.24.0
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/go-sql-driver/mysql v1.9.1
 	github.com/gomodule/redigo v1.9.2
 	github.com/gorilla/websocket v1.5.3
-	github.com/yinyihanbing/gserv v0.0.0-20201207064444-91ca62c01dcd
 	github.com/yinyihanbing/gutils v0.0.0-20200831114507-21202df15ed1
 	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -83,6 +83,10 @@ func (g *Go) Idle() bool {
 	return g.pendingGo == 0
 }
 
+func (g *Go) Pending() int {
+	return g.pendingGo
+}
+
 func (g *Go) NewLinearContext() *LinearContext {
 	c := new(LinearContext)
 	c.g = g
@@ -1,11 +1,14 @@
 package gserv
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall" // added syscall package
+	"time"
 
 	"github.com/yinyihanbing/gserv/cluster"
+	"github.com/yinyihanbing/gserv/conf"
 	"github.com/yinyihanbing/gserv/console"
 	"github.com/yinyihanbing/gserv/module"
 	"github.com/yinyihanbing/gserv/storage"
@@ -21,7 +24,18 @@ func Run(mods ...module.Module) {
 	for i := range len(mods) {
 		module.Register(mods[i]) // register each module
 	}
-	module.Init() // initialize all registered modules
+	// initialize all registered modules in dependency order
+	module.Init()
+
+	// start the module watchdog
+	if conf.HealthCheckInterval > 0 {
+		module.StartWatchdog(conf.HealthCheckInterval, conf.HealthCheckTimeout)
+	}
+
+	// watch the config file
+	if conf.ReloadInterval > 0 {
+		conf.Watch(conf.ReloadInterval)
+	}
 
 	// initialize cluster
 	cluster.Init()
@@ -37,10 +51,82 @@ func Run(mods ...module.Module) {
 	Stop()                                            // call stop to clean up resources
 }
 
+// storageShutdownShare reserves 1/storageShutdownShare of conf.ShutdownTimeout to the last shutdown
+// phase, the storage flush: the phases before it cannot spend it.
+const storageShutdownShare = 4
+
+// shutdownPhase is a step of Stop.
+type shutdownPhase struct {
+	name    string
+	f       func(ctx context.Context) // ctx is done at the deadline of the phase
+	pending func() string             // describes the work left when the phase times out, may be nil
+}
+
 // Stop gracefully shuts down the gserv application.
-// it destroys the cluster, modules, and storage resources.
+// it runs the shutdown phases in order, all bounded by conf.ShutdownTimeout:
+// stop accepting connections, close cluster links, drain modules, flush storage.
+// the phases before storage must finish within 3/4 of the budget, so the db queues always get
+// the last quarter to flush.
 func Stop() {
-	cluster.Destroy() // destroy cluster resources
-	module.Destroy()  // destroy module resources
-	storage.Destroy() // destroy storage resources
+	stop(conf.Hot().ShutdownTimeout, []shutdownPhase{
+		{"stop accepting", func(context.Context) {
+			module.StopWatchdog() // stop pinging modules
+			conf.StopWatch()      // stop reloading the config file
+			console.Destroy()     // destroy console resources
+			cluster.StopAccept()  // stop accepting cluster links
+			module.StopAccept()   // stop accepting connections on gates
+		}, nil},
+		{"cluster", func(context.Context) {
+			cluster.Destroy() // destroy cluster resources
+		}, nil},
+		{"modules", module.DestroyContext, module.Pending}, // destroy module resources, skipping the stalled ones
+		{"storage", func(context.Context) {
+			storage.Destroy() // flush the db queues and close the clients
+		}, storage.Pending},
+	})
+}
+
+// stop runs the phases in order within timeout, 0 means wait forever. the last phase has
+// 1/storageShutdownShare of timeout to itself.
+// a phase starts once the previous one has returned or timed out.
+func stop(timeout time.Duration, phases []shutdownPhase) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	early, cancelEarly := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		early, cancelEarly = context.WithTimeout(ctx, timeout-timeout/storageShutdownShare)
+	}
+	defer cancel()
+	defer cancelEarly()
+
+	for i, p := range phases {
+		if i == len(phases)-1 {
+			early = ctx
+		}
+		stopPhase(early, p)
+	}
+}
+
+// stopPhase runs one shutdown phase and waits for it until ctx is done.
+// a phase timing out is abandoned: its pending work is logged once and the next phase starts.
+func stopPhase(ctx context.Context, p shutdownPhase) {
+	logs.Info("gserv shutdown phase: %v", p.name)
+	start := time.Now()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.f(ctx)
+	}()
+
+	select {
+	case <-done:
+		logs.Info("gserv shutdown phase %v finished in %v", p.name, time.Since(start))
+	case <-ctx.Done():
+		if p.pending != nil {
+			logs.Error("gserv shutdown phase %v timed out, pending: %v", p.name, p.pending())
+		} else {
+			logs.Error("gserv shutdown phase %v timed out", p.name)
+		}
+	}
 }
@@ -0,0 +1,89 @@
+package gserv
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStopDeadline(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+
+	var pendingCalls atomic.Int32
+	phase := func(name string, f func(ctx context.Context)) shutdownPhase {
+		return shutdownPhase{name, f, func() string {
+			pendingCalls.Add(1)
+			return name
+		}}
+	}
+
+	// a hung phase does not keep stop running past the total deadline,
+	// the last phase still gets its share
+	var storageBudget time.Duration
+	start := time.Now()
+	stop(200*time.Millisecond, []shutdownPhase{
+		phase("accept", func(context.Context) {}),
+		phase("modules", func(context.Context) { <-hung }),
+		phase("late", func(context.Context) { <-hung }),
+		phase("storage", func(ctx context.Context) {
+			deadline, _ := ctx.Deadline()
+			storageBudget = time.Until(deadline)
+		}),
+	})
+	if d := time.Since(start); d < 150*time.Millisecond || d > 250*time.Millisecond {
+		t.Fatalf("stop returned after %v", d)
+	}
+	if storageBudget < 40*time.Millisecond {
+		t.Fatalf("storage phase got %v", storageBudget)
+	}
+	// the pending work of each phase timing out is logged once
+	if n := pendingCalls.Load(); n != 2 {
+		t.Fatalf("pending logged %v times", n)
+	}
+}
+
+func TestStopHungStorage(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+
+	start := time.Now()
+	stop(100*time.Millisecond, []shutdownPhase{
+		{"modules", func(context.Context) {}, nil},
+		{"storage", func(context.Context) { <-hung }, nil},
+	})
+	if d := time.Since(start); d < 90*time.Millisecond || d > 150*time.Millisecond {
+		t.Fatalf("stop returned after %v", d)
+	}
+}
+
+func TestStopPhasesInOrder(t *testing.T) {
+	// a phase starts once the previous one has returned
+	var running atomic.Int32
+	var ran []string
+	var phases []shutdownPhase
+	for _, name := range []string{"accept", "modules", "storage"} {
+		phases = append(phases, shutdownPhase{name, func(ctx context.Context) {
+			if running.Add(1) != 1 {
+				t.Errorf("phase %v runs beside another", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+			ran = append(ran, name)
+			running.Add(-1)
+		}, nil})
+	}
+	stop(time.Second, phases)
+	if len(ran) != 3 || ran[2] != "storage" {
+		t.Fatalf("phases = %v", ran)
+	}
+}
+
+func TestStopNoTimeout(t *testing.T) {
+	stop(0, []shutdownPhase{{"forever", func(ctx context.Context) {
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("deadline set without ShutdownTimeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}, nil}})
+}
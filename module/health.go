@@ -0,0 +1,192 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// HealthChecker is implemented by modules that can report their own health.
+// HealthCheck is executed on the module goroutine by the watchdog ping.
+type HealthChecker interface {
+	HealthCheck() error // Returns nil if the module is healthy.
+}
+
+// Pinger is implemented by modules whose loop can be pinged, Skeleton implements it.
+type Pinger interface {
+	Ping(timeout time.Duration, check func() error) (time.Duration, error)
+}
+
+// HealthStatus describes the last known health of a module.
+type HealthStatus struct {
+	Name      string        // The module name.
+	Stalled   bool          // The module loop did not answer the last ping in time.
+	Err       error         // The error reported by HealthCheck, or the ping error.
+	Latency   time.Duration // Round trip time of the last ping.
+	LastPing  time.Time     // Time of the last ping.
+	LastAlive time.Time     // Time of the last answered ping.
+}
+
+// Healthy reports whether the module answered the last ping without error.
+func (hs *HealthStatus) Healthy() bool {
+	return !hs.Stalled && hs.Err == nil
+}
+
+func (hs *HealthStatus) String() string {
+	state := "ok"
+	if hs.Stalled {
+		state = "stalled"
+	} else if hs.Err != nil {
+		state = "unhealthy"
+	}
+	s := fmt.Sprintf("%v: %v, latency=%v, last alive=%v", hs.Name, state, hs.Latency, hs.LastAlive.Format(time.DateTime))
+	if hs.Err != nil {
+		s += fmt.Sprintf(", err=%v", hs.Err)
+	}
+	return s
+}
+
+type watchdog struct {
+	sync.Mutex
+	interval time.Duration
+	timeout  time.Duration
+	status   map[*module]*HealthStatus
+	closeSig chan struct{}
+	wg       sync.WaitGroup
+}
+
+var wd atomic.Pointer[watchdog] // The running watchdog, nil if not started.
+
+// StartWatchdog starts pinging every Pinger module each interval.
+// A module that does not answer within timeout is reported as stalled together with a goroutine dump.
+// Must be called after Init.
+func StartWatchdog(interval time.Duration, timeout time.Duration) {
+	if wd.Load() != nil {
+		logs.Fatal("module watchdog is already running")
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+		logs.Info("invalid watchdog interval. resetting to default value: %v", interval)
+	}
+	if timeout <= 0 || timeout > interval {
+		timeout = interval
+		logs.Info("invalid watchdog timeout. resetting to default value: %v", timeout)
+	}
+
+	w := &watchdog{
+		interval: interval,
+		timeout:  timeout,
+		status:   make(map[*module]*HealthStatus),
+		closeSig: make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.run()
+	wd.Store(w)
+}
+
+// StopWatchdog stops the watchdog started by StartWatchdog.
+func StopWatchdog() {
+	w := wd.Swap(nil)
+	if w == nil {
+		return
+	}
+	close(w.closeSig)
+	w.wg.Wait()
+}
+
+// Health returns the last known health of the pinged modules, nil if the watchdog is not running.
+// It is goroutine safe.
+func Health() []HealthStatus {
+	w := wd.Load()
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	ret := make([]HealthStatus, 0, len(w.status))
+	for _, m := range mods {
+		if hs, ok := w.status[m]; ok {
+			ret = append(ret, *hs)
+		}
+	}
+	return ret
+}
+
+// run pings the modules until the watchdog is stopped.
+func (w *watchdog) run() {
+	defer w.wg.Done()
+
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.closeSig:
+			return
+		case <-t.C:
+			w.check()
+		}
+	}
+}
+
+// check pings every module concurrently and records the results.
+func (w *watchdog) check() {
+	var wg sync.WaitGroup
+	for _, m := range mods {
+		p, ok := m.mi.(Pinger)
+		if !ok {
+			continue
+		}
+		var hc func() error
+		if h, ok := m.mi.(HealthChecker); ok {
+			hc = h.HealthCheck
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := time.Now()
+			latency, err := p.Ping(w.timeout, hc)
+			w.record(m, now, latency, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// record stores a ping result and logs health transitions.
+func (w *watchdog) record(m *module, now time.Time, latency time.Duration, err error) {
+	stalled := errors.Is(err, chanrpc.ErrCallCanceled)
+
+	w.Lock()
+	hs, ok := w.status[m]
+	if !ok {
+		hs = &HealthStatus{Name: displayName(m)}
+		w.status[m] = hs
+	}
+	wasStalled, wasErr := hs.Stalled, hs.Err
+	hs.Stalled = stalled
+	hs.Err = err
+	hs.Latency = latency
+	hs.LastPing = now
+	if !stalled {
+		hs.LastAlive = now
+	}
+	w.Unlock()
+
+	switch {
+	case stalled && !wasStalled:
+		buf := make([]byte, 1<<20)
+		l := runtime.Stack(buf, true)
+		logs.Error("module %v stalled, no answer in %v: %s", hs.Name, w.timeout, buf[:l])
+	case err != nil && !stalled && wasErr == nil:
+		logs.Error("module %v unhealthy: %v", hs.Name, err)
+	case err == nil && (wasStalled || wasErr != nil):
+		logs.Info("module %v recovered, latency=%v", hs.Name, latency)
+	}
+}
@@ -0,0 +1,90 @@
+package module
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+)
+
+// skeletonModule is a module running a Skeleton, optionally reporting its health.
+type skeletonModule struct {
+	*Skeleton
+	name   string
+	health atomic.Pointer[error]
+}
+
+func newSkeletonModule(name string) *skeletonModule {
+	m := &skeletonModule{
+		Skeleton: &Skeleton{GoLen: 1, TimerDispatcherLen: 1, AsynCallLen: 1, ChanRPCServer: chanrpc.NewServer(10)},
+		name:     name,
+	}
+	m.Skeleton.Init()
+	return m
+}
+
+func (m *skeletonModule) Name() string { return m.name }
+func (m *skeletonModule) OnInit()      {}
+func (m *skeletonModule) OnDestroy()   {}
+
+func (m *skeletonModule) HealthCheck() error {
+	if err := m.health.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func TestWatchdog(t *testing.T) {
+	reset(t)
+	healthy := newSkeletonModule("healthy")
+	stuck := newSkeletonModule("stuck")
+	sick := newSkeletonModule("sick")
+	errSick := errors.New("db down")
+	sick.health.Store(&errSick)
+
+	release := make(chan struct{})
+	stuck.RegisterChanRPC("block", func(args []any) { <-release })
+	Register(healthy)
+	Register(stuck)
+	Register(sick)
+	Init()
+	defer Destroy()
+
+	stuck.ChanRPCServer.Go("block")
+	StartWatchdog(20*time.Millisecond, 10*time.Millisecond)
+	defer StopWatchdog()
+	time.Sleep(60 * time.Millisecond)
+
+	status := make(map[string]HealthStatus)
+	for _, hs := range Health() {
+		status[hs.Name] = hs
+	}
+	if hs := status["healthy"]; !hs.Healthy() || hs.LastAlive.IsZero() {
+		t.Fatalf("healthy = %v", &hs)
+	}
+	if hs := status["stuck"]; !hs.Stalled || hs.Healthy() {
+		t.Fatalf("stuck = %v", &hs)
+	}
+	if hs := status["sick"]; hs.Stalled || !errors.Is(hs.Err, errSick) {
+		t.Fatalf("sick = %v", &hs)
+	}
+
+	// the stuck module recovers once its handler returns
+	close(release)
+	sick.health.Store(nil)
+	time.Sleep(60 * time.Millisecond)
+	for _, hs := range Health() {
+		if !hs.Healthy() {
+			t.Fatalf("%v not recovered", &hs)
+		}
+	}
+}
+
+func TestWatchdogStopped(t *testing.T) {
+	if Health() != nil {
+		t.Fatal("Health without a watchdog")
+	}
+	StopWatchdog()
+}
@@ -1,9 +1,13 @@
 package module
 
 import (
+	"context"
+	"fmt"
 	"runtime"
+	"strings"
 	"sync"
 
+	"github.com/yinyihanbing/gserv/chanrpc"
 	"github.com/yinyihanbing/gserv/conf"
 	"github.com/yinyihanbing/gutils/logs"
 )
@@ -15,46 +19,218 @@ type Module interface {
 	Run(closeSig chan bool) // Called to run the module, listens for a close signal.
 }
 
+// Named is implemented by modules that can be looked up with Get and depended on by other modules.
+type Named interface {
+	Name() string // Returns the unique name of the module.
+}
+
+// Acceptor is implemented by modules that accept external work (e.g. gate) and can stop accepting it before shutdown.
+type Acceptor interface {
+	StopAccept() // Stops accepting new work, work already accepted is kept.
+}
+
+// Dependent is implemented by modules that must be initialized after other modules.
+type Dependent interface {
+	Dependencies() []string // Returns the names of the modules this module depends on.
+}
+
 type module struct {
 	mi       Module         // The module instance.
+	name     string         // The module name, empty if the module is not Named.
 	closeSig chan bool      // Channel to signal the module to stop.
+	done     chan struct{}  // Closed when the module's Run method returns.
 	wg       sync.WaitGroup // WaitGroup to manage module's goroutines.
 }
 
-var mods []*module // List of registered modules.
+var (
+	mods      []*module          // List of registered modules, in initialization order after Init.
+	byName    map[string]*module // Named modules indexed by name.
+	destroyCx context.Context    // Context of the running Destroy, bounds the Skeleton shutdown.
+)
 
 // Register adds a new module to the list of registered modules.
 // Parameter: mi - the module instance to register.
 func Register(mi Module) {
-	mods = append(mods, &module{
+	m := &module{
 		mi:       mi,
 		closeSig: make(chan bool, 1),
-	})
+		done:     make(chan struct{}),
+	}
+	if n, ok := mi.(Named); ok {
+		m.name = n.Name()
+		if byName == nil {
+			byName = make(map[string]*module)
+		}
+		if _, ok := byName[m.name]; ok {
+			logs.Fatal("module %v is already registered", m.name)
+		}
+		byName[m.name] = m
+	}
+	mods = append(mods, m)
+}
+
+// Get returns the named module, or nil if no module with that name is registered.
+// Parameter: name - the module name.
+func Get(name string) Module {
+	if m, ok := byName[name]; ok {
+		return m.mi
+	}
+	return nil
+}
+
+// GetChanRPC returns the ChanRPC server of the named module, or nil if the module does not expose one.
+// Parameter: name - the module name.
+func GetChanRPC(name string) *chanrpc.Server {
+	if p, ok := Get(name).(interface{ ChanRPC() *chanrpc.Server }); ok {
+		return p.ChanRPC()
+	}
+	return nil
 }
 
-// Init initializes all registered modules and starts their execution.
+// Init sorts the registered modules by their dependencies, initializes them and starts their execution.
+// A missing or cyclic dependency is fatal, see InitE.
 func Init() {
+	if err := InitE(); err != nil {
+		logs.Fatal("module init failed: %v", err)
+	}
+}
+
+// InitE is like Init, but returns an error without initializing any module if a dependency is missing or cyclic.
+func InitE() error {
+	sorted, err := sortModules(mods)
+	if err != nil {
+		return err
+	}
+	mods = sorted
+
 	for _, m := range mods {
 		m.mi.OnInit() // Call the module's initialization method.
 		m.wg.Add(1)   // Increment the WaitGroup counter.
 		go run(m)     // Start the module's Run method in a goroutine.
 	}
+	return nil
 }
 
-// Destroy stops and cleans up all registered modules in reverse order.
+// StopAccept asks every module implementing Acceptor to stop accepting new work.
+func StopAccept() {
+	for i := len(mods) - 1; i >= 0; i-- {
+		if a, ok := mods[i].mi.(Acceptor); ok {
+			a.StopAccept()
+		}
+	}
+}
+
+// Destroy stops and cleans up all registered modules in reverse dependency order.
 func Destroy() {
+	DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy, but gives up waiting for a module once ctx is done.
+// A module that has not stopped in time is logged and its OnDestroy is skipped.
+// Parameter: ctx - bounds the whole destroy, its deadline is also honored by Skeleton.
+func DestroyContext(ctx context.Context) {
+	destroyCx = ctx
 	for i := len(mods) - 1; i >= 0; i-- {
 		m := mods[i]
 		m.closeSig <- true // Send a signal to stop the module.
-		m.wg.Wait()        // Wait for the module's goroutine to finish.
-		safeDestroy(m)     // Safely destroy the module.
+
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			select {
+			case <-m.done:
+			default:
+				logs.Error("module %v did not stop before the shutdown deadline", displayName(m))
+				continue
+			}
+		}
+		m.wg.Wait()    // Wait for the module's goroutine to finish.
+		safeDestroy(m) // Safely destroy the module.
+	}
+}
+
+// Pending describes the modules that are still running and the length of their ChanRPC queue.
+// It is goroutine safe and meant for shutdown diagnostics.
+func Pending() string {
+	var pending []string
+	for _, m := range mods {
+		select {
+		case <-m.done:
+			continue
+		default:
+		}
+		desc := displayName(m)
+		if p, ok := m.mi.(interface{ ChanRPC() *chanrpc.Server }); ok && p.ChanRPC() != nil {
+			desc += fmt.Sprintf("(queue=%v)", len(p.ChanRPC().ChanCall))
+		}
+		pending = append(pending, desc)
+	}
+	return strings.Join(pending, ", ")
+}
+
+// sortModules orders modules so that every module comes after its dependencies.
+// Modules without ordering constraints keep their registration order.
+// Parameter: ms - the registered modules.
+func sortModules(ms []*module) ([]*module, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*module]int, len(ms))
+	sorted := make([]*module, 0, len(ms))
+	var path []string
+
+	var visit func(m *module) error
+	visit = func(m *module) error {
+		switch state[m] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("module dependency cycle: %v -> %v", strings.Join(path, " -> "), displayName(m))
+		}
+
+		state[m] = visiting
+		path = append(path, displayName(m))
+		if d, ok := m.mi.(Dependent); ok {
+			for _, name := range d.Dependencies() {
+				dep, ok := byName[name]
+				if !ok {
+					return fmt.Errorf("module %v: dependency %v is not registered", displayName(m), name)
+				}
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[m] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+
+	for _, m := range ms {
+		if err := visit(m); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// displayName returns the module name, or its type for unnamed modules.
+// Parameter: m - the module instance.
+func displayName(m *module) string {
+	if m.name != "" {
+		return m.name
 	}
+	return fmt.Sprintf("%T", m.mi)
 }
 
 // run executes the module's Run method.
 // Parameter: m - the module instance.
 func run(m *module) {
-	defer m.wg.Done() // Decrement the WaitGroup counter when done.
+	defer m.wg.Done()   // Decrement the WaitGroup counter when done.
+	defer close(m.done) // Mark the module as stopped.
 	m.mi.Run(m.closeSig)
 }
 
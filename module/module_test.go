@@ -0,0 +1,112 @@
+package module
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yinyihanbing/gserv/chanrpc"
+)
+
+// events records the module lifecycle calls in order.
+type events struct {
+	sync.Mutex
+	list []string
+}
+
+func (e *events) add(s string) {
+	e.Lock()
+	e.list = append(e.list, s)
+	e.Unlock()
+}
+
+type testModule struct {
+	name   string
+	deps   []string
+	events *events
+	server *chanrpc.Server
+}
+
+func (m *testModule) Name() string             { return m.name }
+func (m *testModule) Dependencies() []string   { return m.deps }
+func (m *testModule) OnInit()                  { m.events.add("init " + m.name) }
+func (m *testModule) OnDestroy()               { m.events.add("destroy " + m.name) }
+func (m *testModule) Run(closeSig chan bool)   { <-closeSig }
+func (m *testModule) ChanRPC() *chanrpc.Server { return m.server }
+
+// reset forgets the registered modules.
+func reset(t *testing.T) {
+	mods, byName = nil, nil
+	t.Cleanup(func() { mods, byName = nil, nil })
+}
+
+func TestDependencyOrder(t *testing.T) {
+	reset(t)
+	ev := new(events)
+	server := chanrpc.NewServer(1)
+	Register(&testModule{name: "login", deps: []string{"storage", "cache"}, events: ev, server: server})
+	Register(&testModule{name: "cache", deps: []string{"storage"}, events: ev})
+	Register(&testModule{name: "storage", events: ev})
+
+	if err := InitE(); err != nil {
+		t.Fatal(err)
+	}
+	if Get("cache") == nil || Get("missing") != nil {
+		t.Fatal("Get")
+	}
+	if GetChanRPC("login") != server || GetChanRPC("storage") != nil {
+		t.Fatal("GetChanRPC")
+	}
+	Destroy()
+
+	want := "init storage,init cache,init login,destroy login,destroy cache,destroy storage"
+	if got := strings.Join(ev.list, ","); got != want {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+func TestDependencyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mods []*testModule
+		err  string
+	}{
+		{[]*testModule{{name: "a", deps: []string{"b"}}, {name: "b", deps: []string{"a"}}}, "cycle: a -> b -> a"},
+		{[]*testModule{{name: "a", deps: []string{"a"}}}, "cycle: a -> a"},
+		{[]*testModule{{name: "a", deps: []string{"x"}}}, "dependency x is not registered"},
+	} {
+		reset(t)
+		ev := new(events)
+		for _, m := range tc.mods {
+			m.events = ev
+			Register(m)
+		}
+		err := InitE()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("err = %v, want %q", err, tc.err)
+		}
+		if len(ev.list) != 0 {
+			t.Fatalf("modules initialized despite the error: %v", ev.list)
+		}
+	}
+}
+
+type unnamed struct{ events *events }
+
+func (m *unnamed) OnInit()                {}
+func (m *unnamed) OnDestroy()             { m.events.add("destroy unnamed") }
+func (m *unnamed) Run(closeSig chan bool) { <-closeSig }
+
+func TestRegistrationOrderKept(t *testing.T) {
+	reset(t)
+	ev := new(events)
+	Register(&unnamed{events: ev})
+	Register(&testModule{name: "b", events: ev})
+	Register(&testModule{name: "a", events: ev})
+	Init()
+	Destroy()
+
+	want := "init b,init a,destroy a,destroy b,destroy unnamed"
+	if got := strings.Join(ev.list, ","); got != want {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
@@ -1,10 +1,12 @@
 package module
 
 import (
+	"context"
 	"time"
 
 	"github.com/yinyihanbing/gserv/chanrpc"
 	g "github.com/yinyihanbing/gserv/go"
+	"github.com/yinyihanbing/gutils/logs"
 	"github.com/yinyihanbing/gutils/timer"
 )
 
@@ -34,6 +36,7 @@ func (s *Skeleton) Init() {
 		s.server = chanrpc.NewServer(0)
 	}
 	s.commandServer = chanrpc.NewServer(0)
+	s.commandServer.Register(pingCommand{}, s.onPing)
 }
 
 // Run starts the main loop of the Skeleton, handling various events until a close signal is received.
@@ -98,6 +101,64 @@ func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...inte
 	s.client.AsynCall(id, args...)
 }
 
+// AsynCallContext performs an asynchronous call to a ChanRPC server that is abandoned once ctx is done.
+func (s *Skeleton) AsynCallContext(ctx context.Context, server *chanrpc.Server, id interface{}, args ...interface{}) {
+	s.ensureValidClient()
+	s.client.Attach(server)
+	s.client.AsynCallContext(ctx, id, args...)
+}
+
+// AsynCall performs a typed asynchronous call to a ChanRPC server, the callback runs on the Skeleton goroutine.
+func AsynCall[Req, Resp any](s *Skeleton, server *chanrpc.Server, key chanrpc.Key[Req, Resp], req Req, cb func(Resp, error)) {
+	s.ensureValidClient()
+	s.client.Attach(server)
+	chanrpc.AsynCall(s.client, key, req, cb)
+}
+
+// AsynCallContext performs a typed asynchronous call to a ChanRPC server that is abandoned once ctx is done.
+func AsynCallContext[Req, Resp any](ctx context.Context, s *Skeleton, server *chanrpc.Server, key chanrpc.Key[Req, Resp], req Req, cb func(Resp, error)) {
+	s.ensureValidClient()
+	s.client.Attach(server)
+	chanrpc.AsynCallContext(ctx, s.client, key, req, cb)
+}
+
+// AsynCallFunc runs call on its own goroutine, the callback receives the result on the Skeleton goroutine.
+func (s *Skeleton) AsynCallFunc(call func() (any, error), cb any) {
+	s.ensureValidClient()
+	s.client.AsynCallFunc(call, cb)
+}
+
+// pingCommand is the command server id used by Ping.
+type pingCommand struct{}
+
+// Ping measures how long the Skeleton loop takes to serve a command, check runs on the Skeleton goroutine.
+func (s *Skeleton) Ping(timeout time.Duration, check func() error) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	ret, err := s.commandServer.Call1Context(ctx, pingCommand{}, check)
+	if err == nil && ret != nil {
+		err = ret.(error)
+	}
+	return time.Since(start), err
+}
+
+// onPing answers a Ping on the Skeleton goroutine.
+func (s *Skeleton) onPing(args []any) any {
+	if check, _ := args[0].(func() error); check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChanRPC returns the ChanRPC server of the Skeleton, used by GetChanRPC to expose it to other modules.
+func (s *Skeleton) ChanRPC() *chanrpc.Server {
+	return s.ChanRPCServer
+}
+
 // RegisterChanRPC registers a function with a ChanRPC server for remote procedure calls.
 func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	if s.ChanRPCServer == nil {
@@ -128,12 +189,45 @@ func (s *Skeleton) ensureValidClient() {
 }
 
 // shutdown gracefully shuts down the Skeleton, ensuring all resources are released.
+// Calls already queued are executed and pending callbacks are awaited until the Destroy deadline.
 func (s *Skeleton) shutdown() {
+	var timeout <-chan time.Time
+	if destroyCx != nil {
+		if deadline, ok := destroyCx.Deadline(); ok {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+	}
+
+	// drain the chanrpc queues
+drain:
+	for {
+		select {
+		case ci := <-s.commandServer.ChanCall:
+			s.commandServer.Exec(ci)
+		case ci := <-s.server.ChanCall:
+			s.server.Exec(ci)
+		case <-timeout:
+			logs.Error("skeleton shutdown timeout, chanrpc calls left: %v", len(s.server.ChanCall))
+			break drain
+		default:
+			break drain
+		}
+	}
+
 	s.commandServer.Close()
 	s.server.Close()
 	for !s.g.Idle() || !s.client.Idle() {
-		s.g.Close()
-		s.client.Close()
+		select {
+		case ri := <-s.client.ChanAsynRet:
+			s.client.Cb(ri)
+		case cb := <-s.g.ChanCb:
+			s.g.Cb(cb)
+		case <-timeout:
+			logs.Error("skeleton shutdown timeout, pending go: %v, pending asyncall: %v", s.g.Pending(), s.client.Pending())
+			return
+		}
 	}
 }
 
@@ -0,0 +1,234 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WritePolicy selects what a connection does when PendingWriteNum messages wait to be written.
+type WritePolicy string
+
+const (
+	WriteDisconnect    WritePolicy = "disconnect"     // the connection is destroyed
+	WriteBlock         WritePolicy = "block"          // the write waits for room up to BlockTimeout, then the connection is destroyed
+	WriteDropOldest    WritePolicy = "drop_oldest"    // the oldest waiting message is dropped
+	WriteDropNewest    WritePolicy = "drop_newest"    // the message written is dropped
+	WriteDropDroppable WritePolicy = "drop_droppable" // the droppable messages are dropped, other messages destroy the connection
+)
+
+// Backpressure configures the write queue of the connections of a server.
+type Backpressure struct {
+	// Policy applied to a full queue, WriteDisconnect if empty
+	Policy WritePolicy
+	// time a WriteBlock write waits for room, 1s if 0
+	BlockTimeout time.Duration `conf:"min=0"`
+	// queue length calling OnHighWatermark, 0 disables it. with WriteDropDroppable, the droppable
+	// messages are dropped from this length on to keep room for the others
+	HighWatermark int `conf:"min=0"`
+	// OnHighWatermark is called on the writing goroutine when the queue of conn reaches HighWatermark,
+	// and again once it has drained below half of it and reaches it again. it must not write to conn
+	OnHighWatermark func(conn Conn, pending int) `conf:"-"`
+}
+
+// Validate checks the policy.
+func (bp *Backpressure) Validate() error {
+	switch bp.Policy {
+	case "", WriteDisconnect, WriteBlock, WriteDropOldest, WriteDropNewest, WriteDropDroppable:
+		return nil
+	default:
+		return errors.New("Backpressure.Policy must be disconnect, block, drop_oldest, drop_newest or drop_droppable")
+	}
+}
+
+// WriteStats counts the outcomes of the writes finding a full queue since the server started.
+type WriteStats struct {
+	Blocked        uint64 // writes that waited for room
+	Dropped        uint64 // messages dropped
+	Disconnected   uint64 // connections destroyed, including the block timeouts
+	HighWatermarks uint64 // times a queue reached the high watermark
+}
+
+func (s WriteStats) String() string {
+	return fmt.Sprintf("blocked=%v, dropped=%v, disconnected=%v, highwatermarks=%v",
+		s.Blocked, s.Dropped, s.Disconnected, s.HighWatermarks)
+}
+
+// writeStats is the atomic form of WriteStats.
+type writeStats struct {
+	blocked        atomic.Uint64
+	dropped        atomic.Uint64
+	disconnected   atomic.Uint64
+	highWatermarks atomic.Uint64
+}
+
+func (s *writeStats) load() WriteStats {
+	return WriteStats{
+		Blocked:        s.blocked.Load(),
+		Dropped:        s.dropped.Load(),
+		Disconnected:   s.disconnected.Load(),
+		HighWatermarks: s.highWatermarks.Load(),
+	}
+}
+
+// writeBuf is a write queued on a connection, a zero writeBuf closes the connection.
+type writeBuf struct {
+	b         []byte
+	pooled    *[]byte // the buffer of b, released once written, nil if b belongs to the caller
+	droppable bool    // may be dropped by WriteDropDroppable
+}
+
+// writeQueue is the write channel of a connection with its backpressure policy. it is guarded by
+// the mutex of the connection, except the receives of the write goroutine.
+type writeQueue struct {
+	ch      chan writeBuf
+	bp      Backpressure
+	stats   *writeStats
+	space   chan struct{} // closed to wake the blocked writes, nil if none waits
+	waiting int
+	above   atomic.Bool // the queue reached the high watermark and has not drained yet
+	due     atomic.Bool // OnHighWatermark must be called
+}
+
+// newWriteQueue creates the queue of a connection, bp and stats are the server ones, nil for clients.
+func newWriteQueue(pendingWriteNum int, bp *Backpressure, stats *writeStats) *writeQueue {
+	q := &writeQueue{ch: make(chan writeBuf, pendingWriteNum), stats: stats}
+	if bp != nil {
+		q.bp = *bp
+	}
+	if q.stats == nil {
+		q.stats = new(writeStats)
+	}
+	return q
+}
+
+// push queues w, applying the policy if the queue is full. it returns false if the connection
+// must be destroyed.
+// must be called with mu held and the connection open, mu is released while WriteBlock waits
+func (q *writeQueue) push(mu *sync.Mutex, closeFlag *bool, w writeBuf) bool {
+	hw := q.bp.HighWatermark
+	if w.droppable && q.bp.Policy == WriteDropDroppable && hw > 0 && len(q.ch) >= hw {
+		q.drop(w)
+		return true
+	}
+
+	if len(q.ch) == cap(q.ch) {
+		// the close signal is never dropped
+		if w.b == nil {
+			q.stats.disconnected.Add(1)
+			return false
+		}
+		switch q.bp.Policy {
+		case WriteBlock:
+			if !q.wait(mu, closeFlag) {
+				q.stats.disconnected.Add(1)
+				return false
+			}
+			if *closeFlag {
+				q.drop(w)
+				return true
+			}
+		case WriteDropOldest:
+			select {
+			case old := <-q.ch:
+				q.drop(old)
+			default:
+			}
+		case WriteDropNewest:
+			q.drop(w)
+			return true
+		case WriteDropDroppable:
+			if w.droppable {
+				q.drop(w)
+				return true
+			}
+			q.stats.disconnected.Add(1)
+			return false
+		default:
+			q.stats.disconnected.Add(1)
+			return false
+		}
+	}
+
+	q.ch <- w
+	if hw > 0 && len(q.ch) >= hw && q.above.CompareAndSwap(false, true) {
+		q.stats.highWatermarks.Add(1)
+		q.due.Store(true)
+	}
+	return true
+}
+
+// wait waits for room in the queue, it returns false on timeout. it returns true if the connection
+// is closed meanwhile.
+// must be called with mu held
+func (q *writeQueue) wait(mu *sync.Mutex, closeFlag *bool) bool {
+	q.stats.blocked.Add(1)
+	timeout := q.bp.BlockTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for len(q.ch) == cap(q.ch) && !*closeFlag {
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		space := q.space
+		q.waiting++
+		mu.Unlock()
+		timedOut := false
+		select {
+		case <-space:
+		case <-t.C:
+			timedOut = true
+		}
+		mu.Lock()
+		q.waiting--
+		if timedOut && len(q.ch) == cap(q.ch) && !*closeFlag {
+			return false
+		}
+	}
+	return true
+}
+
+// wake wakes the blocked writes.
+// must be called with mu held
+func (q *writeQueue) wake() {
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+}
+
+// taken is called by the write goroutine after taking messages from the queue.
+func (q *writeQueue) taken(mu *sync.Mutex) {
+	if q.above.Load() && len(q.ch) < q.bp.HighWatermark/2 {
+		q.above.Store(false)
+	}
+	if q.bp.Policy == WriteBlock {
+		mu.Lock()
+		if q.waiting > 0 {
+			q.wake()
+		}
+		mu.Unlock()
+	}
+}
+
+// drop discards a message.
+func (q *writeQueue) drop(w writeBuf) {
+	q.stats.dropped.Add(1)
+	if w.pooled != nil {
+		putBuffer(w.pooled)
+	}
+}
+
+// notify calls OnHighWatermark if the queue reached the high watermark.
+// must be called without the mutex of the connection
+func (q *writeQueue) notify(conn Conn) {
+	if q.due.Load() && q.due.Swap(false) && q.bp.OnHighWatermark != nil {
+		q.bp.OnHighWatermark(conn, len(q.ch))
+	}
+}
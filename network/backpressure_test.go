@@ -0,0 +1,312 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testQueue is a write queue with the lock and close flag of its connection.
+type testQueue struct {
+	*writeQueue
+	mu        sync.Mutex
+	closeFlag bool
+}
+
+func newTestQueue(n int, bp Backpressure) *testQueue {
+	return &testQueue{writeQueue: newWriteQueue(n, &bp, nil)}
+}
+
+func (q *testQueue) push(s string, droppable bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.writeQueue.push(&q.mu, &q.closeFlag, writeBuf{b: []byte(s), droppable: droppable})
+}
+
+// take receives the next message as the write goroutine does.
+func (q *testQueue) take() string {
+	w := <-q.ch
+	q.taken(&q.mu)
+	return string(w.b)
+}
+
+// queued returns the messages waiting.
+func (q *testQueue) queued() []string {
+	var msgs []string
+	for len(q.ch) > 0 {
+		msgs = append(msgs, q.take())
+	}
+	return msgs
+}
+
+func (q *testQueue) expect(t *testing.T, want ...string) {
+	t.Helper()
+	if msgs := q.queued(); fmt.Sprint(msgs) != fmt.Sprint(want) {
+		t.Fatalf("queued %v, want %v", msgs, want)
+	}
+}
+
+func TestBackpressureValidate(t *testing.T) {
+	for _, p := range []WritePolicy{"", WriteDisconnect, WriteBlock, WriteDropOldest, WriteDropNewest, WriteDropDroppable} {
+		if err := (&Backpressure{Policy: p}).Validate(); err != nil {
+			t.Fatalf("policy %q: %v", p, err)
+		}
+	}
+	if err := (&Backpressure{Policy: "drop"}).Validate(); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+func TestWriteDisconnect(t *testing.T) {
+	for _, p := range []WritePolicy{"", WriteDisconnect} {
+		q := newTestQueue(2, Backpressure{Policy: p})
+		if !q.push("a", false) || !q.push("b", true) {
+			t.Fatal("write refused before the queue is full")
+		}
+		if q.push("c", true) {
+			t.Fatalf("policy %q: full queue kept", p)
+		}
+		if s := q.stats.load(); s != (WriteStats{Disconnected: 1}) {
+			t.Fatalf("stats %v", s)
+		}
+	}
+}
+
+func TestWriteDrop(t *testing.T) {
+	q := newTestQueue(2, Backpressure{Policy: WriteDropNewest})
+	for _, s := range []string{"a", "b", "c", "d"} {
+		if !q.push(s, false) {
+			t.Fatal("connection destroyed")
+		}
+	}
+	if s := q.stats.load(); s != (WriteStats{Dropped: 2}) {
+		t.Fatalf("stats %v", s)
+	}
+	q.expect(t, "a", "b")
+
+	q = newTestQueue(2, Backpressure{Policy: WriteDropOldest})
+	for _, s := range []string{"a", "b", "c", "d"} {
+		if !q.push(s, false) {
+			t.Fatal("connection destroyed")
+		}
+	}
+	if s := q.stats.load(); s != (WriteStats{Dropped: 2}) {
+		t.Fatalf("stats %v", s)
+	}
+	q.expect(t, "c", "d")
+
+	// the close signal is never dropped
+	q.push("a", false)
+	q.push("b", false)
+	q.mu.Lock()
+	closed := q.writeQueue.push(&q.mu, &q.closeFlag, writeBuf{})
+	q.mu.Unlock()
+	if closed {
+		t.Fatal("close signal dropped")
+	}
+}
+
+func TestWriteDropDroppable(t *testing.T) {
+	q := newTestQueue(2, Backpressure{Policy: WriteDropDroppable})
+	q.push("a", false)
+	q.push("b", true)
+	if !q.push("c", true) {
+		t.Fatal("connection destroyed for a droppable message")
+	}
+	if q.push("d", false) {
+		t.Fatal("message dropped")
+	}
+	if s := q.stats.load(); s != (WriteStats{Dropped: 1, Disconnected: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+
+	// the droppable messages are dropped from the high watermark on, the others are queued
+	q = newTestQueue(4, Backpressure{Policy: WriteDropDroppable, HighWatermark: 2})
+	for i, droppable := range []bool{true, false, true, false, true, false} {
+		if !q.push(fmt.Sprint(i), droppable) {
+			t.Fatalf("message %v refused", i)
+		}
+	}
+	q.expect(t, "0", "1", "3", "5")
+	if s := q.stats.load(); s.Dropped != 2 {
+		t.Fatalf("stats %v", s)
+	}
+}
+
+func TestWriteBlock(t *testing.T) {
+	q := newTestQueue(1, Backpressure{Policy: WriteBlock, BlockTimeout: time.Second})
+	q.push("a", false)
+
+	// the write waits for the write goroutine
+	done := make(chan bool)
+	go func() { done <- q.push("b", false) }()
+	select {
+	case <-done:
+		t.Fatal("write not blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if msg := q.take(); msg != "a" {
+		t.Fatalf("message %q", msg)
+	}
+	if !<-done {
+		t.Fatal("connection destroyed")
+	}
+	q.expect(t, "b")
+
+	// the connection closed meanwhile drops the message
+	q.push("a", false)
+	go func() { done <- q.push("b", false) }()
+	time.Sleep(20 * time.Millisecond)
+	q.mu.Lock()
+	q.closeFlag = true
+	q.wake()
+	q.mu.Unlock()
+	if !<-done {
+		t.Fatal("connection destroyed")
+	}
+	q.expect(t, "a")
+	if s := q.stats.load(); s != (WriteStats{Blocked: 2, Dropped: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+
+	// the connection is destroyed after BlockTimeout
+	q = newTestQueue(1, Backpressure{Policy: WriteBlock, BlockTimeout: 50 * time.Millisecond})
+	q.push("a", false)
+	start := time.Now()
+	if q.push("b", false) {
+		t.Fatal("write kept after the timeout")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("write waited %v", d)
+	}
+	if s := q.stats.load(); s != (WriteStats{Blocked: 1, Disconnected: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+}
+
+func TestHighWatermark(t *testing.T) {
+	var calls []int
+	q := newTestQueue(10, Backpressure{HighWatermark: 4, OnHighWatermark: func(conn Conn, pending int) {
+		if conn != nil {
+			t.Fatal("conn not passed")
+		}
+		calls = append(calls, pending)
+	}})
+	push := func(n int) {
+		for range n {
+			q.push("x", false)
+			q.notify(nil)
+		}
+	}
+
+	push(6)
+	if fmt.Sprint(calls) != "[4]" {
+		t.Fatalf("calls %v", calls)
+	}
+
+	// not again before the queue drains below half of the watermark
+	q.take()
+	q.take()
+	q.take()
+	push(2)
+	if len(calls) != 1 {
+		t.Fatalf("calls %v", calls)
+	}
+	for len(q.ch) > 1 {
+		q.take()
+	}
+	push(3)
+	if fmt.Sprint(calls) != "[4 4]" {
+		t.Fatalf("calls %v", calls)
+	}
+	if s := q.stats.load(); s != (WriteStats{HighWatermarks: 2}) {
+		t.Fatalf("stats %v", s)
+	}
+}
+
+func TestTCPBackpressure(t *testing.T) {
+	var mu sync.Mutex
+	var watermarks []Conn
+	server := &TCPServer{PendingWriteNum: 4, Backpressure: Backpressure{
+		Policy:       WriteBlock,
+		BlockTimeout: time.Second,
+		OnHighWatermark: func(conn Conn, pending int) {
+			mu.Lock()
+			watermarks = append(watermarks, conn)
+			mu.Unlock()
+		},
+		HighWatermark: 2,
+	}}
+	agents, addr := startTCP(t, server)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := agents.next(t)
+
+	// the writes outrunning a slow client wait, nothing is lost
+	msg := bytes.Repeat([]byte("x"), 4000)
+	go func() {
+		for range 2000 {
+			if err := a.conn.WriteMsg(msg); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for i := range 2000 {
+		if got := readFrame(t, conn); !bytes.Equal(got, msg) {
+			t.Fatalf("message %v of %v bytes", i, len(got))
+		}
+	}
+	s := server.WriteStats()
+	if s.Blocked == 0 || s.Dropped != 0 || s.Disconnected != 0 {
+		t.Fatalf("stats %v", s)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(watermarks) == 0 || watermarks[0] != a.conn {
+		t.Fatalf("high watermarks %v", watermarks)
+	}
+}
+
+func TestWSBackpressure(t *testing.T) {
+	server := &WSServer{PendingWriteNum: 4, MaxMsgLen: 64 * 1024, Backpressure: Backpressure{Policy: WriteDropNewest}}
+	agents, url := startWS(t, server)
+	conn := dialWS(t, url)
+	a := agents.next(t)
+
+	// a client not reading loses messages but stays connected
+	msg := bytes.Repeat([]byte("x"), 32*1024)
+	for range 500 {
+		a.conn.WriteMsg(msg)
+	}
+	if s := server.WriteStats(); s.Dropped == 0 || s.Disconnected != 0 {
+		t.Fatalf("stats %v", s)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, got, err := conn.ReadMessage(); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("message of %v bytes, %v", len(got), err)
+	}
+	if a.isClosed() {
+		t.Fatal("connection closed")
+	}
+
+	// the default policy destroys it
+	server = &WSServer{PendingWriteNum: 4, MaxMsgLen: 64 * 1024}
+	agents, url = startWS(t, server)
+	dialWS(t, url)
+	a = agents.next(t)
+	for range 500 {
+		a.conn.WriteMsg(msg)
+	}
+	a.waitClosed(t)
+	if s := server.WriteStats(); s.Disconnected != 1 {
+		t.Fatalf("stats %v", s)
+	}
+}
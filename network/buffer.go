@@ -0,0 +1,59 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// the message buffers are pooled by power of two sizes, from 64B to 1MB. larger messages are allocated.
+const (
+	minBufferShift = 6
+	maxBufferShift = 20
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// bufferClass returns the pool of the buffers of n bytes, -1 if they are not pooled.
+func bufferClass(n int) int {
+	if n > 1<<maxBufferShift {
+		return -1
+	}
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// getBuffer returns a buffer of length n, from the pool if n is not too large.
+func getBuffer(n int) *[]byte {
+	class := bufferClass(n)
+	if class < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, _ := bufferPools[class].Get().(*[]byte); p != nil {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n, 1<<(class+minBufferShift))
+	return &b
+}
+
+// putBuffer returns a buffer to its pool, buffers not allocated by getBuffer are ignored.
+func putBuffer(p *[]byte) {
+	c := cap(*p)
+	class := bufferClass(c)
+	if class < 0 || c != 1<<(class+minBufferShift) {
+		return
+	}
+	bufferPools[class].Put(p)
+}
+
+// ReleaseMsg recycles a message returned by TCPConn.ReadMsg. releasing is optional: a message
+// not released is collected by the GC. b and the slices of b must not be used after the call,
+// the processors decoding it must not keep references to it, e.g. the protobuf raw messages do.
+func ReleaseMsg(b []byte) {
+	if b != nil {
+		putBuffer(&b)
+	}
+}
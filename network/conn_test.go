@@ -0,0 +1,122 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// testAgent records the messages of its connection.
+type testAgent struct {
+	conn   Conn
+	msgs   chan []byte
+	closed chan struct{}
+}
+
+func (a *testAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.msgs <- append([]byte(nil), data...)
+	}
+}
+
+func (a *testAgent) OnClose() {
+	close(a.closed)
+}
+
+// next returns the next message received.
+func (a *testAgent) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case data := <-a.msgs:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+		return nil
+	}
+}
+
+// waitClosed waits for the end of the agent.
+func (a *testAgent) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-a.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection kept")
+	}
+}
+
+func (a *testAgent) isClosed() bool {
+	select {
+	case <-a.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// testAgents gives the agents created by a server.
+type testAgents chan *testAgent
+
+func (agents testAgents) new(conn Conn) Agent {
+	a := &testAgent{conn: conn, msgs: make(chan []byte, 100), closed: make(chan struct{})}
+	// the connections of clients retrying are not all waited for
+	select {
+	case agents <- a:
+	default:
+	}
+	return a
+}
+
+func (agents testAgents) next(t *testing.T) *testAgent {
+	t.Helper()
+	select {
+	case a := <-agents:
+		return a
+	case <-time.After(time.Second):
+		t.Fatal("no connection")
+		return nil
+	}
+}
+
+// startTCP starts a tcp server on a free port with 2 byte big endian message lengths.
+func startTCP(t *testing.T, server *TCPServer) (testAgents, string) {
+	agents := make(testAgents, 10)
+	server.Addr = "127.0.0.1:0"
+	server.LenMsgLen = 2
+	server.NewAgent = func(c *TCPConn) Agent { return agents.new(c) }
+	server.Start()
+	t.Cleanup(server.Close)
+	return agents, server.ln.Addr().String()
+}
+
+// writeFrame writes a message with its 2 byte big endian length.
+func writeFrame(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads a message with its 2 byte big endian length.
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
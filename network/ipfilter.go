@@ -0,0 +1,317 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPFilterOptions configures the per-IP limits and the static allow and deny lists of an IPFilter.
+type IPFilterOptions struct {
+	MaxConnPerIP int      `conf:"min=0"` // concurrent connections per IP, 0 is unlimited
+	AcceptRate   float64  `conf:"min=0"` // connections accepted per second per IP, 0 is unlimited
+	AcceptBurst  int      `conf:"min=0"` // connections accepted at once per IP, AcceptRate (at least 1) if 0
+	Allow        []string // addresses or CIDRs, if not empty only they are accepted
+	Deny         []string // addresses or CIDRs refused, checked before Allow
+}
+
+// Validate checks the addresses of the lists.
+func (opts *IPFilterOptions) Validate() error {
+	if _, err := parseCIDRs(opts.Allow); err != nil {
+		return fmt.Errorf("IPFilter.Allow: %v", err)
+	}
+	if _, err := parseCIDRs(opts.Deny); err != nil {
+		return fmt.Errorf("IPFilter.Deny: %v", err)
+	}
+	return nil
+}
+
+// IPFilterStats counts the connections refused by a filter since it was created.
+type IPFilterStats struct {
+	Denied      uint64 // by the allow and deny lists
+	ConnLimited uint64 // by MaxConnPerIP
+	RateLimited uint64 // by AcceptRate
+}
+
+func (s IPFilterStats) String() string {
+	return fmt.Sprintf("denied=%v, connlimited=%v, ratelimited=%v", s.Denied, s.ConnLimited, s.RateLimited)
+}
+
+// ipFilterStats is the atomic form of IPFilterStats.
+type ipFilterStats struct {
+	denied      atomic.Uint64
+	connLimited atomic.Uint64
+	rateLimited atomic.Uint64
+}
+
+func (s *ipFilterStats) load() IPFilterStats {
+	return IPFilterStats{
+		Denied:      s.denied.Load(),
+		ConnLimited: s.connLimited.Load(),
+		RateLimited: s.rateLimited.Load(),
+	}
+}
+
+var (
+	errIPDenied      = errors.New("address denied")
+	errTooManyConns  = errors.New("too many connections from the address")
+	errAcceptTooFast = errors.New("connections from the address too fast")
+)
+
+// acceptBucket is the token bucket of the connections accepted from an IP.
+type acceptBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// IPFilter checks the client addresses of the servers sharing it, e.g. the websocket and tcp servers
+// of a gate: the per-IP limits count the connections of all of them. the lists can be edited at runtime,
+// e.g. by the ipfilter console command, the active connections are kept.
+// goroutine safe
+type IPFilter struct {
+	opts        IPFilterOptions
+	mutex       sync.Mutex
+	allow, deny []*net.IPNet
+	conns       map[string]int           // connections per IP
+	buckets     map[string]*acceptBucket // nil if AcceptRate is 0
+	swept       time.Time
+	servers     []string // addresses of the running servers using the filter
+	stats       ipFilterStats
+}
+
+// NewIPFilter creates a filter with the static lists of opts.
+func NewIPFilter(opts IPFilterOptions) (*IPFilter, error) {
+	allow, err := parseCIDRs(opts.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(opts.Deny)
+	if err != nil {
+		return nil, err
+	}
+	f := &IPFilter{opts: opts, allow: allow, deny: deny, conns: make(map[string]int)}
+	if opts.AcceptRate > 0 {
+		if f.opts.AcceptBurst <= 0 {
+			f.opts.AcceptBurst = max(1, int(opts.AcceptRate))
+		}
+		f.buckets = make(map[string]*acceptBucket)
+	}
+	return f, nil
+}
+
+// Allow adds an address or CIDR to the allow list, only the allowed addresses are accepted from now on.
+func (f *IPFilter) Allow(cidr string) error {
+	return f.add(&f.allow, cidr)
+}
+
+// Deny adds an address or CIDR to the deny list.
+func (f *IPFilter) Deny(cidr string) error {
+	return f.add(&f.deny, cidr)
+}
+
+func (f *IPFilter) add(list *[]*net.IPNet, cidr string) error {
+	nets, err := parseCIDRs([]string{cidr})
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if indexNet(*list, nets[0]) < 0 {
+		*list = append(*list, nets[0])
+	}
+	return nil
+}
+
+// Remove removes an address or CIDR from the allow and deny lists, it returns false if none has it.
+func (f *IPFilter) Remove(cidr string) (bool, error) {
+	nets, err := parseCIDRs([]string{cidr})
+	if err != nil {
+		return false, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	removed := false
+	for _, list := range []*[]*net.IPNet{&f.allow, &f.deny} {
+		if i := indexNet(*list, nets[0]); i >= 0 {
+			*list = slices.Delete(*list, i, i+1)
+			removed = true
+		}
+	}
+	return removed, nil
+}
+
+// indexNet returns the index of n in list, -1 if absent.
+func indexNet(list []*net.IPNet, n *net.IPNet) int {
+	return slices.IndexFunc(list, func(m *net.IPNet) bool {
+		return m.String() == n.String()
+	})
+}
+
+// Lists returns the CIDRs of the allow and deny lists.
+func (f *IPFilter) Lists() (allow, deny []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, n := range f.allow {
+		allow = append(allow, n.String())
+	}
+	for _, n := range f.deny {
+		deny = append(deny, n.String())
+	}
+	return allow, deny
+}
+
+// Stats returns the connections refused by the filter.
+func (f *IPFilter) Stats() IPFilterStats {
+	return f.stats.load()
+}
+
+// String describes the limits, the lists and the counters of the filter.
+func (f *IPFilter) String() string {
+	allow, deny := f.Lists()
+	f.mutex.Lock()
+	servers := strings.Join(f.servers, ", ")
+	f.mutex.Unlock()
+	return fmt.Sprintf("servers: %v\r\nmaxconnperip=%v, acceptrate=%v, acceptburst=%v\r\nallow: %v\r\ndeny: %v\r\n%v",
+		servers, f.opts.MaxConnPerIP, f.opts.AcceptRate, f.opts.AcceptBurst,
+		strings.Join(allow, ", "), strings.Join(deny, ", "), f.Stats())
+}
+
+// acquire checks a new connection from addr, which must be released once closed if accepted.
+// a nil filter accepts every connection, addresses without IP are denied
+func (f *IPFilter) acquire(addr net.Addr) error {
+	if f == nil {
+		return nil
+	}
+	ip := addrIP(addr)
+	key := ip.String()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if ip == nil || containsIP(f.deny, ip) || (len(f.allow) > 0 && !containsIP(f.allow, ip)) {
+		f.stats.denied.Add(1)
+		return errIPDenied
+	}
+	if f.opts.MaxConnPerIP > 0 && f.conns[key] >= f.opts.MaxConnPerIP {
+		f.stats.connLimited.Add(1)
+		return errTooManyConns
+	}
+	if f.buckets != nil && !f.take(key) {
+		f.stats.rateLimited.Add(1)
+		return errAcceptTooFast
+	}
+	f.conns[key]++
+	return nil
+}
+
+// release counts a connection accepted by acquire closed.
+func (f *IPFilter) release(addr net.Addr) {
+	if f == nil {
+		return
+	}
+	key := addrIP(addr).String()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.conns[key] <= 1 {
+		delete(f.conns, key)
+	} else {
+		f.conns[key]--
+	}
+}
+
+// take takes a token of the bucket of an IP.
+// must be called with the lock held
+func (f *IPFilter) take(key string) bool {
+	now := time.Now()
+	burst := float64(f.opts.AcceptBurst)
+
+	// forget the full buckets from time to time, they are the same as new ones
+	if now.Sub(f.swept) > time.Minute {
+		for k, b := range f.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*f.opts.AcceptRate >= burst {
+				delete(f.buckets, k)
+			}
+		}
+		f.swept = now
+	}
+
+	b := f.buckets[key]
+	if b == nil {
+		b = &acceptBucket{tokens: burst, last: now}
+		f.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*f.opts.AcceptRate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ipFilters are the filters of the running servers, see IPFilters.
+var ipFilters struct {
+	sync.Mutex
+	list []*IPFilter
+}
+
+// IPFilters returns the filters of the running servers.
+// goroutine safe
+func IPFilters() []*IPFilter {
+	ipFilters.Lock()
+	defer ipFilters.Unlock()
+	return slices.Clone(ipFilters.list)
+}
+
+// attach records a server using the filter.
+func (f *IPFilter) attach(server string) {
+	if f == nil {
+		return
+	}
+	ipFilters.Lock()
+	defer ipFilters.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.servers) == 0 {
+		ipFilters.list = append(ipFilters.list, f)
+	}
+	f.servers = append(f.servers, server)
+}
+
+// detach forgets a server recorded by attach.
+func (f *IPFilter) detach(server string) {
+	if f == nil {
+		return
+	}
+	ipFilters.Lock()
+	defer ipFilters.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if i := slices.Index(f.servers, server); i >= 0 {
+		f.servers = slices.Delete(f.servers, i, i+1)
+	}
+	if len(f.servers) == 0 {
+		if i := slices.Index(ipFilters.list, f); i >= 0 {
+			ipFilters.list = slices.Delete(ipFilters.list, i, i+1)
+		}
+	}
+}
+
+// addrIP returns the IP of a TCP, UDP or IP address, nil for other addresses.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
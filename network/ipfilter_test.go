@@ -0,0 +1,193 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}
+}
+
+func TestIPFilterLists(t *testing.T) {
+	f, err := NewIPFilter(IPFilterOptions{Deny: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.acquire(tcpAddr("192.0.2.1")) != errIPDenied || f.acquire(tcpAddr("198.51.100.1")) != nil {
+		t.Fatal("deny list not applied")
+	}
+
+	// once an address is allowed, only the allowed ones are accepted, deny comes first
+	f.Allow("198.51.100.0/24")
+	f.Deny("198.51.100.7")
+	for ip, want := range map[string]error{
+		"198.51.100.1": nil,
+		"198.51.100.7": errIPDenied,
+		"203.0.113.1":  errIPDenied,
+		"192.0.2.1":    errIPDenied,
+	} {
+		if err := f.acquire(tcpAddr(ip)); err != want {
+			t.Fatalf("%v: %v, want %v", ip, err, want)
+		}
+	}
+	allow, deny := f.Lists()
+	if fmt.Sprint(allow, deny) != "[198.51.100.0/24] [192.0.2.0/24 198.51.100.7/32]" {
+		t.Fatalf("lists %v %v", allow, deny)
+	}
+
+	// the entries are removed from both lists
+	f.Allow("192.0.2.0/24")
+	if removed, err := f.Remove("192.0.2.0/24"); !removed || err != nil {
+		t.Fatalf("removed %v, %v", removed, err)
+	}
+	if removed, _ := f.Remove("192.0.2.0/24"); removed {
+		t.Fatal("removed twice")
+	}
+	if _, err := f.Remove("192.0.2.0/33"); err == nil {
+		t.Fatal("invalid address removed")
+	}
+	if err := f.Allow("example.com"); err == nil {
+		t.Fatal("invalid address allowed")
+	}
+	if allow, deny := f.Lists(); len(allow) != 1 || len(deny) != 1 {
+		t.Fatalf("lists %v %v", allow, deny)
+	}
+
+	if _, err := NewIPFilter(IPFilterOptions{Allow: []string{"10.0.0.0/40"}}); err == nil {
+		t.Fatal("invalid allow list accepted")
+	}
+	if err := (&IPFilterOptions{Deny: []string{"x"}}).Validate(); err == nil {
+		t.Fatal("invalid deny list accepted")
+	}
+}
+
+func TestIPFilterLimits(t *testing.T) {
+	f, err := NewIPFilter(IPFilterOptions{MaxConnPerIP: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := tcpAddr("192.0.2.1"), &net.UDPAddr{IP: net.ParseIP("192.0.2.2")}
+	if f.acquire(a) != nil || f.acquire(a) != nil || f.acquire(b) != nil {
+		t.Fatal("connection refused below the limit")
+	}
+	if f.acquire(a) != errTooManyConns {
+		t.Fatal("limit not applied")
+	}
+	f.release(a)
+	if f.acquire(a) != nil {
+		t.Fatal("closed connection not released")
+	}
+
+	// addresses without IP are denied, all of them would count as one
+	if f.acquire(nil) != errIPDenied || f.acquire(&net.UnixAddr{Name: "x"}) != errIPDenied {
+		t.Fatal("address without IP accepted")
+	}
+	if s := f.Stats(); s != (IPFilterStats{Denied: 2, ConnLimited: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+
+	// a nil filter accepts every connection
+	var none *IPFilter
+	if none.acquire(nil) != nil {
+		t.Fatal("nil filter refused a connection")
+	}
+	none.release(nil)
+}
+
+func TestIPFilterRate(t *testing.T) {
+	f, err := NewIPFilter(IPFilterOptions{AcceptRate: 20, AcceptBurst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tcpAddr("192.0.2.1")
+	for range 3 {
+		if err := f.acquire(a); err != nil {
+			t.Fatal(err)
+		}
+		f.release(a)
+	}
+	if f.acquire(a) != errAcceptTooFast {
+		t.Fatal("burst exceeded")
+	}
+	// other addresses have their own bucket
+	if f.acquire(tcpAddr("192.0.2.2")) != nil {
+		t.Fatal("bucket shared")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := f.acquire(a); err != nil {
+		t.Fatalf("bucket not refilled: %v", err)
+	}
+	if s := f.Stats(); s.RateLimited != 1 {
+		t.Fatalf("stats %v", s)
+	}
+
+	// the burst is the rate by default
+	f, _ = NewIPFilter(IPFilterOptions{AcceptRate: 0.5})
+	if f.acquire(a) != nil || f.acquire(a) != errAcceptTooFast {
+		t.Fatal("default burst not 1")
+	}
+}
+
+func TestIPFilters(t *testing.T) {
+	f, _ := NewIPFilter(IPFilterOptions{MaxConnPerIP: 1})
+	f.attach("ws")
+	f.attach("tcp")
+	if !slices.Contains(IPFilters(), f) {
+		t.Fatal("filter not listed")
+	}
+	if s := f.String(); !strings.Contains(s, "servers: ws, tcp") || !strings.Contains(s, "maxconnperip=1") {
+		t.Fatalf("description %q", s)
+	}
+	f.detach("ws")
+	if !slices.Contains(IPFilters(), f) {
+		t.Fatal("filter of a running server not listed")
+	}
+	f.detach("tcp")
+	if slices.Contains(IPFilters(), f) {
+		t.Fatal("filter of stopped servers listed")
+	}
+}
+
+func TestTCPIPFilter(t *testing.T) {
+	filter, err := NewIPFilter(IPFilterOptions{MaxConnPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, addr := startTCP(t, &TCPServer{IPFilter: filter})
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	conn := dial()
+	a := agents.next(t)
+	dial()
+	expectNoAgent(t, agents)
+	if s := filter.Stats(); s.ConnLimited != 1 {
+		t.Fatalf("stats %v", s)
+	}
+
+	// a closed connection is released
+	conn.Close()
+	a.waitClosed(t)
+	time.Sleep(20 * time.Millisecond)
+	dial()
+	agents.next(t)
+
+	// the runtime lists apply to the new connections
+	filter.Deny("127.0.0.0/8")
+	dial()
+	expectNoAgent(t, agents)
+	if s := filter.Stats(); s.Denied != 1 {
+		t.Fatalf("stats %v", s)
+	}
+}
@@ -0,0 +1,576 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// kcp is the ARQ of a KCP connection, a port of the message mode of ikcp
+// (https://github.com/skywind3000/kcp) with the same segment format:
+//
+//	conv 4 | cmd 1 | frg 1 | wnd 2 | ts 4 | sn 4 | una 4 | len 4 | data, little endian
+//
+// it is not goroutine safe, KCPConn serializes the calls.
+type kcp struct {
+	conv, mtu, mss           uint32
+	sndUna, sndNxt, rcvNxt   uint32
+	ssthresh                 uint32
+	rxRttval, rxSrtt         int32
+	rxRto, rxMinrto          uint32
+	sndWnd, rcvWnd, rmtWnd   uint32
+	cwnd, incr, probe        uint32
+	current, interval        uint32
+	tsFlush, tsProbe, wait   uint32
+	fastresend               uint32
+	nodelay, nocwnd, updated bool
+	dead                     bool // a segment reached kcpDeadLink transmissions
+
+	sndQueue, rcvQueue []*segment
+	sndBuf, rcvBuf     []*segment
+	acklist            []ackItem
+	buffer             []byte
+	output             func(b []byte)
+}
+
+type segment struct {
+	conv, ts, sn, una uint32
+	cmd, frg          uint8
+	wnd               uint16
+	resendts, rto     uint32
+	fastack, xmit     uint32
+	data              []byte
+}
+
+type ackItem struct {
+	sn, ts uint32
+}
+
+const (
+	kcpCmdPush = 81 // data
+	kcpCmdAck  = 82
+	kcpCmdWask = 83 // window probe
+	kcpCmdWins = 84 // window size
+	kcpCmdFin  = 85 // not part of KCP: the connection is closed, handled by KCPConn
+	// not part of KCP: the handshake opening a connection, see KCPServer
+	kcpCmdSyn    = 86
+	kcpCmdCookie = 87
+	kcpCmdAccept = 88
+
+	kcpAskSend = 1
+	kcpAskTell = 2
+
+	kcpOverhead      = 24
+	kcpRTONoDelayMin = 30
+	kcpRTOMin        = 100
+	kcpRTODefault    = 200
+	kcpRTOMax        = 60000
+	kcpWndSnd        = 32
+	kcpWndRcv        = 128
+	kcpMTUDefault    = 1400
+	kcpThreshInit    = 2
+	kcpThreshMin     = 2
+	kcpProbeInit     = 7000
+	kcpProbeLimit    = 120000
+	kcpDeadLink      = 20
+	kcpMaxFragments  = 255
+	kcpCookieLen     = 16
+)
+
+var errKCPMsgTooLong = errors.New("kcp message too long")
+
+var kcpEpoch = time.Now()
+
+// kcpNow returns the KCP clock in milliseconds.
+func kcpNow() uint32 {
+	return uint32(time.Since(kcpEpoch) / time.Millisecond)
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+func newKCP(conv uint32, output func(b []byte)) *kcp {
+	k := &kcp{
+		conv:     conv,
+		sndWnd:   kcpWndSnd,
+		rcvWnd:   kcpWndRcv,
+		rmtWnd:   kcpWndRcv,
+		cwnd:     1,
+		rxRto:    kcpRTODefault,
+		rxMinrto: kcpRTOMin,
+		interval: 100,
+		ssthresh: kcpThreshInit,
+		output:   output,
+	}
+	k.setMTU(kcpMTUDefault)
+	k.incr = k.mss
+	return k
+}
+
+func (k *kcp) setMTU(mtu int) {
+	k.mtu = uint32(mtu)
+	k.mss = k.mtu - kcpOverhead
+	k.buffer = make([]byte, 0, k.mtu)
+}
+
+func (k *kcp) setWndSize(snd, rcv int) {
+	if snd > 0 {
+		k.sndWnd = uint32(snd)
+	}
+	if rcv > 0 {
+		k.rcvWnd = uint32(max(rcv, kcpWndRcv))
+	}
+}
+
+func (k *kcp) setNoDelay(nodelay bool, interval time.Duration, resend int, nocwnd bool) {
+	k.nodelay = nodelay
+	if nodelay {
+		k.rxMinrto = kcpRTONoDelayMin
+	} else {
+		k.rxMinrto = kcpRTOMin
+	}
+	if interval > 0 {
+		k.interval = uint32(min(max(interval/time.Millisecond, 10), 5000))
+	}
+	k.fastresend = uint32(max(resend, 0))
+	k.nocwnd = nocwnd
+}
+
+// maxMsgLen is the size of the largest message send accepts.
+func (k *kcp) maxMsgLen() uint32 {
+	return (kcpMaxFragments - 1) * k.mss
+}
+
+// waitSnd returns the number of segments not acknowledged yet.
+func (k *kcp) waitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// send splits a message into segments and queues them.
+func (k *kcp) send(data []byte) error {
+	count := (uint32(len(data)) + k.mss - 1) / k.mss
+	if count == 0 {
+		count = 1
+	}
+	if count >= kcpMaxFragments {
+		return errKCPMsgTooLong
+	}
+	for i := range count {
+		size := min(uint32(len(data)), k.mss)
+		seg := &segment{data: append([]byte(nil), data[:size]...), frg: uint8(count - i - 1)}
+		k.sndQueue = append(k.sndQueue, seg)
+		data = data[size:]
+	}
+	return nil
+}
+
+// recv returns the next complete message, nil if there is none.
+func (k *kcp) recv() []byte {
+	size := k.peekSize()
+	if size < 0 {
+		return nil
+	}
+	recover := len(k.rcvQueue) >= int(k.rcvWnd)
+
+	msg := make([]byte, 0, size)
+	n := 0
+	for _, seg := range k.rcvQueue {
+		msg = append(msg, seg.data...)
+		n++
+		if seg.frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = k.rcvQueue[n:]
+	k.moveRcvBuf()
+
+	// tell the peer the window is open again
+	if len(k.rcvQueue) < int(k.rcvWnd) && recover {
+		k.probe |= kcpAskTell
+	}
+	return msg
+}
+
+func (k *kcp) peekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	seg := k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	size := 0
+	for _, seg := range k.rcvQueue {
+		size += len(seg.data)
+		if seg.frg == 0 {
+			break
+		}
+	}
+	return size
+}
+
+// moveRcvBuf moves the in order segments to the receive queue.
+func (k *kcp) moveRcvBuf() {
+	n := 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn != k.rcvNxt || len(k.rcvQueue) >= int(k.rcvWnd) {
+			break
+		}
+		k.rcvQueue = append(k.rcvQueue, seg)
+		k.rcvNxt++
+		n++
+	}
+	k.rcvBuf = k.rcvBuf[n:]
+}
+
+func (k *kcp) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttval = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttval = (3*k.rxRttval + delta) / 4
+		k.rxSrtt = max((7*k.rxSrtt+rtt)/8, 1)
+	}
+	rto := uint32(k.rxSrtt) + max(k.interval, 4*uint32(k.rxRttval))
+	k.rxRto = min(max(rto, k.rxMinrto), kcpRTOMax)
+}
+
+func (k *kcp) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcp) parseAck(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if seg.sn == sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			return
+		}
+		if timediff(sn, seg.sn) < 0 {
+			return
+		}
+	}
+}
+
+func (k *kcp) parseUna(una uint32) {
+	n := 0
+	for _, seg := range k.sndBuf {
+		if timediff(una, seg.sn) <= 0 {
+			break
+		}
+		n++
+	}
+	k.sndBuf = k.sndBuf[n:]
+}
+
+func (k *kcp) parseFastack(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range k.sndBuf {
+		if timediff(sn, seg.sn) < 0 {
+			break
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+func (k *kcp) parseData(newseg *segment) {
+	sn := newseg.sn
+	if timediff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timediff(sn, k.rcvNxt) < 0 {
+		return
+	}
+
+	// insert in order, from the end
+	i := len(k.rcvBuf)
+	for ; i > 0; i-- {
+		seg := k.rcvBuf[i-1]
+		if seg.sn == sn {
+			return
+		}
+		if timediff(sn, seg.sn) > 0 {
+			break
+		}
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[i+1:], k.rcvBuf[i:])
+	k.rcvBuf[i] = newseg
+	k.moveRcvBuf()
+}
+
+// input processes a datagram received from the peer.
+func (k *kcp) input(data []byte) error {
+	if len(data) < kcpOverhead {
+		return errors.New("kcp packet too short")
+	}
+
+	prevUna := k.sndUna
+	var maxack uint32
+	acked := false
+	for len(data) >= kcpOverhead {
+		conv := binary.LittleEndian.Uint32(data)
+		cmd := data[4]
+		frg := data[5]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[kcpOverhead:]
+
+		if conv != k.conv {
+			return errors.New("kcp conv mismatch")
+		}
+		if uint32(len(data)) < length {
+			return errors.New("kcp packet truncated")
+		}
+		if cmd < kcpCmdPush || cmd > kcpCmdWins {
+			return errors.New("kcp unknown command")
+		}
+
+		k.rmtWnd = uint32(wnd)
+		k.parseUna(una)
+		k.shrinkBuf()
+
+		switch cmd {
+		case kcpCmdAck:
+			if rtt := timediff(k.current, ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(sn)
+			k.shrinkBuf()
+			if !acked || timediff(sn, maxack) > 0 {
+				maxack = sn
+			}
+			acked = true
+		case kcpCmdPush:
+			if timediff(sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, ackItem{sn: sn, ts: ts})
+				if timediff(sn, k.rcvNxt) >= 0 {
+					k.parseData(&segment{
+						conv: conv, cmd: cmd, frg: frg, wnd: wnd, ts: ts, sn: sn, una: una,
+						data: append([]byte(nil), data[:length]...),
+					})
+				}
+			}
+		case kcpCmdWask:
+			k.probe |= kcpAskTell
+		}
+		data = data[length:]
+	}
+
+	if acked {
+		k.parseFastack(maxack)
+	}
+
+	// congestion window
+	if timediff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			k.incr = max(k.incr, mss)
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+func (k *kcp) wndUnused() uint16 {
+	if len(k.rcvQueue) < int(k.rcvWnd) {
+		return uint16(int(k.rcvWnd) - len(k.rcvQueue))
+	}
+	return 0
+}
+
+func (seg *segment) encode(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, seg.conv)
+	b = append(b, seg.cmd, seg.frg)
+	b = binary.LittleEndian.AppendUint16(b, seg.wnd)
+	b = binary.LittleEndian.AppendUint32(b, seg.ts)
+	b = binary.LittleEndian.AppendUint32(b, seg.sn)
+	b = binary.LittleEndian.AppendUint32(b, seg.una)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(seg.data)))
+	return b
+}
+
+// update advances the clock and flushes every interval.
+func (k *kcp) update(current uint32) {
+	k.current = current
+	if !k.updated {
+		k.updated = true
+		k.tsFlush = current
+	}
+	slap := timediff(current, k.tsFlush)
+	if slap >= 10000 || slap < -10000 {
+		k.tsFlush = current
+		slap = 0
+	}
+	if slap >= 0 {
+		k.tsFlush += k.interval
+		if timediff(current, k.tsFlush) >= 0 {
+			k.tsFlush = current + k.interval
+		}
+		k.flush()
+	}
+}
+
+// flush sends the pending acks, probes and segments.
+func (k *kcp) flush() {
+	if !k.updated {
+		return
+	}
+	current := k.current
+	buf := k.buffer[:0]
+	emit := func(need int) {
+		if len(buf)+need > int(k.mtu) && len(buf) > 0 {
+			k.output(buf)
+			buf = buf[:0]
+		}
+	}
+
+	seg := segment{conv: k.conv, cmd: kcpCmdAck, wnd: k.wndUnused(), una: k.rcvNxt}
+
+	// acks
+	for _, ack := range k.acklist {
+		emit(kcpOverhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		buf = seg.encode(buf)
+	}
+	k.acklist = k.acklist[:0]
+
+	// probe the window of the peer if it is full
+	if k.rmtWnd == 0 {
+		if k.wait == 0 {
+			k.wait = kcpProbeInit
+			k.tsProbe = current + k.wait
+		} else if timediff(current, k.tsProbe) >= 0 {
+			k.wait = max(k.wait, kcpProbeInit)
+			k.wait = min(k.wait+k.wait/2, kcpProbeLimit)
+			k.tsProbe = current + k.wait
+			k.probe |= kcpAskSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.wait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if k.probe&kcpAskSend != 0 {
+		seg.cmd = kcpCmdWask
+		emit(kcpOverhead)
+		buf = seg.encode(buf)
+	}
+	if k.probe&kcpAskTell != 0 {
+		seg.cmd = kcpCmdWins
+		emit(kcpOverhead)
+		buf = seg.encode(buf)
+	}
+	k.probe = 0
+
+	// move the queued segments into the send window
+	wnd := min(k.sndWnd, k.rmtWnd)
+	if !k.nocwnd {
+		wnd = min(k.cwnd, wnd)
+	}
+	for timediff(k.sndNxt, k.sndUna+wnd) < 0 && len(k.sndQueue) > 0 {
+		newseg := k.sndQueue[0]
+		k.sndQueue = k.sndQueue[1:]
+		newseg.conv = k.conv
+		newseg.cmd = kcpCmdPush
+		newseg.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, newseg)
+	}
+
+	resent := k.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtomin uint32
+	if !k.nodelay {
+		rtomin = k.rxRto >> 3
+	}
+
+	// (re)transmit
+	change, lost := false, false
+	for _, segment := range k.sndBuf {
+		needsend := false
+		switch {
+		case segment.xmit == 0:
+			needsend = true
+			segment.rto = k.rxRto
+			segment.resendts = current + segment.rto + rtomin
+		case timediff(current, segment.resendts) >= 0:
+			needsend = true
+			if k.nodelay {
+				segment.rto += segment.rto / 2
+			} else {
+				segment.rto += max(segment.rto, k.rxRto)
+			}
+			segment.resendts = current + segment.rto
+			lost = true
+		case segment.fastack >= resent:
+			needsend = true
+			segment.fastack = 0
+			segment.resendts = current + segment.rto
+			change = true
+		}
+		if !needsend {
+			continue
+		}
+		segment.xmit++
+		segment.ts = current
+		segment.wnd = seg.wnd
+		segment.una = k.rcvNxt
+		emit(kcpOverhead + len(segment.data))
+		buf = segment.encode(buf)
+		buf = append(buf, segment.data...)
+		if segment.xmit >= kcpDeadLink {
+			k.dead = true
+		}
+	}
+	if len(buf) > 0 {
+		k.output(buf)
+	}
+
+	// congestion control
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = max(inflight/2, kcpThreshMin)
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = max(k.cwnd/2, kcpThreshMin)
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// KCPClient keeps reliable UDP connections to a KCPServer, see KCPServer for the handshake.
+// a dead server is detected by the idle timeout or the retransmission limit.
+type KCPClient struct {
+	sync.Mutex
+	Addr            string
+	ConnNum         int
+	ConnectInterval time.Duration
+	PendingWriteNum int              // segments waiting for an acknowledgement per connection
+	MaxMsgLen       uint32           // limited by 254 segments
+	Transform       TransformOptions // asks the server for per-message compression and encryption
+	AutoReconnect   bool
+	KCPOptions
+	NewAgent  func(*KCPConn) Agent
+	conns     map[*KCPConn]struct{}
+	wg        sync.WaitGroup
+	closeFlag bool
+}
+
+// Start initializes the client and starts the connection goroutines.
+func (client *KCPClient) Start() {
+	client.init()
+
+	for range client.ConnNum {
+		client.wg.Add(1)
+		go client.connect()
+	}
+}
+
+func (client *KCPClient) init() {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.ConnNum <= 0 {
+		client.ConnNum = 1
+		logs.Info("invalid connnum. resetting to default value: %v", client.ConnNum)
+	}
+	if client.ConnectInterval <= 0 {
+		client.ConnectInterval = 3 * time.Second
+		logs.Info("invalid connectinterval. resetting to default value: %v", client.ConnectInterval)
+	}
+	if client.PendingWriteNum <= 0 {
+		client.PendingWriteNum = 1024
+		logs.Info("invalid pendingwritenum. resetting to default value: %v", client.PendingWriteNum)
+	}
+	if client.MaxMsgLen <= 0 {
+		client.MaxMsgLen = 4096
+		logs.Info("invalid maxmsglen. resetting to default value: %v", client.MaxMsgLen)
+	}
+	if client.NewAgent == nil {
+		logs.Fatal("newagent callback must not be nil. please provide a valid function.")
+	}
+	if client.conns != nil {
+		logs.Fatal("kcpclient is already running. duplicate start() calls are not allowed.")
+	}
+
+	client.conns = make(map[*KCPConn]struct{})
+	client.closeFlag = false
+}
+
+// kcpHandshakeInterval is the interval of the syns sent until the server answers.
+const kcpHandshakeInterval = 250 * time.Millisecond
+
+// dial opens a UDP socket to the server and runs the handshake, it returns the socket and
+// the conv of the connection, nil once the client is closed.
+func (client *KCPClient) dial() (*net.UDPConn, uint32) {
+	for {
+		conv := rand.Uint32()
+		addr, err := net.ResolveUDPAddr("udp", client.Addr)
+		var conn *net.UDPConn
+		if err == nil {
+			conn, err = net.DialUDP("udp", nil, addr)
+		}
+		if err == nil {
+			if err = client.handshake(conn, conv); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+		if client.closed() {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, 0
+		}
+		if err == nil {
+			return conn, conv
+		}
+
+		logs.Info("failed to connect to %v. error: %v. retrying in %v...", client.Addr, err, client.ConnectInterval)
+		time.Sleep(client.ConnectInterval)
+	}
+}
+
+// handshake opens the connection conv, see KCPServer. it gives up after IdleTimeout.
+func (client *KCPClient) handshake(conn *net.UDPConn, conv uint32) error {
+	timeout := client.IdleTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	syn := kcpControl(conv, kcpCmdSyn, make([]byte, kcpCookieLen))
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) && !client.closed() {
+		conn.Write(syn)
+		conn.SetReadDeadline(time.Now().Add(kcpHandshakeInterval))
+		n, err := conn.Read(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); !ok || !opErr.Timeout() {
+				// e.g. the server port is closed
+				time.Sleep(kcpHandshakeInterval)
+			}
+			continue
+		}
+		data := buf[:n]
+		if c, ok := kcpConv(data); !ok || c != conv {
+			continue
+		}
+		switch {
+		case data[4] == kcpCmdCookie && n == kcpOverhead+kcpCookieLen:
+			syn = kcpControl(conv, kcpCmdSyn, append([]byte(nil), data[kcpOverhead:]...))
+		case data[4] == kcpCmdAccept:
+			conn.SetReadDeadline(time.Time{})
+			return nil
+		}
+	}
+	return errors.New("kcp handshake timeout")
+}
+
+func (client *KCPClient) closed() bool {
+	client.Lock()
+	defer client.Unlock()
+	return client.closeFlag
+}
+
+// connect handles the connection lifecycle, including reconnection logic.
+func (client *KCPClient) connect() {
+	defer client.wg.Done()
+
+	for {
+		udpConn, conv := client.dial()
+		if udpConn == nil {
+			return
+		}
+		if !client.handleConnection(udpConn, conv) {
+			return
+		}
+		if !client.AutoReconnect {
+			return
+		}
+		time.Sleep(client.ConnectInterval)
+	}
+}
+
+// handleConnection runs the agent of a connection, it returns false if the client is closed.
+func (client *KCPClient) handleConnection(udpConn *net.UDPConn, conv uint32) bool {
+	c := newKCPConn(conv, udpConn.LocalAddr(), udpConn.RemoteAddr(), func(b []byte) error {
+		_, err := udpConn.Write(b)
+		return err
+	}, &client.KCPOptions, client.MaxMsgLen, client.PendingWriteNum)
+	c.onDestroy = func() {
+		udpConn.Close()
+	}
+
+	client.Lock()
+	if client.closeFlag {
+		client.Unlock()
+		udpConn.Close()
+		return false
+	}
+	client.conns[c] = struct{}{}
+	client.Unlock()
+
+	go c.run()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					continue
+				}
+				// e.g. the server port is closed, the idle timeout ends the connection
+				select {
+				case <-c.closeSig:
+					return
+				default:
+					time.Sleep(time.Duration(c.kcp.interval) * time.Millisecond)
+					continue
+				}
+			}
+			c.input(buf[:n])
+		}
+	}()
+
+	if err := c.handshake(&client.Transform, false); err != nil {
+		logs.Error("handshake with %v failed: %v", client.Addr, err)
+		c.Destroy()
+		client.Lock()
+		delete(client.conns, c)
+		client.Unlock()
+		return true
+	}
+	agent := client.NewAgent(c)
+	agent.Run()
+
+	// cleanup
+	c.Close()
+	<-c.closeSig
+	client.Lock()
+	delete(client.conns, c)
+	client.Unlock()
+	agent.OnClose()
+
+	return true
+}
+
+// Close closes the connections, telling the server.
+func (client *KCPClient) Close() {
+	client.Lock()
+	client.closeFlag = true
+	for c := range client.conns {
+		c.Destroy()
+	}
+	client.conns = nil
+	client.Unlock()
+
+	client.wg.Wait()
+}
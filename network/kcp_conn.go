@@ -0,0 +1,322 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// KCPOptions tunes the reliable UDP transport, the zero value is the KCP default mode.
+// the fast mode of KCP is NoDelay, Interval 10ms, Resend 2 and NoCwnd.
+type KCPOptions struct {
+	SndWnd   int           `conf:"min=0"` // send window in segments, 32 if 0
+	RcvWnd   int           `conf:"min=0"` // receive window in segments, at least 128
+	NoDelay  bool          // lower minimum RTO and slower RTO backoff
+	Interval time.Duration `conf:"min=0"` // internal update interval, 10ms to 5s, 100ms if 0
+	Resend   int           `conf:"min=0"` // fast retransmit after this many skipping acks, 0 disables it
+	NoCwnd   bool          // disables the congestion window
+	MTU      int           `conf:"min=0"` // maximum datagram size, 1400 if 0
+	// IdleTimeout closes a connection receiving nothing for this long, 30s if 0.
+	// an idle connection sends a keepalive every third of it
+	IdleTimeout time.Duration `conf:"min=0"`
+}
+
+// kcpCloseTimeout bounds the time Close waits for the unacknowledged data.
+const kcpCloseTimeout = 5 * time.Second
+
+var errKCPClosed = errors.New("kcp connection closed")
+
+// KCPConn is a reliable UDP connection, it implements Conn. message boundaries are kept
+// by the transport, there is no length prefix.
+type KCPConn struct {
+	sync.Mutex
+	kcp             *kcp
+	local, remote   net.Addr
+	write           func(b []byte) error // sends a datagram to the peer
+	maxMsgLen       uint32
+	pendingWriteNum int
+	writeStats      *writeStats // counts the connections destroyed by pendingWriteNum, may be nil
+	idleTimeout     time.Duration
+	readTimeout     time.Duration // closes a connection receiving no message for this long, 0 waits forever
+	heartbeat       bool          // empty messages are heartbeats, answered and not returned by ReadMsg
+	transform       *pipeline     // compression and encryption, nil if none is negotiated
+	readSig         chan struct{} // signaled when messages are received
+	closeSig        chan struct{} // closed when the connection is destroyed
+	closeFlag       bool
+	closing         time.Time // time Close was called, zero if not closing
+	lastRecv        time.Time
+	lastMsg         time.Time
+	lastSend        time.Time
+	onDestroy       func()
+}
+
+func newKCPConn(conv uint32, local, remote net.Addr, write func(b []byte) error, opts *KCPOptions, maxMsgLen uint32, pendingWriteNum int) *KCPConn {
+	c := &KCPConn{
+		local:           local,
+		remote:          remote,
+		write:           write,
+		pendingWriteNum: pendingWriteNum,
+		idleTimeout:     opts.IdleTimeout,
+		readSig:         make(chan struct{}, 1),
+		closeSig:        make(chan struct{}),
+		lastRecv:        time.Now(),
+		lastMsg:         time.Now(),
+		lastSend:        time.Now(),
+	}
+	if c.idleTimeout <= 0 {
+		c.idleTimeout = 30 * time.Second
+	}
+
+	c.kcp = newKCP(conv, c.output)
+	if opts.MTU > 0 {
+		c.kcp.setMTU(opts.MTU)
+	}
+	c.kcp.setWndSize(opts.SndWnd, opts.RcvWnd)
+	c.kcp.setNoDelay(opts.NoDelay, opts.Interval, opts.Resend, opts.NoCwnd)
+	c.maxMsgLen = min(maxMsgLen, c.kcp.maxMsgLen())
+	c.kcp.update(kcpNow())
+	return c
+}
+
+// run updates the ARQ every interval until the connection is destroyed, then calls onDestroy.
+func (c *KCPConn) run() {
+	t := time.NewTicker(time.Duration(c.kcp.interval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.closeSig:
+			if c.onDestroy != nil {
+				c.onDestroy()
+			}
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		c.Lock()
+		if now.Sub(c.lastSend) >= c.idleTimeout/3 {
+			c.kcp.probe |= kcpAskTell
+		}
+		c.kcp.update(kcpNow())
+		switch {
+		case c.kcp.dead:
+			logs.Debug("kcp connection %v: peer not acknowledging, closing", c.remote)
+			c.doDestroy(true)
+		case now.Sub(c.lastRecv) >= c.idleTimeout:
+			logs.Debug("kcp connection %v: idle for %v, closing", c.remote, c.idleTimeout)
+			c.doDestroy(true)
+		case c.readTimeout > 0 && now.Sub(c.lastMsg) >= c.readTimeout:
+			logs.Debug("kcp connection %v: no message for %v, closing", c.remote, c.readTimeout)
+			c.doDestroy(true)
+		case !c.closing.IsZero() && (c.kcp.waitSnd() == 0 || now.Sub(c.closing) >= kcpCloseTimeout):
+			c.doDestroy(true)
+		}
+		c.Unlock()
+	}
+}
+
+// output sends a datagram built by the ARQ.
+// must be called with the lock held
+func (c *KCPConn) output(b []byte) {
+	c.lastSend = time.Now()
+	if err := c.write(b); err != nil {
+		logs.Debug("kcp write to %v error: %v", c.remote, err)
+	}
+}
+
+// input processes a datagram received from the peer.
+func (c *KCPConn) input(data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closeFlag {
+		return
+	}
+
+	if conv, ok := kcpConv(data); ok && conv == c.kcp.conv && data[4] == kcpCmdFin {
+		c.doDestroy(false)
+		return
+	}
+	c.kcp.current = kcpNow()
+	if err := c.kcp.input(data); err != nil {
+		logs.Debug("kcp input from %v error: %v", c.remote, err)
+		return
+	}
+	c.lastRecv = time.Now()
+
+	// acknowledge without waiting for the next update
+	if c.kcp.nodelay {
+		c.kcp.flush()
+	}
+	if c.kcp.peekSize() >= 0 {
+		c.lastMsg = c.lastRecv
+		select {
+		case c.readSig <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handshake negotiates the transforms of the connection, see TransformOptions.
+// it is called before the agent is created
+func (c *KCPConn) handshake(opts *TransformOptions, server bool) error {
+	if !opts.enabled() {
+		return nil
+	}
+	t := time.AfterFunc(opts.handshakeTimeout(), c.Destroy)
+	p, err := negotiate(c, opts, server, c.maxMsgLen)
+	t.Stop()
+	if err != nil {
+		return err
+	}
+	c.transform = p
+	return nil
+}
+
+// doDestroy closes the connection, the peer is told if fin is set.
+// must be called with the lock held
+func (c *KCPConn) doDestroy(fin bool) {
+	if c.closeFlag {
+		return
+	}
+	c.closeFlag = true
+	if fin {
+		seg := segment{conv: c.kcp.conv, cmd: kcpCmdFin}
+		c.write(seg.encode(nil))
+	}
+	close(c.closeSig)
+}
+
+// Destroy closes the connection immediately, the data not acknowledged yet is discarded.
+func (c *KCPConn) Destroy() {
+	c.Lock()
+	defer c.Unlock()
+	c.doDestroy(true)
+}
+
+// Close closes the connection once the data written is acknowledged by the peer.
+func (c *KCPConn) Close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.closeFlag || !c.closing.IsZero() {
+		return
+	}
+	c.closing = time.Now()
+}
+
+// LocalAddr returns the local network address of the connection.
+func (c *KCPConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the remote network address of the connection.
+func (c *KCPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ReadMsg reads the next message, empty heartbeat messages are answered and skipped.
+// it returns an error once the connection is closed.
+// goroutine not safe
+func (c *KCPConn) ReadMsg() ([]byte, error) {
+	for {
+		c.Lock()
+		msg := c.kcp.recv()
+		closed := c.closeFlag
+		if len(msg) == 0 && msg != nil && c.heartbeat {
+			c.send(msg)
+			c.Unlock()
+			continue
+		}
+		c.Unlock()
+
+		if msg != nil && c.transform != nil {
+			return c.transform.decode(msg)
+		}
+		if msg != nil {
+			return msg, nil
+		}
+		if closed {
+			return nil, errKCPClosed
+		}
+		select {
+		case <-c.readSig:
+		case <-c.closeSig:
+		}
+	}
+}
+
+// WriteMsg sends the parts as one message, the connection is destroyed if more than
+// pendingWriteNum segments wait for an acknowledgement.
+func (c *KCPConn) WriteMsg(args ...[]byte) error {
+	var msgLen uint32
+	for _, arg := range args {
+		msgLen += uint32(len(arg))
+	}
+	if msgLen > c.maxMsgLen {
+		return errors.New("message too long")
+	} else if msgLen < 1 {
+		return errors.New("message too short")
+	}
+
+	if c.transform != nil {
+		c.transform.Lock()
+		defer c.transform.Unlock()
+		msg, err := c.transform.encode(args)
+		if err != nil {
+			return err
+		}
+		c.Lock()
+		defer c.Unlock()
+		return c.send(msg)
+	}
+
+	msg := args[0]
+	if len(args) > 1 {
+		msg = make([]byte, 0, msgLen)
+		for _, arg := range args {
+			msg = append(msg, arg...)
+		}
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.send(msg)
+}
+
+// send queues a message and flushes it.
+// must be called with the lock held
+func (c *KCPConn) send(msg []byte) error {
+	if c.closeFlag || !c.closing.IsZero() {
+		return nil
+	}
+	if c.kcp.waitSnd() >= c.pendingWriteNum {
+		logs.Debug("close kcp connection %v: too many pending segments", c.remote)
+		if c.writeStats != nil {
+			c.writeStats.disconnected.Add(1)
+		}
+		c.doDestroy(true)
+		return nil
+	}
+	if err := c.kcp.send(msg); err != nil {
+		return err
+	}
+	c.kcp.current = kcpNow()
+	c.kcp.flush()
+	return nil
+}
+
+// kcpConv returns the conversation id of a datagram.
+func kcpConv(data []byte) (uint32, bool) {
+	if len(data) < kcpOverhead {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data), true
+}
+
+// kcpControl builds a datagram of the handshake.
+func kcpControl(conv uint32, cmd uint8, payload []byte) []byte {
+	seg := segment{conv: conv, cmd: cmd, data: payload}
+	return append(seg.encode(make([]byte, 0, kcpOverhead+len(payload))), payload...)
+}
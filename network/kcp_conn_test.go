@@ -0,0 +1,28 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestKCPPendingWriteNum(t *testing.T) {
+	// the peer never acknowledges
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	var stats writeStats
+	c := newKCPConn(1, addr, addr, func(b []byte) error { return nil }, &KCPOptions{}, 4096, 2)
+	c.writeStats = &stats
+
+	for range 2 {
+		c.WriteMsg([]byte("x"))
+	}
+	if c.closeFlag {
+		t.Fatal("destroyed within PendingWriteNum")
+	}
+	c.WriteMsg([]byte("x"))
+	if !c.closeFlag {
+		t.Fatal("not destroyed above PendingWriteNum")
+	}
+	if s := stats.load(); s != (WriteStats{Disconnected: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+}
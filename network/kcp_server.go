@@ -0,0 +1,273 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinyihanbing/gutils/logs"
+)
+
+// KCPServer accepts reliable UDP connections, a connection is identified by the remote address
+// and its conversation id.
+//
+// a connection is opened by a handshake, nothing is allocated before the client proves it receives
+// the datagrams sent to its address:
+//
+//	client: syn, 16 zero bytes      (padded to the size of the answer)
+//	server: cookie, 16 bytes        (HMAC of the address and conv, valid for 30 to 60s)
+//	client: syn, the cookie
+//	server: accept                  (the connection is created)
+//
+// every datagram carries the conv chosen by the client, the other datagrams of its address are dropped.
+type KCPServer struct {
+	Addr            string
+	MaxConnNum      int
+	PendingWriteNum int    // segments waiting for an acknowledgement per connection
+	MaxMsgLen       uint32 // limited by 254 segments
+	FlushTimeout    time.Duration
+	ReadTimeout     time.Duration    // connections receiving no message for this long are closed, 0 waits forever
+	Heartbeat       bool             // empty messages are heartbeats, answered and not passed to the agent
+	IPFilter        *IPFilter        // per-IP limits and allow and deny lists, nil accepts every client
+	Transform       TransformOptions // per-message compression and encryption negotiated with each client
+	KCPOptions
+	NewAgent func(*KCPConn) Agent
+
+	ln         *net.UDPConn
+	secret     []byte              // key of the cookies
+	conns      map[string]*KCPConn // remote address -> connection
+	accepting  bool
+	mutexConns sync.Mutex
+	writeStats writeStats
+	wgLn       sync.WaitGroup
+	wgConns    sync.WaitGroup
+}
+
+// kcpCookiePeriod is the validity period of the cookies, a cookie is accepted during the next one too.
+const kcpCookiePeriod = 30 * time.Second
+
+// Start listens on Addr and starts serving the connections.
+func (server *KCPServer) Start() {
+	addr, err := net.ResolveUDPAddr("udp", server.Addr)
+	if err != nil {
+		logs.Fatal("failed to resolve address: %v", err)
+	}
+	ln, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logs.Fatal("failed to start listener: %v", err)
+	}
+
+	if server.MaxConnNum <= 0 {
+		server.MaxConnNum = 100
+		logs.Info("invalid maxconnnum. resetting to default value: %v", server.MaxConnNum)
+	}
+	if server.PendingWriteNum <= 0 {
+		server.PendingWriteNum = 1024
+		logs.Info("invalid pendingwritenum. resetting to default value: %v", server.PendingWriteNum)
+	}
+	if server.MaxMsgLen <= 0 {
+		server.MaxMsgLen = 4096
+		logs.Info("invalid maxmsglen. resetting to default value: %v", server.MaxMsgLen)
+	}
+	if server.NewAgent == nil {
+		logs.Fatal("newagent callback must not be nil. please provide a valid function.")
+	}
+
+	server.secret = make([]byte, 32)
+	rand.Read(server.secret)
+	server.ln = ln
+	server.conns = make(map[string]*KCPConn)
+	server.accepting = true
+	server.IPFilter.attach(server.Addr)
+
+	server.wgLn.Add(1)
+	go server.run()
+}
+
+// run reads the datagrams and dispatches them to the connections.
+func (server *KCPServer) run() {
+	defer server.wgLn.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := server.ln.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			return
+		}
+		data := buf[:n]
+		conv, ok := kcpConv(data)
+		if !ok {
+			continue
+		}
+
+		key := addr.String()
+		server.mutexConns.Lock()
+		c := server.conns[key]
+		server.mutexConns.Unlock()
+		if data[4] == kcpCmdSyn {
+			server.handleSyn(c, conv, data[kcpOverhead:], addr, key)
+		} else if c != nil && c.kcp.conv == conv {
+			c.input(data)
+		}
+	}
+}
+
+// handleSyn answers a syn of the handshake, c is the connection of the address, nil if none.
+func (server *KCPServer) handleSyn(c *KCPConn, conv uint32, cookie []byte, addr *net.UDPAddr, key string) {
+	if len(cookie) != kcpCookieLen {
+		return
+	}
+	now := time.Now()
+	if [kcpCookieLen]byte(cookie) == [kcpCookieLen]byte{} {
+		server.ln.WriteToUDP(kcpControl(conv, kcpCmdCookie, server.cookie(addr, conv, now)), addr)
+		return
+	}
+	if !hmac.Equal(cookie, server.cookie(addr, conv, now)) &&
+		!hmac.Equal(cookie, server.cookie(addr, conv, now.Add(-kcpCookiePeriod))) {
+		return
+	}
+
+	accept := kcpControl(conv, kcpCmdAccept, nil)
+	if c != nil && c.kcp.conv == conv {
+		// the accept was lost
+		server.ln.WriteToUDP(accept, addr)
+		return
+	}
+	if c != nil {
+		// the client restarted with the same address
+		c.Destroy()
+	}
+
+	server.mutexConns.Lock()
+	defer server.mutexConns.Unlock()
+	if !server.accepting || server.conns == nil {
+		return
+	}
+	if len(server.conns) >= server.MaxConnNum {
+		logs.Error("too many connections. conn num=%v, limit=%v", len(server.conns), server.MaxConnNum)
+		return
+	}
+	if err := server.IPFilter.acquire(addr); err != nil {
+		logs.Debug("connection from %v refused: %v", addr, err)
+		return
+	}
+	server.newConn(conv, addr, key)
+	server.ln.WriteToUDP(accept, addr)
+}
+
+// cookie returns the cookie of an address and conv for the period of t.
+func (server *KCPServer) cookie(addr *net.UDPAddr, conv uint32, t time.Time) []byte {
+	mac := hmac.New(sha256.New, server.secret)
+	var b [12]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(t.UnixNano()/int64(kcpCookiePeriod)))
+	binary.LittleEndian.PutUint32(b[8:], conv)
+	mac.Write(b[:])
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:kcpCookieLen]
+}
+
+// newConn creates a connection and starts its agent once the transforms are negotiated.
+// must be called with mutexConns held
+func (server *KCPServer) newConn(conv uint32, addr *net.UDPAddr, key string) *KCPConn {
+	c := newKCPConn(conv, server.ln.LocalAddr(), addr, func(b []byte) error {
+		_, err := server.ln.WriteToUDP(b, addr)
+		return err
+	}, &server.KCPOptions, server.MaxMsgLen, server.PendingWriteNum)
+	c.readTimeout = server.ReadTimeout
+	c.heartbeat = server.Heartbeat
+	c.writeStats = &server.writeStats
+	c.onDestroy = func() {
+		server.mutexConns.Lock()
+		if server.conns[key] == c {
+			delete(server.conns, key)
+		}
+		server.mutexConns.Unlock()
+	}
+	server.conns[key] = c
+	go c.run()
+
+	server.wgConns.Add(1)
+	go func() {
+		defer server.wgConns.Done()
+		defer server.IPFilter.release(addr)
+		if err := c.handshake(&server.Transform, true); err != nil {
+			logs.Debug("handshake with %v failed: %v", addr, err)
+			c.Destroy()
+			return
+		}
+
+		agent := server.NewAgent(c)
+		agent.Run()
+
+		c.Close()
+		agent.OnClose()
+	}()
+	return c
+}
+
+// SetMaxConnNum changes the connection limit, active connections above the new limit are kept.
+func (server *KCPServer) SetMaxConnNum(n int) {
+	server.mutexConns.Lock()
+	server.MaxConnNum = n
+	server.mutexConns.Unlock()
+}
+
+// SetPendingWriteNum changes the limit of the pending segments of the new connections.
+func (server *KCPServer) SetPendingWriteNum(n int) {
+	server.mutexConns.Lock()
+	server.PendingWriteNum = n
+	server.mutexConns.Unlock()
+}
+
+// WriteStats returns the connections destroyed by PendingWriteNum, the only policy of the kcp connections.
+// goroutine safe
+func (server *KCPServer) WriteStats() WriteStats {
+	return server.writeStats.load()
+}
+
+// StopAccept stops creating connections for new addresses, active connections are kept.
+func (server *KCPServer) StopAccept() {
+	server.mutexConns.Lock()
+	server.accepting = false
+	server.mutexConns.Unlock()
+}
+
+// Close closes the connections, telling the peers, and the listener.
+func (server *KCPServer) Close() {
+	server.StopAccept()
+
+	// let active connections flush their pending writes
+	if server.FlushTimeout > 0 {
+		server.mutexConns.Lock()
+		for _, c := range server.conns {
+			c.Close()
+		}
+		server.mutexConns.Unlock()
+
+		if !waitTimeout(&server.wgConns, server.FlushTimeout) {
+			server.mutexConns.Lock()
+			logs.Error("flush timeout. %v connections still open, addr=%v", len(server.conns), server.Addr)
+			server.mutexConns.Unlock()
+		}
+	}
+
+	server.mutexConns.Lock()
+	conns := server.conns
+	server.conns = nil
+	server.mutexConns.Unlock()
+	for _, c := range conns {
+		c.Destroy()
+	}
+	server.wgConns.Wait()
+
+	server.ln.Close()
+	server.wgLn.Wait()
+	server.IPFilter.detach(server.Addr)
+}
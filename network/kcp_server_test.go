@@ -0,0 +1,274 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startKCP starts a kcp server on a free port.
+func startKCP(t *testing.T, server *KCPServer) (testAgents, string) {
+	agents := make(testAgents, 10)
+	server.Addr = "127.0.0.1:0"
+	server.NewAgent = func(c *KCPConn) Agent { return agents.new(c) }
+	server.Start()
+	t.Cleanup(server.Close)
+	return agents, server.ln.LocalAddr().String()
+}
+
+// startKCPClient connects a client, it returns the agents of its connections.
+func startKCPClient(t *testing.T, client *KCPClient) testAgents {
+	agents := make(testAgents, 10)
+	client.NewAgent = func(c *KCPConn) Agent { return agents.new(c) }
+	client.Start()
+	t.Cleanup(client.Close)
+	return agents
+}
+
+// rawKCP is a client socket writing the datagrams of the tests.
+type rawKCP struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func dialKCP(t *testing.T, addr string) *rawKCP {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawKCP{t: t, conn: conn}
+}
+
+func (r *rawKCP) send(conv uint32, cmd uint8, payload []byte) {
+	if _, err := r.conn.Write(kcpControl(conv, cmd, payload)); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// read returns the next datagram received, nil if none comes.
+func (r *rawKCP) read() []byte {
+	buf := make([]byte, 1500)
+	r.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := r.conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+// readConv returns the next datagram of conv received, nil if none comes.
+func (r *rawKCP) readConv(conv uint32) []byte {
+	for {
+		data := r.read()
+		if c, _ := kcpConv(data); data == nil || c == conv {
+			return data
+		}
+	}
+}
+
+// handshake opens the connection conv, it returns the cookie.
+func (r *rawKCP) handshake(conv uint32) []byte {
+	r.t.Helper()
+	r.send(conv, kcpCmdSyn, make([]byte, kcpCookieLen))
+	reply := r.readConv(conv)
+	if len(reply) != kcpOverhead+kcpCookieLen || reply[4] != kcpCmdCookie {
+		r.t.Fatalf("cookie reply %v", reply)
+	}
+	cookie := reply[kcpOverhead:]
+	r.send(conv, kcpCmdSyn, cookie)
+	if reply := r.readConv(conv); !bytes.Equal(reply, kcpControl(conv, kcpCmdAccept, nil)) {
+		r.t.Fatalf("accept reply %v", reply)
+	}
+	return cookie
+}
+
+func expectNoAgent(t *testing.T, agents testAgents) {
+	t.Helper()
+	select {
+	case <-agents:
+		t.Fatal("connection created")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestKCP(t *testing.T) {
+	agents, addr := startKCP(t, &KCPServer{})
+	client := &KCPClient{Addr: addr}
+	clientAgents := startKCPClient(t, client)
+	ca := clientAgents.next(t)
+	a := agents.next(t)
+
+	ca.conn.WriteMsg([]byte("hello"), []byte(" world"))
+	if msg := a.next(t); string(msg) != "hello world" {
+		t.Fatalf("message %q", msg)
+	}
+
+	// a message of several segments keeps its boundaries
+	big := bytes.Repeat([]byte("0123456789"), 300)
+	a.conn.WriteMsg(big)
+	a.conn.WriteMsg([]byte("small"))
+	if msg := ca.next(t); !bytes.Equal(msg, big) {
+		t.Fatalf("message of %v bytes, want %v", len(msg), len(big))
+	}
+	if msg := ca.next(t); string(msg) != "small" {
+		t.Fatalf("message %q", msg)
+	}
+
+	// the server learns the client is gone
+	client.Close()
+	ca.waitClosed(t)
+	a.waitClosed(t)
+}
+
+func TestKCPHandshake(t *testing.T) {
+	agents, addr := startKCP(t, &KCPServer{})
+	r := dialKCP(t, addr)
+
+	// no connection without the handshake
+	r.send(1, kcpCmdPush, []byte("data"))
+	r.send(1, kcpCmdSyn, nil)
+	r.send(1, kcpCmdSyn, make([]byte, kcpCookieLen+1))
+	r.send(1, kcpCmdSyn, bytes.Repeat([]byte{1}, kcpCookieLen))
+	if reply := r.read(); reply != nil {
+		t.Fatalf("reply %v", reply)
+	}
+	expectNoAgent(t, agents)
+
+	// the cookie answers a syn of its size, nothing is created before it comes back
+	r.send(1, kcpCmdSyn, make([]byte, kcpCookieLen))
+	cookie := r.read()[kcpOverhead:]
+	expectNoAgent(t, agents)
+
+	// a cookie is bound to the address and the conv
+	other := dialKCP(t, addr)
+	other.send(1, kcpCmdSyn, cookie)
+	r.send(2, kcpCmdSyn, cookie)
+	if other.read() != nil || r.read() != nil {
+		t.Fatal("cookie accepted for another address or conv")
+	}
+	expectNoAgent(t, agents)
+
+	r.send(1, kcpCmdSyn, cookie)
+	if reply := r.read(); !bytes.Equal(reply, kcpControl(1, kcpCmdAccept, nil)) {
+		t.Fatalf("accept reply %v", reply)
+	}
+	a := agents.next(t)
+
+	// the accept was lost: the syn is answered again, the connection is kept
+	r.send(1, kcpCmdSyn, cookie)
+	if reply := r.read(); !bytes.Equal(reply, kcpControl(1, kcpCmdAccept, nil)) {
+		t.Fatalf("accept reply %v", reply)
+	}
+	expectNoAgent(t, agents)
+
+	// the datagrams of another conv do not reach the connection
+	r.send(2, kcpCmdFin, nil)
+	r.send(2, kcpCmdPush, []byte("data"))
+	r.send(2, kcpCmdSyn, make([]byte, kcpCookieLen))
+	r.read()
+	time.Sleep(50 * time.Millisecond)
+	if a.isClosed() {
+		t.Fatal("connection closed by another conv")
+	}
+
+	// a client restarting with the same address replaces the connection once its handshake is done,
+	// the old one is told
+	r.handshake(2)
+	a.waitClosed(t)
+	a = agents.next(t)
+
+	r.send(2, kcpCmdFin, nil)
+	a.waitClosed(t)
+}
+
+func TestKCPIPFilter(t *testing.T) {
+	filter, err := NewIPFilter(IPFilterOptions{MaxConnPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, addr := startKCP(t, &KCPServer{IPFilter: filter})
+
+	r1 := dialKCP(t, addr)
+	r1.handshake(1)
+	a := agents.next(t)
+
+	// the filter checks the connections once the address is proven
+	r2 := dialKCP(t, addr)
+	r2.send(2, kcpCmdSyn, make([]byte, kcpCookieLen))
+	r2.send(2, kcpCmdSyn, r2.read()[kcpOverhead:])
+	if reply := r2.read(); reply != nil {
+		t.Fatalf("reply %v", reply)
+	}
+	expectNoAgent(t, agents)
+	if s := filter.Stats(); s.ConnLimited != 1 {
+		t.Fatalf("stats %v", s)
+	}
+
+	// a closed connection is released
+	r1.send(1, kcpCmdFin, nil)
+	a.waitClosed(t)
+	time.Sleep(20 * time.Millisecond)
+	r2.handshake(3)
+	agents.next(t)
+
+	// denied addresses do not connect
+	filter.Deny("127.0.0.1")
+	r3 := dialKCP(t, addr)
+	r3.send(4, kcpCmdSyn, make([]byte, kcpCookieLen))
+	r3.send(4, kcpCmdSyn, r3.read()[kcpOverhead:])
+	if reply := r3.read(); reply != nil {
+		t.Fatalf("reply %v", reply)
+	}
+}
+
+func TestKCPTransform(t *testing.T) {
+	opts := TransformOptions{CompressThreshold: 10, Encrypt: true}
+	agents, addr := startKCP(t, &KCPServer{Transform: opts})
+	clientAgents := startKCPClient(t, &KCPClient{Addr: addr, Transform: opts})
+	ca, a := clientAgents.next(t), agents.next(t)
+
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	ca.conn.WriteMsg(msg)
+	if got := a.next(t); !bytes.Equal(got, msg) {
+		t.Fatalf("message %q", got)
+	}
+	a.conn.WriteMsg([]byte("short"))
+	if got := ca.next(t); string(got) != "short" {
+		t.Fatalf("message %q", got)
+	}
+
+	// a server requiring encryption refuses the clients not asking for it
+	agents, addr = startKCP(t, &KCPServer{Transform: TransformOptions{RequireEncrypt: true}})
+	startKCPClient(t, &KCPClient{Addr: addr})
+	expectNoAgent(t, agents)
+}
+
+func TestKCPHeartbeat(t *testing.T) {
+	agents, addr := startKCP(t, &KCPServer{Heartbeat: true, ReadTimeout: 200 * time.Millisecond})
+	clientAgents := startKCPClient(t, &KCPClient{Addr: addr})
+	ca, a := clientAgents.next(t), agents.next(t)
+
+	// empty messages are answered and not passed to the agent, they keep the connection alive
+	c := ca.conn.(*KCPConn)
+	for range 4 {
+		c.Lock()
+		c.send([]byte{})
+		c.Unlock()
+		if msg := ca.next(t); len(msg) != 0 {
+			t.Fatalf("heartbeat answer %q", msg)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if a.isClosed() || len(a.msgs) != 0 {
+		t.Fatal("heartbeat passed to the agent or connection closed")
+	}
+
+	// the transport keepalives do not count as messages
+	a.waitClosed(t)
+}
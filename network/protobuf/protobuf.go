@@ -38,6 +38,11 @@ type MsgRaw struct {
 	msgRawData []byte
 }
 
+// ID returns the ID of the raw message.
+func (r MsgRaw) ID() uint16 {
+	return r.msgID
+}
+
 // NewProcessor creates a new Processor instance with default settings.
 // Returns: Pointer to the new Processor
 func NewProcessor() *Processor {
@@ -202,6 +207,19 @@ func (p *Processor) Marshal(msg any) ([][]byte, error) {
 	return [][]byte{id, data}, err
 }
 
+// MarshalRaw returns the wire form of a message from its ID and protobuf data, as received by a raw handler.
+// Parameters: id - the message ID, data - the protobuf data
+// Returns: A slice of byte slices, as returned by Marshal
+func (p *Processor) MarshalRaw(id uint16, data []byte) [][]byte {
+	b := make([]byte, 2)
+	if p.littleEndian {
+		binary.LittleEndian.PutUint16(b, id)
+	} else {
+		binary.BigEndian.PutUint16(b, id)
+	}
+	return [][]byte{b, data}
+}
+
 // Range iterates over all registered message types and their IDs.
 // Parameters: f - a function to execute for each message type and ID
 func (p *Processor) Range(f func(id uint16, t reflect.Type)) {
@@ -0,0 +1,184 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a load balancer takes to send the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxySignature starts a PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseCIDRs parses addresses and CIDRs, a single IP is a /32 or /128 network.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether one of nets contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener wraps the connections of the trusted proxies in a proxyConn.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (ln *proxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil || !containsIP(ln.trusted, addrIP(conn.RemoteAddr())) {
+		return conn, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+// proxyConn is a connection from a trusted proxy, its RemoteAddr is the client address
+// given by the PROXY protocol header once read.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr // nil if the header gives no address, e.g. a health check
+}
+
+// RemoteAddr returns the address of the client, the address of the proxy if the header gives none.
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY protocol header of a connection from a trusted proxy,
+// the other connections are left untouched. it must be called before reading the connection.
+func readProxyHeader(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	pc, ok := conn.(*proxyConn)
+	if !ok {
+		return nil
+	}
+
+	pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer pc.Conn.SetReadDeadline(time.Time{})
+
+	var buf [16]byte
+	if _, err := io.ReadFull(pc.Conn, buf[:6]); err != nil {
+		return err
+	}
+	switch {
+	case string(buf[:6]) == "PROXY ":
+		return pc.readV1()
+	case bytes.Equal(buf[:6], proxySignature[:6]):
+		if _, err := io.ReadFull(pc.Conn, buf[6:]); err != nil {
+			return err
+		}
+		return pc.readV2(buf[:])
+	default:
+		return errors.New("missing proxy protocol header")
+	}
+}
+
+// readV1 reads the rest of a text header: "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func (pc *proxyConn) readV1() error {
+	// at most 107 bytes, read one at a time to leave the client data unread
+	line := make([]byte, 0, 107-6)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return errors.New("proxy protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(pc.Conn, b[:]); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return fmt.Errorf("invalid proxy protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return fmt.Errorf("invalid proxy protocol v1 source %v:%v", fields[1], fields[3])
+	}
+	pc.remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+// readV2 reads the addresses of a binary header, hdr is its first 16 bytes.
+func (pc *proxyConn) readV2(hdr []byte) error {
+	if !bytes.Equal(hdr[:12], proxySignature) {
+		return errors.New("invalid proxy protocol v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported proxy protocol version %v", hdr[12]>>4)
+	}
+	// 0 is LOCAL, 1 is PROXY
+	local := hdr[12]&0xf == 0
+	if !local && hdr[12]&0xf != 1 {
+		return fmt.Errorf("unsupported proxy protocol command %v", hdr[12]&0xf)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(pc.Conn, body); err != nil {
+		return err
+	}
+
+	// LOCAL: a connection of the proxy itself, e.g. a health check
+	if local {
+		return nil
+	}
+	// the TLVs after the addresses are ignored
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return errors.New("invalid proxy protocol v2 ipv4 addresses")
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return errors.New("invalid proxy protocol v2 ipv6 addresses")
+		}
+		pc.remote = &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+	}
+	return nil
+}
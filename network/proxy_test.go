@@ -0,0 +1,174 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a binary header of command cmd.
+func proxyV2(cmd, family byte, addrs []byte) []byte {
+	hdr := append([]byte(nil), proxySignature...)
+	hdr = append(hdr, 0x20|cmd, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+// readHeader sends header and data from a trusted proxy, it returns the client address read.
+func readHeader(t *testing.T, header []byte) (net.Addr, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(append(header, "data"...))
+
+	pc := &proxyConn{Conn: server}
+	if err := readProxyHeader(pc); err != nil {
+		return nil, err
+	}
+	// the data after the header is left unread
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(pc, data); err != nil || string(data) != "data" {
+		t.Fatalf("data %q, %v", data, err)
+	}
+	return pc.RemoteAddr(), nil
+}
+
+func TestProxyV1(t *testing.T) {
+	for header, want := range map[string]string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n":  "192.0.2.1:5000",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 5000 80\r\n": "[2001:db8::1]:5000",
+		"PROXY UNKNOWN\r\n":                             "pipe",
+		"PROXY UNKNOWN ffff::1 ffff::2 65535 65535\r\n": "pipe",
+	} {
+		addr, err := readHeader(t, []byte(header))
+		if err != nil || addr.String() != want {
+			t.Fatalf("header %q: %v, %v", header, addr, err)
+		}
+	}
+
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 5000\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 5000 80\r\n",
+		"PROXY TCP4 192.0.2 198.51.100.1 5000 80\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 70000 80\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		"GET / HTTP/1.1\r\n",
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte(header))
+		if err := readProxyHeader(&proxyConn{Conn: server}); err == nil {
+			t.Fatalf("header %q accepted", header)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x13, 0x88, 0, 80}
+	v6 := make([]byte, 36)
+	v6[0], v6[1], v6[15] = 0x20, 0x01, 1
+	v6[32], v6[33] = 0x13, 0x88
+
+	for _, c := range []struct {
+		header []byte
+		want   string
+	}{
+		{proxyV2(1, 0x11, v4), "192.0.2.1:5000"},
+		{proxyV2(1, 0x21, v6), "[2001::1]:5000"},
+		// TLVs after the addresses are skipped
+		{proxyV2(1, 0x11, append(v4, 0x04, 0, 1, 'x')), "192.0.2.1:5000"},
+		// LOCAL keeps the proxy address
+		{proxyV2(0, 0x11, v4), "pipe"},
+		{proxyV2(0, 0, nil), "pipe"},
+		// unspecified and unix families too
+		{proxyV2(1, 0, nil), "pipe"},
+	} {
+		addr, err := readHeader(t, c.header)
+		if err != nil || addr.String() != c.want {
+			t.Fatalf("header %v: %v, %v", c.header, addr, err)
+		}
+	}
+
+	badVersion := proxyV2(1, 0x11, v4)
+	badVersion[12] = 0x11
+	for _, header := range [][]byte{
+		badVersion,
+		proxyV2(2, 0x11, v4),
+		proxyV2(0xf, 0x11, v4),
+		proxyV2(1, 0x11, v4[:8]),
+		proxyV2(1, 0x21, v4),
+		append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 12),
+	} {
+		client, server := net.Pipe()
+		go client.Write(append(header, "data"...))
+		if err := readProxyHeader(&proxyConn{Conn: server}); err == nil {
+			t.Fatalf("header %v accepted", header)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3": true, "192.0.2.1": true, "192.0.2.2": false,
+		"2001:db8::5": true, "::1": true, "::2": false, "11.0.0.1": false,
+	} {
+		if containsIP(nets, net.ParseIP(ip)) != want {
+			t.Fatalf("%v contained: %v", ip, !want)
+		}
+	}
+	for _, s := range []string{"10.0.0.0/33", "example.com", ""} {
+		if _, err := parseCIDRs([]string{s}); err == nil {
+			t.Fatalf("%q parsed", s)
+		}
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	agents, addr := startTCP(t, &TCPServer{ProxyProtocol: []string{"127.0.0.0/8"}})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n"))
+	writeFrame(t, conn, []byte("hello"))
+	a := agents.next(t)
+	if msg := a.next(t); string(msg) != "hello" {
+		t.Fatalf("message %q", msg)
+	}
+	if addr := a.conn.RemoteAddr().String(); addr != "192.0.2.1:5000" {
+		t.Fatalf("remote address %v", addr)
+	}
+
+	// a trusted proxy without the header is refused
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	writeFrame(t, conn2, []byte("hello"))
+	expectNoAgent(t, agents)
+
+	// the header of an untrusted peer is not honoured
+	agents, addr = startTCP(t, &TCPServer{ProxyProtocol: []string{"192.0.2.0/24"}})
+	conn3, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+	conn3.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 80\r\n"))
+	a = agents.next(t)
+	if host, _, _ := net.SplitHostPort(a.conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Fatalf("remote address %v", a.conn.RemoteAddr())
+	}
+}
@@ -1,6 +1,8 @@
 package network
 
 import (
+	"crypto/tls"
+	"math/rand/v2"
 	"net"
 	"sync"
 	"time"
@@ -14,12 +16,35 @@ type TCPClient struct {
 	Addr            string
 	ConnNum         int
 	ConnectInterval time.Duration
+	// MaxConnectInterval enables exponential backoff: the delay between attempts doubles from
+	// ConnectInterval up to MaxConnectInterval with a random jitter, and is reset once connected.
+	// 0 retries every ConnectInterval
+	MaxConnectInterval time.Duration
+	// ReadTimeout closes a connection receiving no message for this long, 0 waits forever
+	ReadTimeout time.Duration
+	// WriteTimeout closes a connection whose write does not complete within this time, 0 waits forever
+	WriteTimeout time.Duration
+	// HeartbeatInterval enables heartbeats, see TCPServer.Heartbeat: one is sent every interval,
+	// the answers keep the connection alive within ReadTimeout. 0 disables them
+	HeartbeatInterval time.Duration
+	// TLS enables TLS, the server certificate is verified with the CAs of CAFile, the system ones if empty.
+	// CertFile and KeyFile are the client certificate presented for mutual TLS. ServerName is the name
+	// checked in the server certificate, the host of Addr if empty
+	TLS        bool
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+	// Transform asks the server for per-message compression and encryption, see TransformOptions
+	Transform       TransformOptions
 	PendingWriteNum int
 	AutoReconnect   bool
 	NewAgent        func(*TCPConn) Agent
 	conns           ConnSet
 	wg              sync.WaitGroup
 	closeFlag       bool
+	closeSig        chan struct{}
+	tlsConfig       *tls.Config
 
 	// msg parser
 	LenMsgLen    int
@@ -52,8 +77,17 @@ func (client *TCPClient) init() {
 
 	client.conns = make(ConnSet)
 	client.closeFlag = false
+	client.closeSig = make(chan struct{})
 
 	client.initMsgParser()
+
+	if client.TLS {
+		config, err := clientTLSConfig(client.CertFile, client.KeyFile, client.CAFile, client.ServerName)
+		if err != nil {
+			logs.Fatal("failed to load certificates: %v", err)
+		}
+		client.tlsConfig = config
+	}
 }
 
 // validateConfig validates and adjusts the client configuration.
@@ -80,19 +114,37 @@ func (client *TCPClient) initMsgParser() {
 	msgParser := NewMsgParser()
 	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
 	msgParser.SetByteOrder(client.LittleEndian)
+	msgParser.SetHeartbeat(client.HeartbeatInterval > 0)
 	client.msgParser = msgParser
 }
 
 // dial attempts to establish a TCP connection to the configured address.
-func (client *TCPClient) dial() net.Conn {
+// it returns nil once the client is closed.
+func (client *TCPClient) dial(b *backoff) net.Conn {
 	for {
-		conn, err := net.Dial("tcp", client.Addr)
-		if err == nil || client.closeFlag {
+		var conn net.Conn
+		var err error
+		if client.tlsConfig != nil {
+			conn, err = tls.Dial("tcp", client.Addr, client.tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", client.Addr)
+		}
+		client.Lock()
+		closeFlag := client.closeFlag
+		client.Unlock()
+		if err == nil {
 			return conn
 		}
+		// tls.Dial returns a nil *tls.Conn, not a nil net.Conn
+		if closeFlag {
+			return nil
+		}
 
-		logs.Info("failed to connect to %v. error: %v. retrying in %v...", client.Addr, err, client.ConnectInterval)
-		time.Sleep(client.ConnectInterval)
+		delay := b.next()
+		logs.Info("failed to connect to %v. error: %v. retrying in %v...", client.Addr, err, delay)
+		if !client.sleep(delay) {
+			return nil
+		}
 	}
 }
 
@@ -100,11 +152,13 @@ func (client *TCPClient) dial() net.Conn {
 func (client *TCPClient) connect() {
 	defer client.wg.Done()
 
+	b := &backoff{min: client.ConnectInterval, max: client.MaxConnectInterval}
 	for {
-		conn := client.dial()
+		conn := client.dial(b)
 		if conn == nil {
 			return
 		}
+		b.reset()
 
 		if !client.handleConnection(conn) {
 			return
@@ -113,10 +167,53 @@ func (client *TCPClient) connect() {
 		if !client.AutoReconnect {
 			break
 		}
-		time.Sleep(client.ConnectInterval)
+		if !client.sleep(b.next()) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, it returns false if the client is closed meanwhile.
+func (client *TCPClient) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-client.closeSig:
+		return false
 	}
 }
 
+// backoff computes the delays between connection attempts.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+// next returns the delay before the next attempt: min doubled per failed attempt up to max,
+// with a jitter of +/- 20%. min if max is not above min.
+func (b *backoff) next() time.Duration {
+	if b.max <= b.min {
+		return b.min
+	}
+
+	d := b.min << min(b.attempt, 30)
+	if d <= 0 || d > b.max {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+	jitter := time.Duration(rand.Int64N(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
 // handleConnection manages a single connection, including agent lifecycle and cleanup.
 func (client *TCPClient) handleConnection(conn net.Conn) bool {
 	client.Lock()
@@ -128,7 +225,19 @@ func (client *TCPClient) handleConnection(conn net.Conn) bool {
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
+	tcpConn := newTCPConn(conn, newWriteQueue(client.PendingWriteNum, nil, nil), client.msgParser, idleTimeouts{
+		read:      client.ReadTimeout,
+		write:     client.WriteTimeout,
+		heartbeat: client.HeartbeatInterval,
+	})
+	if err := tcpConn.handshake(&client.Transform, false); err != nil {
+		logs.Error("handshake with %v failed: %v", client.Addr, err)
+		tcpConn.Destroy()
+		client.Lock()
+		delete(client.conns, conn)
+		client.Unlock()
+		return true
+	}
 	agent := client.NewAgent(tcpConn)
 	agent.Run()
 
@@ -145,6 +254,9 @@ func (client *TCPClient) handleConnection(conn net.Conn) bool {
 // Close gracefully shuts down the client, closing all active connections.
 func (client *TCPClient) Close() {
 	client.Lock()
+	if client.closeSig != nil && !client.closeFlag {
+		close(client.closeSig)
+	}
 	client.closeFlag = true
 	for conn := range client.conns {
 		conn.Close()
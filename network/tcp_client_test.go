@@ -0,0 +1,42 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 10 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		want *= time.Second
+		d := b.next()
+		if d < want*4/5 || d > want*6/5 {
+			t.Fatalf("delay = %v, want %v +/- 20%%", d, want)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > 1200*time.Millisecond {
+		t.Fatalf("delay after reset = %v", d)
+	}
+
+	// no backoff without a larger max
+	b = &backoff{min: time.Second}
+	for range 3 {
+		if d := b.next(); d != time.Second {
+			t.Fatalf("delay = %v, want 1s", d)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := &backoff{min: time.Second, max: time.Second * 2}
+	seen := make(map[time.Duration]bool)
+	for range 20 {
+		b.reset()
+		seen[b.next()] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("no jitter")
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"net"
 	"sync"
+	"time"
 
 	"github.com/yinyihanbing/gutils/logs"
 )
@@ -14,49 +15,166 @@ type ConnSet map[net.Conn]struct{}
 type TCPConn struct {
 	sync.Mutex
 	conn      net.Conn
-	writeChan chan []byte
+	queue     *writeQueue
 	closeFlag bool
 	msgParser *MsgParser
+	idle      idleTimeouts
+	done      chan struct{} // closed when the write goroutine exits
+	transform *pipeline     // compression and encryption, nil if none is negotiated
+	lenBuf    [4]byte       // message length read by the message parser
+}
+
+// maxWriteBatch bounds the queued writes sent in one writev call.
+const maxWriteBatch = 64
+
+// idleTimeouts configures the detection of dead peers.
+type idleTimeouts struct {
+	read      time.Duration // a message must be received within, 0 waits forever
+	write     time.Duration // a write must complete within, 0 waits forever
+	heartbeat time.Duration // interval of the heartbeats sent, 0 sends none
+	echo      bool          // answer the heartbeats received
 }
 
 // newTCPConn creates a new TCPConn instance.
-func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
+func newTCPConn(conn net.Conn, queue *writeQueue, msgParser *MsgParser, idle idleTimeouts) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
-	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
+	tcpConn.queue = queue
 	tcpConn.msgParser = msgParser
+	tcpConn.idle = idle
+	tcpConn.done = make(chan struct{})
 
 	// goroutine to handle writing to the connection
-	go func() {
-		for b := range tcpConn.writeChan {
-			if b == nil {
-				break
-			}
+	go tcpConn.writeLoop()
 
-			_, err := conn.Write(b)
-			if err != nil {
-				logs.Debug("error writing to connection: ", err)
-				break
+	if idle.heartbeat > 0 {
+		go tcpConn.sendHeartbeats()
+	}
+
+	return tcpConn
+}
+
+// writeLoop writes the queued messages until the connection is closed,
+// the messages queued while writing are sent together in one writev call.
+func (tcpConn *TCPConn) writeLoop() {
+	defer close(tcpConn.done)
+
+	batch := make([]writeBuf, 0, maxWriteBatch)
+	bufs := make(net.Buffers, 0, maxWriteBatch)
+	for w := range tcpConn.queue.ch {
+		closing := w.b == nil
+		if !closing {
+			batch = append(batch, w)
+		}
+	drain:
+		for !closing && len(batch) < maxWriteBatch {
+			select {
+			case w, ok := <-tcpConn.queue.ch:
+				if !ok || w.b == nil {
+					closing = true
+					break drain
+				}
+				batch = append(batch, w)
+			default:
+				break drain
 			}
 		}
 
-		conn.Close()
-		tcpConn.Lock()
-		tcpConn.closeFlag = true
-		tcpConn.Unlock()
-	}()
+		tcpConn.queue.taken(&tcpConn.Mutex)
+		err := tcpConn.writeBatch(batch, bufs)
+		clear(batch)
+		batch = batch[:0]
+		if err != nil {
+			logs.Debug("error writing to connection: %v", err)
+			break
+		}
+		if closing {
+			break
+		}
+	}
 
-	return tcpConn
+	tcpConn.conn.Close()
+	tcpConn.Lock()
+	tcpConn.closeFlag = true
+	tcpConn.queue.wake()
+	tcpConn.Unlock()
+}
+
+// writeBatch writes the messages of batch and releases their pooled buffers.
+func (tcpConn *TCPConn) writeBatch(batch []writeBuf, bufs net.Buffers) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	for _, w := range batch {
+		bufs = append(bufs, w.b)
+	}
+
+	if tcpConn.idle.write > 0 {
+		tcpConn.conn.SetWriteDeadline(time.Now().Add(tcpConn.idle.write))
+	}
+	_, err := bufs.WriteTo(tcpConn.conn)
+
+	for _, w := range batch {
+		if w.pooled != nil {
+			putBuffer(w.pooled)
+		}
+	}
+	return err
+}
+
+// sendHeartbeats writes a heartbeat every idle.heartbeat until the connection is closed.
+func (tcpConn *TCPConn) sendHeartbeats() {
+	t := time.NewTicker(tcpConn.idle.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-tcpConn.done:
+			return
+		case <-t.C:
+			tcpConn.Write(tcpConn.msgParser.heartbeatFrame())
+		}
+	}
+}
+
+// extendReadDeadline gives the peer idle.read to send the next message.
+func (tcpConn *TCPConn) extendReadDeadline() {
+	if tcpConn.idle.read > 0 {
+		tcpConn.conn.SetReadDeadline(time.Now().Add(tcpConn.idle.read))
+	}
+}
+
+// onHeartbeat is called by the message parser when a heartbeat is received.
+func (tcpConn *TCPConn) onHeartbeat() {
+	if tcpConn.idle.echo {
+		tcpConn.Write(tcpConn.msgParser.heartbeatFrame())
+	}
+}
+
+// handshake negotiates the transforms of the connection, see TransformOptions.
+// it is called before the agent is created
+func (tcpConn *TCPConn) handshake(opts *TransformOptions, server bool) error {
+	if !opts.enabled() {
+		return nil
+	}
+	tcpConn.conn.SetReadDeadline(time.Now().Add(opts.handshakeTimeout()))
+	p, err := negotiate(tcpConn, opts, server, tcpConn.msgParser.maxMsgLen)
+	tcpConn.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	tcpConn.transform = p
+	return nil
 }
 
 // doDestroy forcibly closes the connection and cleans up resources.
 func (tcpConn *TCPConn) doDestroy() {
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	setLinger0(tcpConn.conn)
 	tcpConn.conn.Close()
 
 	if !tcpConn.closeFlag {
-		close(tcpConn.writeChan)
+		close(tcpConn.queue.ch)
 		tcpConn.closeFlag = true
+		tcpConn.queue.wake()
 	}
 }
 
@@ -76,23 +194,21 @@ func (tcpConn *TCPConn) Close() {
 		return
 	}
 
-	tcpConn.doWrite(nil) // signal to close
+	tcpConn.doWrite(writeBuf{}) // signal to close
 	tcpConn.closeFlag = true
 }
 
-// doWrite writes data to the write channel or destroys the connection if the channel is full.
-func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
+// doWrite writes data to the write channel, applying the backpressure policy if the channel is full.
+func (tcpConn *TCPConn) doWrite(w writeBuf) {
+	if !tcpConn.queue.push(&tcpConn.Mutex, &tcpConn.closeFlag, w) {
 		logs.Debug("close connection: write channel full")
 		tcpConn.doDestroy()
-		return
 	}
-
-	tcpConn.writeChan <- b
 }
 
 // Write sends data to the connection. The data must not be modified by other goroutines.
 func (tcpConn *TCPConn) Write(b []byte) {
+	defer tcpConn.queue.notify(tcpConn)
 	tcpConn.Lock()
 	defer tcpConn.Unlock()
 	if tcpConn.closeFlag || b == nil {
@@ -100,7 +216,20 @@ func (tcpConn *TCPConn) Write(b []byte) {
 		return
 	}
 
-	tcpConn.doWrite(b)
+	tcpConn.doWrite(writeBuf{b: b})
+}
+
+// writeBuffer queues a buffer of the pool, it is released once written.
+func (tcpConn *TCPConn) writeBuffer(buf *[]byte, droppable bool) {
+	defer tcpConn.queue.notify(tcpConn)
+	tcpConn.Lock()
+	defer tcpConn.Unlock()
+	if tcpConn.closeFlag {
+		putBuffer(buf)
+		return
+	}
+
+	tcpConn.doWrite(writeBuf{b: *buf, pooled: buf, droppable: droppable})
 }
 
 // Read reads data from the connection into the provided buffer.
@@ -120,10 +249,34 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 
 // ReadMsg reads a complete message from the connection using the message parser.
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
-	return tcpConn.msgParser.Read(tcpConn)
+	b, err := tcpConn.msgParser.Read(tcpConn)
+	if err != nil || tcpConn.transform == nil {
+		return b, err
+	}
+	return tcpConn.transform.decode(b)
 }
 
 // WriteMsg writes one or more messages to the connection using the message parser.
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
-	return tcpConn.msgParser.Write(tcpConn, args...)
+	return tcpConn.writeMsg(false, args)
+}
+
+// WriteDroppableMsg writes a message the WriteDropDroppable policy may drop, e.g. a position update
+// superseded by the next one.
+func (tcpConn *TCPConn) WriteDroppableMsg(args ...[]byte) error {
+	return tcpConn.writeMsg(true, args)
+}
+
+func (tcpConn *TCPConn) writeMsg(droppable bool, args [][]byte) error {
+	if tcpConn.transform == nil {
+		return tcpConn.msgParser.write(tcpConn, droppable, args)
+	}
+
+	tcpConn.transform.Lock()
+	defer tcpConn.transform.Unlock()
+	msg, err := tcpConn.transform.encode(args)
+	if err != nil {
+		return err
+	}
+	return tcpConn.msgParser.write(tcpConn, droppable, [][]byte{msg})
 }
@@ -13,6 +13,7 @@ type MsgParser struct {
 	minMsgLen    uint32 // Minimum allowed message length.
 	maxMsgLen    uint32 // Maximum allowed message length.
 	littleEndian bool   // Byte order: true for little-endian, false for big-endian.
+	heartbeat    bool   // Messages of length 0 are heartbeats.
 }
 
 // NewMsgParser creates a new MsgParser with default settings.
@@ -64,11 +65,25 @@ func (p *MsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
-// Read reads a message from the TCP connection.
+// SetHeartbeat enables heartbeats: messages of length 0, consumed by Read and never returned.
+// Both peers must enable them.
+func (p *MsgParser) SetHeartbeat(enabled bool) {
+	p.heartbeat = enabled
+}
+
+// heartbeatFrame returns a heartbeat, a zero message length.
+func (p *MsgParser) heartbeatFrame() []byte {
+	return make([]byte, p.lenMsgLen)
+}
+
+// Read reads a message from the TCP connection, skipping heartbeats.
 // Returns the message data or an error if the message is invalid or cannot be read.
+// The message buffer comes from a pool, it can be given back with ReleaseMsg.
 func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
-	var b [4]byte
-	bufMsgLen := b[:p.lenMsgLen]
+	bufMsgLen := conn.lenBuf[:p.lenMsgLen]
+
+read:
+	conn.extendReadDeadline()
 
 	// read len
 	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
@@ -94,6 +109,12 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 		}
 	}
 
+	// heartbeat
+	if msgLen == 0 && p.heartbeat {
+		conn.onHeartbeat()
+		goto read
+	}
+
 	// check len
 	if msgLen > p.maxMsgLen {
 		return nil, errors.New("message too long")
@@ -102,8 +123,10 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 	}
 
 	// data
-	msgData := make([]byte, msgLen)
+	buf := getBuffer(int(msgLen))
+	msgData := *buf
 	if _, err := io.ReadFull(conn, msgData); err != nil {
+		putBuffer(buf)
 		return nil, err
 	}
 
@@ -111,9 +134,13 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 }
 
 // Write writes a message to the TCP connection.
-// args: Message parts to be concatenated and sent.
+// args: Message parts to be concatenated and sent, they are copied and can be reused once Write returns.
 // Returns an error if the message length is invalid or cannot be written.
 func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
+	return p.write(conn, false, args)
+}
+
+func (p *MsgParser) write(conn *TCPConn, droppable bool, args [][]byte) error {
 	// get len
 	var msgLen uint32
 	for _, arg := range args {
@@ -127,7 +154,8 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 		return errors.New("message too short")
 	}
 
-	msg := make([]byte, uint32(p.lenMsgLen)+msgLen)
+	buf := getBuffer(p.lenMsgLen + int(msgLen))
+	msg := *buf
 
 	// write len
 	switch p.lenMsgLen {
@@ -154,7 +182,7 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 		l += len(arg)
 	}
 
-	conn.Write(msg)
+	conn.writeBuffer(buf, droppable)
 
 	return nil
 }
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, c := range []struct{ n, class int }{{0, 0}, {1, 0}, {64, 0}, {65, 1}, {128, 1}, {1 << 20, 14}, {1<<20 + 1, -1}} {
+		if class := bufferClass(c.n); class != c.class {
+			t.Fatalf("class of %v: %v, want %v", c.n, class, c.class)
+		}
+	}
+
+	// the buffers have the length asked and the capacity of their class
+	buf := getBuffer(100)
+	if len(*buf) != 100 || cap(*buf) != 128 {
+		t.Fatalf("buffer %v/%v", len(*buf), cap(*buf))
+	}
+	if buf := getBuffer(1<<20 + 1); len(*buf) != 1<<20+1 {
+		t.Fatalf("buffer %v", len(*buf))
+	}
+
+	// only the buffers of the pool go back to it
+	ReleaseMsg(make([]byte, 100))
+	ReleaseMsg(nil)
+	putBuffer(buf)
+	if buf := getBuffer(128); cap(*buf) != 128 {
+		t.Fatalf("buffer %v/%v", len(*buf), cap(*buf))
+	}
+}
+
+func TestTCPWriteBatch(t *testing.T) {
+	agents, addr := startTCP(t, &TCPServer{PendingWriteNum: 1000})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := agents.next(t)
+
+	// the parts are copied: reusing them after WriteMsg does not change the messages
+	part := make([]byte, 3)
+	for i := range 500 {
+		copy(part, fmt.Sprintf("%03d", i))
+		a.conn.WriteMsg([]byte("msg "), part)
+	}
+	for i := range 500 {
+		if msg := readFrame(t, conn); string(msg) != fmt.Sprintf("msg %03d", i) {
+			t.Fatalf("message %v: %q", i, msg)
+		}
+	}
+
+	// the messages read can be released and their buffers reused
+	for i := range 500 {
+		writeFrame(t, conn, bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	for i := range 500 {
+		msg := a.next(t)
+		if len(msg) != 100 || msg[0] != byte(i) || msg[99] != byte(i) {
+			t.Fatalf("message %v: %v", i, msg)
+		}
+	}
+}
+
+// benchAgent gives its connection to the benchmark and waits for its end.
+type benchAgent struct {
+	done chan struct{}
+}
+
+func (a *benchAgent) Run()     { <-a.done }
+func (a *benchAgent) OnClose() {}
+
+// benchConn connects to a server, it returns the connection of both sides.
+func benchConn(b *testing.B, pendingWriteNum int) (*TCPConn, net.Conn) {
+	conns := make(chan *TCPConn, 1)
+	done := make(chan struct{})
+	server := &TCPServer{
+		Addr:            "127.0.0.1:0",
+		PendingWriteNum: pendingWriteNum,
+		LenMsgLen:       2,
+		MaxMsgLen:       65535,
+		NewAgent: func(c *TCPConn) Agent {
+			conns <- c
+			return &benchAgent{done: done}
+		},
+	}
+	server.Start()
+	b.Cleanup(server.Close)
+	b.Cleanup(func() { close(done) })
+	client, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { client.Close() })
+	return <-conns, client
+}
+
+var benchSizes = []int{64, 1024, 16384}
+
+func BenchmarkReadMsg(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			conn, client := benchConn(b, 100)
+			frame := make([]byte, 2+size)
+			frame[0], frame[1] = byte(size>>8), byte(size)
+			go func() {
+				for range b.N {
+					if _, err := client.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				msg, err := conn.ReadMsg()
+				if err != nil {
+					b.Fatal(err)
+				}
+				ReleaseMsg(msg)
+			}
+		})
+	}
+}
+
+func BenchmarkWriteMsg(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			conn, client := benchConn(b, 1024)
+			frameLen := 2 + size
+			// the messages in flight stay below PendingWriteNum, a full queue would close the connection
+			inFlight := make(chan struct{}, 512)
+			received := make(chan struct{})
+			go func() {
+				defer close(received)
+				buf := make([]byte, 64*1024)
+				var n int
+				for range b.N {
+					for n < frameLen {
+						m, err := client.Read(buf)
+						if err != nil {
+							return
+						}
+						n += m
+					}
+					n -= frameLen
+					<-inFlight
+				}
+			}()
+			msg := make([]byte, size)
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				inFlight <- struct{}{}
+				if err := conn.WriteMsg(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-received
+		})
+	}
+}
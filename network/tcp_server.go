@@ -1,6 +1,7 @@
 package network
 
 import (
+	"crypto/tls"
 	"net"
 	"sync"
 	"time"
@@ -16,18 +17,44 @@ type TCPServer struct {
 	MaxConnNum int
 	// Maximum number of pending writes per connection
 	PendingWriteNum int
+	// Maximum time Close waits for connections to flush pending writes, 0 closes them immediately
+	FlushTimeout time.Duration
+	// Connections receiving no message for ReadTimeout are closed, 0 waits forever
+	ReadTimeout time.Duration
+	// Connections whose write does not complete within WriteTimeout are closed, 0 waits forever
+	WriteTimeout time.Duration
+	// Messages of length 0 are heartbeats, answered by the server and not passed to the agent,
+	// see TCPClient.HeartbeatInterval
+	Heartbeat bool
+	// TLS certificate and key files, the connections are plaintext if empty
+	CertFile string
+	KeyFile  string
+	// CA certificates file enabling mutual TLS: clients must present a certificate signed by one of them
+	ClientCAFile string
+	// Addresses or CIDRs of the load balancers sending a PROXY protocol header (v1 or v2), e.g. "10.0.0.0/8".
+	// their connections must start with one, RemoteAddr returns the client address it gives.
+	// the other connections are served as is, empty disables the PROXY protocol
+	ProxyProtocol []string
+	// Per-IP limits and allow and deny lists checked on the client address, nil accepts every client
+	IPFilter *IPFilter
+	// Per-message compression and encryption negotiated with each client, see TransformOptions
+	Transform TransformOptions
+	// Policy applied when PendingWriteNum messages wait to be written, the connection is destroyed by default
+	Backpressure Backpressure
 	// Callback to create a new agent for each connection
 	NewAgent func(*TCPConn) Agent
 	// Listener for incoming connections
 	ln net.Listener
 	// Set of active connections
-	conns ConnSet
+	conns map[net.Conn]*TCPConn
 	// Mutex to protect access to the connection set
 	mutexConns sync.Mutex
 	// WaitGroup for listener goroutine
 	wgLn sync.WaitGroup
 	// WaitGroup for connection handling goroutines
 	wgConns sync.WaitGroup
+	// Outcomes of the writes finding a full queue
+	writeStats writeStats
 
 	// Message parser configuration
 	LenMsgLen    int
@@ -41,6 +68,7 @@ type TCPServer struct {
 func (server *TCPServer) Start() {
 	// Initialize server configuration and message parser
 	server.init()
+	server.IPFilter.attach(server.Addr)
 	// Start the server in a separate goroutine
 	go server.run()
 }
@@ -52,6 +80,21 @@ func (server *TCPServer) init() {
 	if err != nil {
 		logs.Fatal("failed to start listener: %v", err)
 	}
+	if len(server.ProxyProtocol) > 0 {
+		trusted, err := parseCIDRs(server.ProxyProtocol)
+		if err != nil {
+			logs.Fatal("invalid proxyprotocol: %v", err)
+		}
+		// the header comes before the TLS handshake
+		ln = &proxyListener{Listener: ln, trusted: trusted}
+	}
+	if server.CertFile != "" || server.KeyFile != "" {
+		config, err := serverTLSConfig(server.CertFile, server.KeyFile, server.ClientCAFile)
+		if err != nil {
+			logs.Fatal("failed to load certificates: %v", err)
+		}
+		ln = tls.NewListener(ln, config)
+	}
 
 	// Validate and set default values for configuration
 	if server.MaxConnNum <= 0 {
@@ -65,15 +108,19 @@ func (server *TCPServer) init() {
 	if server.NewAgent == nil {
 		logs.Fatal("newagent callback must not be nil. please provide a valid function.")
 	}
+	if err := server.Backpressure.Validate(); err != nil {
+		logs.Fatal("invalid backpressure: %v", err)
+	}
 
 	// Assign listener and initialize connection set
 	server.ln = ln
-	server.conns = make(ConnSet)
+	server.conns = make(map[net.Conn]*TCPConn)
 
 	// Initialize message parser
 	msgParser := NewMsgParser()
 	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
+	msgParser.SetHeartbeat(server.Heartbeat)
 	server.msgParser = msgParser
 }
 
@@ -115,17 +162,42 @@ func (server *TCPServer) run() {
 			logs.Error("too many connections. conn num=%v, limit=%v", len(server.conns), server.MaxConnNum)
 			continue
 		}
-		// Add the new connection to the connection set
-		server.conns[conn] = struct{}{}
+		// Create a new TCP connection and add it to the connection set
+		tcpConn := newTCPConn(conn, newWriteQueue(server.PendingWriteNum, &server.Backpressure, &server.writeStats), server.msgParser, idleTimeouts{
+			read:  server.ReadTimeout,
+			write: server.WriteTimeout,
+			echo:  server.Heartbeat,
+		})
+		server.conns[conn] = tcpConn
 		server.mutexConns.Unlock()
 
 		// Increment the connection WaitGroup
 		server.wgConns.Add(1)
 
-		// Create a new TCP connection and agent
-		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser)
-		agent := server.NewAgent(tcpConn)
 		go func() {
+			// Read the PROXY header, check the client address and negotiate the transforms
+			// before the agent writes anything
+			err := readProxyHeader(conn)
+			if err != nil {
+				logs.Debug("proxy protocol header from %v: %v", conn.RemoteAddr(), err)
+			} else if err = server.IPFilter.acquire(tcpConn.RemoteAddr()); err != nil {
+				logs.Debug("connection from %v refused: %v", tcpConn.RemoteAddr(), err)
+			} else if err = tcpConn.handshake(&server.Transform, true); err != nil {
+				server.IPFilter.release(tcpConn.RemoteAddr())
+				logs.Debug("handshake with %v failed: %v", conn.RemoteAddr(), err)
+			}
+			if err != nil {
+				tcpConn.Destroy()
+				server.mutexConns.Lock()
+				delete(server.conns, conn)
+				server.mutexConns.Unlock()
+				server.wgConns.Done()
+				return
+			}
+
+			// Create a new agent
+			agent := server.NewAgent(tcpConn)
+
 			// Run the agent
 			agent.Run()
 
@@ -134,6 +206,7 @@ func (server *TCPServer) run() {
 			server.mutexConns.Lock()
 			delete(server.conns, conn)
 			server.mutexConns.Unlock()
+			server.IPFilter.release(tcpConn.RemoteAddr())
 			agent.OnClose()
 
 			// Decrement the connection WaitGroup
@@ -142,11 +215,51 @@ func (server *TCPServer) run() {
 	}
 }
 
+// SetMaxConnNum changes the connection limit, active connections above the new limit are kept.
+func (server *TCPServer) SetMaxConnNum(n int) {
+	server.mutexConns.Lock()
+	server.MaxConnNum = n
+	server.mutexConns.Unlock()
+}
+
+// SetPendingWriteNum changes the write queue length of the connections accepted from now on.
+func (server *TCPServer) SetPendingWriteNum(n int) {
+	server.mutexConns.Lock()
+	server.PendingWriteNum = n
+	server.mutexConns.Unlock()
+}
+
+// WriteStats returns the outcomes of the writes finding a full queue.
+// goroutine safe
+func (server *TCPServer) WriteStats() WriteStats {
+	return server.writeStats.load()
+}
+
+// StopAccept closes the listener so no new connections are accepted, active connections are kept.
+func (server *TCPServer) StopAccept() {
+	server.ln.Close()
+	server.wgLn.Wait()
+}
+
 // Close gracefully shuts down the server and closes all active connections.
 func (server *TCPServer) Close() {
 	// Close the listener and wait for the listener goroutine to finish
-	server.ln.Close()
-	server.wgLn.Wait()
+	server.StopAccept()
+
+	// Let active connections flush their pending writes
+	if server.FlushTimeout > 0 {
+		server.mutexConns.Lock()
+		for _, tcpConn := range server.conns {
+			tcpConn.Close()
+		}
+		server.mutexConns.Unlock()
+
+		if !waitTimeout(&server.wgConns, server.FlushTimeout) {
+			server.mutexConns.Lock()
+			logs.Error("flush timeout. %v connections still open, addr=%v", len(server.conns), server.Addr)
+			server.mutexConns.Unlock()
+		}
+	}
 
 	// Close all active connections
 	server.mutexConns.Lock()
@@ -158,4 +271,21 @@ func (server *TCPServer) Close() {
 
 	// Wait for all connection handling goroutines to finish
 	server.wgConns.Wait()
+	server.IPFilter.detach(server.Addr)
+}
+
+// waitTimeout waits for the WaitGroup for at most d, returns false on timeout.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
 }
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPReadTimeout(t *testing.T) {
+	agents, addr := startTCP(t, &TCPServer{ReadTimeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := agents.next(t)
+
+	// each message gives the client ReadTimeout more
+	for range 3 {
+		time.Sleep(50 * time.Millisecond)
+		writeFrame(t, conn, []byte("x"))
+		a.next(t)
+	}
+	last := time.Now()
+	a.waitClosed(t)
+	if d := time.Since(last); d < 80*time.Millisecond {
+		t.Fatalf("closed after %v idle", d)
+	}
+}
+
+func TestTCPHeartbeat(t *testing.T) {
+	agents, addr := startTCP(t, &TCPServer{Heartbeat: true})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	a := agents.next(t)
+
+	// heartbeats are answered and not passed to the agent
+	writeFrame(t, conn, nil)
+	if msg := readFrame(t, conn); len(msg) != 0 {
+		t.Fatalf("heartbeat answer %v", msg)
+	}
+	writeFrame(t, conn, []byte("abc"))
+	if msg := a.next(t); string(msg) != "abc" {
+		t.Fatalf("message %q", msg)
+	}
+}
+
+func TestTCPClientHeartbeat(t *testing.T) {
+	agents, addr := startTCP(t, &TCPServer{ReadTimeout: 100 * time.Millisecond, Heartbeat: true})
+	clientAgents := make(testAgents, 10)
+	client := &TCPClient{
+		Addr:              addr,
+		ReadTimeout:       100 * time.Millisecond,
+		HeartbeatInterval: 20 * time.Millisecond,
+		LenMsgLen:         2,
+		NewAgent:          func(c *TCPConn) Agent { return clientAgents.new(c) },
+	}
+	client.Start()
+	defer client.Close()
+	a, ca := agents.next(t), clientAgents.next(t)
+
+	// both sides stay alive on heartbeats alone
+	time.Sleep(300 * time.Millisecond)
+	if a.isClosed() || ca.isClosed() {
+		t.Fatal("connection closed despite the heartbeats")
+	}
+	if len(a.msgs) != 0 || len(ca.msgs) != 0 {
+		t.Fatal("heartbeat passed to an agent")
+	}
+}
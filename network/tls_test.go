@@ -0,0 +1,170 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM of the CA certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.key = ca.newKey()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.file = ca.write("ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return key
+}
+
+func (ca *testCA) write(name, blockType string, der []byte) string {
+	file := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return file
+}
+
+// issue creates the certificate of localhost and 127.0.0.1, it returns the certificate and key files.
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage) (string, string) {
+	key := ca.newKey()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".pem", "CERTIFICATE", der), ca.write(name+".key", "PRIVATE KEY", keyDER)
+}
+
+// startTLSClient connects a client, it returns the agents of its connections.
+func startTLSClient(t *testing.T, client *TCPClient) testAgents {
+	agents := make(testAgents, 10)
+	client.TLS = true
+	client.LenMsgLen = 2
+	client.ConnectInterval = 20 * time.Millisecond
+	client.NewAgent = func(c *TCPConn) Agent { return agents.new(c) }
+	client.Start()
+	t.Cleanup(client.Close)
+	return agents
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("server", x509.ExtKeyUsageServerAuth)
+	agents, addr := startTCP(t, &TCPServer{CertFile: certFile, KeyFile: keyFile})
+
+	clientAgents := startTLSClient(t, &TCPClient{Addr: addr, CAFile: ca.file, ServerName: "localhost"})
+	ca1 := clientAgents.next(t)
+	ca1.conn.WriteMsg([]byte("hello"))
+	a := agents.next(t)
+	if msg := a.next(t); string(msg) != "hello" {
+		t.Fatalf("message %q", msg)
+	}
+	a.conn.WriteMsg([]byte("world"))
+	if msg := ca1.next(t); string(msg) != "world" {
+		t.Fatalf("message %q", msg)
+	}
+
+	// the server certificate is not trusted without the CA
+	untrusted := startTLSClient(t, &TCPClient{Addr: addr, ServerName: "localhost"})
+	select {
+	case <-untrusted:
+		t.Fatal("connected to an untrusted server")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// nor for another name
+	wrongName := startTLSClient(t, &TCPClient{Addr: addr, CAFile: ca.file, ServerName: "example.com"})
+	select {
+	case <-wrongName:
+		t.Fatal("connected to a server of another name")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue("server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue("client", x509.ExtKeyUsageClientAuth)
+	agents, addr := startTCP(t, &TCPServer{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file})
+
+	// a client presenting a certificate of the CA is served
+	clientAgents := startTLSClient(t, &TCPClient{Addr: addr, CAFile: ca.file, ServerName: "localhost", CertFile: clientCert, KeyFile: clientKey})
+	clientAgents.next(t).conn.WriteMsg([]byte("hello"))
+	if msg := agents.next(t).next(t); string(msg) != "hello" {
+		t.Fatalf("message %q", msg)
+	}
+
+	// a client without certificate is refused by the server
+	anonymous := startTLSClient(t, &TCPClient{Addr: addr, CAFile: ca.file, ServerName: "localhost"})
+	select {
+	case c := <-anonymous:
+		c.conn.WriteMsg([]byte("hello"))
+	case <-time.After(100 * time.Millisecond):
+	}
+	a := agents.next(t)
+	a.waitClosed(t)
+	if len(a.msgs) != 0 {
+		t.Fatal("message received from a client without certificate")
+	}
+
+	// a certificate of another CA neither
+	other := newTestCA(t)
+	otherCert, otherKey := other.issue("client", x509.ExtKeyUsageClientAuth)
+	startTLSClient(t, &TCPClient{Addr: addr, CAFile: ca.file, ServerName: "localhost", CertFile: otherCert, KeyFile: otherKey})
+	a = agents.next(t)
+	a.waitClosed(t)
+	if len(a.msgs) != 0 {
+		t.Fatal("message received from a client of another CA")
+	}
+}
@@ -0,0 +1,393 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TransformOptions configures the per-message compression and encryption of the connections.
+// the transforms are negotiated by a handshake when the connection opens: the client asks, the server
+// accepts what it enables too. both peers must enable a transform for the handshake to take place.
+// the transformed message, up to 25 bytes longer, is limited by MaxMsgLen.
+type TransformOptions struct {
+	// messages of at least CompressThreshold bytes are compressed with flate, 0 disables compression
+	CompressThreshold int `conf:"min=0"`
+	// flate compression level, flate.DefaultCompression if 0
+	CompressLevel int `conf:"min=-2,max=9"`
+	// messages are encrypted with AES-GCM, keyed by an X25519 exchange. the exchange is not
+	// authenticated, TLS is required to defeat an active attacker
+	Encrypt bool
+	// the server refuses the clients not asking for encryption, the client the servers not accepting it
+	RequireEncrypt bool
+	// time allowed for the handshake, 10s if 0
+	HandshakeTimeout time.Duration `conf:"min=0"`
+}
+
+func (opts *TransformOptions) enabled() bool {
+	return opts.CompressThreshold > 0 || opts.Encrypt || opts.RequireEncrypt
+}
+
+func (opts *TransformOptions) flags() byte {
+	var flags byte
+	if opts.CompressThreshold > 0 {
+		flags |= transformCompress
+	}
+	if opts.Encrypt || opts.RequireEncrypt {
+		flags |= transformEncrypt
+	}
+	return flags
+}
+
+func (opts *TransformOptions) handshakeTimeout() time.Duration {
+	if opts.HandshakeTimeout > 0 {
+		return opts.HandshakeTimeout
+	}
+	return 10 * time.Second
+}
+
+// handshake messages: [magic][version][flags][X25519 public key if transformEncrypt]
+const (
+	transformMagic   = 0xA7
+	transformVersion = 1
+
+	transformCompress = 1 << 0
+	transformEncrypt  = 1 << 1
+)
+
+// msgConn is a connection before its pipeline is set.
+type msgConn interface {
+	ReadMsg() ([]byte, error)
+	WriteMsg(args ...[]byte) error
+}
+
+// negotiate runs the handshake on a connection and returns its pipeline, nil if no transform is accepted.
+func negotiate(conn msgConn, opts *TransformOptions, server bool, maxMsgLen uint32) (*pipeline, error) {
+	var priv *ecdh.PrivateKey
+	newHello := func(flags byte) ([]byte, error) {
+		hello := []byte{transformMagic, transformVersion, flags}
+		if flags&transformEncrypt == 0 {
+			return hello, nil
+		}
+		var err error
+		priv, err = ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return append(hello, priv.PublicKey().Bytes()...), nil
+	}
+
+	var flags byte
+	var clientPub, serverPub []byte
+	if server {
+		peer, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		peerFlags, pub, err := parseHello(peer)
+		if err != nil {
+			return nil, err
+		}
+		flags = peerFlags & opts.flags()
+		if opts.RequireEncrypt && flags&transformEncrypt == 0 {
+			return nil, errors.New("client does not ask for encryption")
+		}
+		hello, err := newHello(flags)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.WriteMsg(hello); err != nil {
+			return nil, err
+		}
+		clientPub, serverPub = pub, hello[3:]
+	} else {
+		hello, err := newHello(opts.flags())
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.WriteMsg(hello); err != nil {
+			return nil, err
+		}
+		peer, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		var pub []byte
+		flags, pub, err = parseHello(peer)
+		if err != nil {
+			return nil, err
+		}
+		if flags&^opts.flags() != 0 {
+			return nil, fmt.Errorf("server accepts transforms not asked: %#x", flags)
+		}
+		if opts.RequireEncrypt && flags&transformEncrypt == 0 {
+			return nil, errors.New("server does not accept encryption")
+		}
+		clientPub, serverPub = hello[3:], pub
+	}
+	if flags == 0 {
+		return nil, nil
+	}
+
+	p := &pipeline{maxMsgLen: maxMsgLen}
+	if flags&transformCompress != 0 {
+		p.stages = append(p.stages, newCompressor(opts.CompressThreshold, opts.CompressLevel, maxMsgLen))
+	}
+	if flags&transformEncrypt != 0 {
+		c, err := newEncryptor(priv, clientPub, serverPub, server)
+		if err != nil {
+			return nil, err
+		}
+		p.stages = append(p.stages, c)
+	}
+	return p, nil
+}
+
+func parseHello(b []byte) (flags byte, pub []byte, err error) {
+	if len(b) < 3 || b[0] != transformMagic {
+		return 0, nil, errors.New("invalid handshake message")
+	}
+	if b[1] != transformVersion {
+		return 0, nil, fmt.Errorf("unsupported handshake version %v", b[1])
+	}
+	flags = b[2]
+	if flags&transformEncrypt == 0 {
+		return flags, nil, nil
+	}
+	if len(b) != 3+32 {
+		return 0, nil, errors.New("invalid handshake public key")
+	}
+	return flags, b[3:], nil
+}
+
+// transform is a stage of a pipeline, e.g. compression or encryption. encode is called on the written
+// messages in order, decode on the read messages in order.
+type transform interface {
+	encode(msg []byte) ([]byte, error)
+	decode(msg []byte) ([]byte, error)
+}
+
+// pipeline transforms the messages of a connection: the written messages go through the stages in order,
+// the read messages in reverse order.
+type pipeline struct {
+	sync.Mutex // orders the writes, the encryption nonces follow the write order
+	stages     []transform
+	maxMsgLen  uint32
+}
+
+// encode merges the parts of a message and transforms it.
+// must be called with the lock held
+func (p *pipeline) encode(args [][]byte) ([]byte, error) {
+	var msgLen uint32
+	for _, arg := range args {
+		msgLen += uint32(len(arg))
+	}
+	if msgLen > p.maxMsgLen {
+		return nil, errors.New("message too long")
+	} else if msgLen < 1 {
+		return nil, errors.New("message too short")
+	}
+
+	msg := make([]byte, 0, msgLen)
+	for _, arg := range args {
+		msg = append(msg, arg...)
+	}
+	for _, stage := range p.stages {
+		var err error
+		if msg, err = stage.encode(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// decode restores a message read from the connection.
+// goroutine not safe, called by the reading goroutine only
+func (p *pipeline) decode(msg []byte) ([]byte, error) {
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		var err error
+		if msg, err = p.stages[i].decode(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// compressor compresses the messages of at least threshold bytes, a flag byte tells whether a message is compressed.
+type compressor struct {
+	threshold int
+	level     int
+	maxMsgLen uint32
+}
+
+const (
+	flagRaw        = 0
+	flagCompressed = 1
+)
+
+// flateWriters pools the flate writers by level, a writer allocates hundreds of KB.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+var flateReaders sync.Pool
+
+func newCompressor(threshold, level int, maxMsgLen uint32) *compressor {
+	if level == 0 || level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = flate.DefaultCompression
+	}
+	return &compressor{threshold: threshold, level: level, maxMsgLen: maxMsgLen}
+}
+
+func (c *compressor) encode(msg []byte) ([]byte, error) {
+	if len(msg) >= c.threshold {
+		var buf bytes.Buffer
+		buf.Grow(len(msg)/2 + 1)
+		buf.WriteByte(flagCompressed)
+
+		pool := &flateWriters[c.level-flate.HuffmanOnly]
+		w, _ := pool.Get().(*flate.Writer)
+		if w == nil {
+			var err error
+			if w, err = flate.NewWriter(&buf, c.level); err != nil {
+				return nil, err
+			}
+		} else {
+			w.Reset(&buf)
+		}
+		_, err := w.Write(msg)
+		if err == nil {
+			err = w.Close()
+		}
+		pool.Put(w)
+		if err != nil {
+			return nil, err
+		}
+		// incompressible messages are sent raw
+		if buf.Len() < len(msg)+1 {
+			return buf.Bytes(), nil
+		}
+	}
+
+	out := make([]byte, 1+len(msg))
+	out[0] = flagRaw
+	copy(out[1:], msg)
+	return out, nil
+}
+
+func (c *compressor) decode(msg []byte) ([]byte, error) {
+	if len(msg) < 1 {
+		return nil, errors.New("message too short")
+	}
+	switch msg[0] {
+	case flagRaw:
+		return msg[1:], nil
+	case flagCompressed:
+	default:
+		return nil, fmt.Errorf("invalid compression flag %v", msg[0])
+	}
+
+	r, _ := flateReaders.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(msg[1:]))
+	} else {
+		r.(flate.Resetter).Reset(bytes.NewReader(msg[1:]), nil)
+	}
+	defer flateReaders.Put(r)
+
+	// the limit stops the messages inflating beyond maxMsgLen
+	out, err := io.ReadAll(io.LimitReader(r, int64(c.maxMsgLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(out)) > c.maxMsgLen {
+		return nil, errors.New("message too long")
+	}
+	return out, nil
+}
+
+// encryptor seals the messages with AES-256-GCM, one key per direction. the nonce is a message counter
+// sent before the sealed message: the messages replayed or reordered fail to open, the messages dropped
+// by the backpressure policy do not.
+type encryptor struct {
+	seal, open           cipher.AEAD
+	sealNonce, openNonce uint64
+}
+
+func newEncryptor(priv *ecdh.PrivateKey, clientPub, serverPub []byte, server bool) (*encryptor, error) {
+	peerPub := serverPub
+	if server {
+		peerPub = clientPub
+	}
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := append(append([]byte(nil), clientPub...), serverPub...)
+	clientKey, err := newAEAD(secret, salt, "gserv client to server")
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := newAEAD(secret, salt, "gserv server to client")
+	if err != nil {
+		return nil, err
+	}
+	if server {
+		return &encryptor{seal: serverKey, open: clientKey}, nil
+	}
+	return &encryptor{seal: clientKey, open: serverKey}, nil
+}
+
+func newAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *encryptor) encode(msg []byte) ([]byte, error) {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], e.sealNonce)
+	e.sealNonce++
+	out := make([]byte, 8, 8+len(msg)+e.seal.Overhead())
+	copy(out, nonce[4:])
+	return e.seal.Seal(out, nonce[:], msg, nil), nil
+}
+
+func (e *encryptor) decode(msg []byte) ([]byte, error) {
+	if len(msg) < 8 {
+		return nil, errors.New("message too short")
+	}
+	var nonce [12]byte
+	copy(nonce[4:], msg[:8])
+	n := binary.BigEndian.Uint64(nonce[4:])
+	if n < e.openNonce {
+		return nil, errors.New("message replayed")
+	}
+	// a forged counter must not advance the next one
+	out, err := e.open.Open(nil, nonce[:], msg[8:], nil)
+	if err != nil {
+		return nil, err
+	}
+	e.openNonce = n + 1
+	return out, nil
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn is one end of an in-memory message connection.
+type pipeConn struct {
+	in, out chan []byte
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan []byte, 10), make(chan []byte, 10)
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+func (c *pipeConn) ReadMsg() ([]byte, error) {
+	select {
+	case msg := <-c.in:
+		return msg, nil
+	case <-time.After(time.Second):
+		return nil, errors.New("timeout")
+	}
+}
+
+func (c *pipeConn) WriteMsg(args ...[]byte) error {
+	c.out <- bytes.Join(args, nil)
+	return nil
+}
+
+// negotiatePair runs the handshake between a client and a server.
+func negotiatePair(t *testing.T, client, server TransformOptions) (*pipeline, *pipeline, error, error) {
+	t.Helper()
+	c, s := newPipe()
+	var sp *pipeline
+	var serr error
+	done := make(chan struct{})
+	go func() {
+		sp, serr = negotiate(s, &server, true, 4096)
+		close(done)
+	}()
+	cp, cerr := negotiate(c, &client, false, 4096)
+	<-done
+	return cp, sp, cerr, serr
+}
+
+func TestTransformRoundTrip(t *testing.T) {
+	opts := TransformOptions{CompressThreshold: 32, Encrypt: true}
+	cp, sp, cerr, serr := negotiatePair(t, opts, opts)
+	if cerr != nil || serr != nil || cp == nil || sp == nil {
+		t.Fatalf("negotiate: %v, %v", cerr, serr)
+	}
+
+	for _, msg := range [][]byte{[]byte("short"), bytes.Repeat([]byte("compressible "), 100)} {
+		// both directions
+		for _, p := range [][2]*pipeline{{cp, sp}, {sp, cp}} {
+			encoded, err := p[0].encode([][]byte{msg[:1], msg[1:]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(encoded, msg) {
+				t.Fatal("message sent in the clear")
+			}
+			if len(msg) > 100 && len(encoded) >= len(msg) {
+				t.Fatalf("%v bytes compressed to %v", len(msg), len(encoded))
+			}
+			decoded, err := p[1].decode(encoded)
+			if err != nil || !bytes.Equal(decoded, msg) {
+				t.Fatalf("decoded %q, %v", decoded, err)
+			}
+		}
+	}
+
+	if _, err := cp.encode([][]byte{make([]byte, 4097)}); err == nil {
+		t.Fatal("message above MaxMsgLen encoded")
+	}
+}
+
+func TestTransformNegotiation(t *testing.T) {
+	compress := TransformOptions{CompressThreshold: 32}
+	encrypt := TransformOptions{Encrypt: true}
+
+	// the server accepts what both enable
+	cp, sp, cerr, serr := negotiatePair(t, TransformOptions{CompressThreshold: 32, Encrypt: true}, compress)
+	if cerr != nil || serr != nil || len(cp.stages) != 1 || len(sp.stages) != 1 {
+		t.Fatalf("negotiate: %v, %v", cerr, serr)
+	}
+	if _, ok := cp.stages[0].(*compressor); !ok {
+		t.Fatalf("stage %T", cp.stages[0])
+	}
+
+	// nothing in common: no pipeline
+	cp, sp, cerr, serr = negotiatePair(t, encrypt, compress)
+	if cerr != nil || serr != nil || cp != nil || sp != nil {
+		t.Fatalf("negotiate: %v, %v, %v, %v", cp, sp, cerr, serr)
+	}
+
+	// encryption required by the server or the client
+	_, _, _, serr = negotiatePair(t, compress, TransformOptions{RequireEncrypt: true})
+	if serr == nil {
+		t.Fatal("server accepted a client without encryption")
+	}
+	_, _, cerr, _ = negotiatePair(t, TransformOptions{RequireEncrypt: true}, compress)
+	if cerr == nil {
+		t.Fatal("client accepted a server without encryption")
+	}
+
+	// invalid hellos
+	for _, hello := range [][]byte{{1, 2, 3}, {transformMagic, 9, 0}, {transformMagic, transformVersion, transformEncrypt, 1}} {
+		c, s := newPipe()
+		c.WriteMsg(hello)
+		if _, err := negotiate(s, &encrypt, true, 4096); err == nil {
+			t.Fatalf("hello %v accepted", hello)
+		}
+	}
+}
+
+func TestTransformTamper(t *testing.T) {
+	opts := TransformOptions{Encrypt: true}
+	cp, sp, cerr, serr := negotiatePair(t, opts, opts)
+	if cerr != nil || serr != nil {
+		t.Fatalf("negotiate: %v, %v", cerr, serr)
+	}
+	encode := func(s string) []byte {
+		msg, err := cp.encode([][]byte{[]byte(s)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	m1, m2, m3, m4 := encode("one"), encode("two"), encode("three"), encode("four")
+
+	// a message altered or forged does not open and does not disturb the next ones
+	for i := range m1 {
+		tampered := bytes.Clone(m1)
+		tampered[i] ^= 1
+		if _, err := sp.decode(tampered); err == nil {
+			t.Fatalf("message with byte %v altered opened", i)
+		}
+	}
+	forged := bytes.Clone(m2)
+	copy(forged, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if _, err := sp.decode(forged); err == nil {
+		t.Fatal("forged message opened")
+	}
+	if msg, err := sp.decode(m1); err != nil || string(msg) != "one" {
+		t.Fatalf("decoded %q, %v", msg, err)
+	}
+
+	// the messages replayed or reordered are refused, the messages skipped are not
+	if _, err := sp.decode(m1); err == nil {
+		t.Fatal("message replayed")
+	}
+	if msg, err := sp.decode(m3); err != nil || string(msg) != "three" {
+		t.Fatalf("decoded %q, %v", msg, err)
+	}
+	if _, err := sp.decode(m2); err == nil {
+		t.Fatal("message reordered")
+	}
+	if msg, err := sp.decode(m4); err != nil || string(msg) != "four" {
+		t.Fatalf("decoded %q, %v", msg, err)
+	}
+
+	// a message sealed for the other direction does not open
+	back, _ := sp.encode([][]byte{[]byte("back")})
+	if _, err := sp.decode(back); err == nil {
+		t.Fatal("reflected message opened")
+	}
+}
+
+func TestCompressorLimit(t *testing.T) {
+	c := newCompressor(1, flate.BestCompression, 1<<20)
+	bomb, err := c.encode(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a message inflating beyond MaxMsgLen is refused
+	small := newCompressor(1, 0, 1000)
+	if _, err := small.decode(bomb); err == nil {
+		t.Fatal("message above MaxMsgLen inflated")
+	}
+	if _, err := small.decode([]byte{7, 1}); err == nil {
+		t.Fatal("invalid flag accepted")
+	}
+	if msg, err := small.decode([]byte{flagRaw, 'a'}); err != nil || string(msg) != "a" {
+		t.Fatalf("decoded %q, %v", msg, err)
+	}
+}
+
+func TestTCPTransform(t *testing.T) {
+	opts := TransformOptions{CompressThreshold: 32, Encrypt: true}
+	agents, addr := startTCP(t, &TCPServer{Transform: opts})
+	clientAgents := make(testAgents, 10)
+	client := &TCPClient{Addr: addr, LenMsgLen: 2, Transform: opts, NewAgent: func(c *TCPConn) Agent { return clientAgents.new(c) }}
+	client.Start()
+	defer client.Close()
+	ca, a := clientAgents.next(t), agents.next(t)
+
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	ca.conn.WriteMsg(msg)
+	if got := a.next(t); !bytes.Equal(got, msg) {
+		t.Fatalf("message %q", got)
+	}
+	a.conn.WriteMsg([]byte("short"))
+	if got := ca.next(t); string(got) != "short" {
+		t.Fatalf("message %q", got)
+	}
+
+	// a client without the handshake is refused
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	writeFrame(t, conn, []byte("hello"))
+	expectNoAgent(t, agents)
+}
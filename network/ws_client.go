@@ -17,6 +17,10 @@ type WSClient struct {
 	PendingWriteNum  int
 	MaxMsgLen        uint32
 	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration    // closes a connection receiving no message, ping or pong for this long, 0 waits forever
+	WriteTimeout     time.Duration    // closes a connection whose write does not complete within this time, 0 waits forever
+	PingInterval     time.Duration    // interval of the pings sent to the server, 0 sends none
+	Transform        TransformOptions // per-message compression and encryption asked to the server
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
 	dialer           websocket.Dialer
@@ -107,7 +111,23 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
+	wsConn := newWSConn(conn, newWriteQueue(client.PendingWriteNum, nil, nil), client.MaxMsgLen, idleTimeouts{
+		read:      client.ReadTimeout,
+		write:     client.WriteTimeout,
+		heartbeat: client.PingInterval,
+	})
+	if err := wsConn.handshake(&client.Transform, false); err != nil {
+		logs.Error("handshake with %v failed: %v", client.Addr, err)
+		wsConn.Destroy()
+		client.Lock()
+		delete(client.conns, conn)
+		client.Unlock()
+		if client.AutoReconnect {
+			time.Sleep(client.ConnectInterval)
+			goto reconnect
+		}
+		return
+	}
 	agent := client.NewAgent(wsConn)
 	agent.Run()
 
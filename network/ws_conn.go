@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/yinyihanbing/gutils/logs"
@@ -15,27 +16,54 @@ type WebsocketConnSet map[*websocket.Conn]struct{}
 type WSConn struct {
 	sync.Mutex
 	conn           *websocket.Conn
-	writeChan      chan []byte
+	queue          *writeQueue
 	maxMsgLen      uint32
 	closeFlag      bool
 	remoteOriginIP net.Addr
+	idle           idleTimeouts  // idle.heartbeat is the ping interval, idle.echo enables empty heartbeat messages
+	done           chan struct{} // closed when the write goroutine exits
+	transform      *pipeline     // compression and encryption, nil if none is negotiated
 }
 
+// controlTimeout bounds the writes of ping and pong frames if no write timeout is set.
+const controlTimeout = 10 * time.Second
+
 // newWSConn creates a new WSConn instance.
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+func newWSConn(conn *websocket.Conn, queue *writeQueue, maxMsgLen uint32, idle idleTimeouts) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
-	wsConn.writeChan = make(chan []byte, pendingWriteNum)
+	wsConn.queue = queue
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.idle = idle
+	wsConn.done = make(chan struct{})
+
+	// pings and pongs keep the connection alive
+	conn.SetPongHandler(func(string) error {
+		wsConn.extendReadDeadline()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		wsConn.extendReadDeadline()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), wsConn.controlDeadline())
+		if _, ok := err.(net.Error); ok || err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
 
 	// Start a goroutine to handle write operations.
 	go func() {
-		for b := range wsConn.writeChan {
-			if b == nil {
+		defer close(wsConn.done)
+		for w := range queue.ch {
+			if w.b == nil {
 				break
 			}
+			queue.taken(&wsConn.Mutex)
 
-			err := conn.WriteMessage(websocket.BinaryMessage, b)
+			if idle.write > 0 {
+				conn.SetWriteDeadline(time.Now().Add(idle.write))
+			}
+			err := conn.WriteMessage(websocket.BinaryMessage, w.b)
 			if err != nil {
 				break
 			}
@@ -44,25 +72,78 @@ func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSC
 		conn.Close()
 		wsConn.Lock()
 		wsConn.closeFlag = true
+		queue.wake()
 		wsConn.Unlock()
 	}()
 
+	if idle.heartbeat > 0 {
+		go wsConn.sendPings()
+	}
+
 	return wsConn
 }
 
+// sendPings writes a ping every idle.heartbeat until the connection is closed.
+func (wsConn *WSConn) sendPings() {
+	t := time.NewTicker(wsConn.idle.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-wsConn.done:
+			return
+		case <-t.C:
+			if err := wsConn.conn.WriteControl(websocket.PingMessage, nil, wsConn.controlDeadline()); err != nil {
+				logs.Debug("write ping error: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// extendReadDeadline gives the peer idle.read to send the next message or control frame.
+func (wsConn *WSConn) extendReadDeadline() {
+	if wsConn.idle.read > 0 {
+		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.idle.read))
+	}
+}
+
+func (wsConn *WSConn) controlDeadline() time.Time {
+	if wsConn.idle.write > 0 {
+		return time.Now().Add(wsConn.idle.write)
+	}
+	return time.Now().Add(controlTimeout)
+}
+
 // SetOriginIP sets the remote origin IP address.
 func (wsConn *WSConn) SetOriginIP(ip net.Addr) {
 	wsConn.remoteOriginIP = ip
 }
 
+// handshake negotiates the transforms of the connection, see TransformOptions.
+// it is called before the agent is created
+func (wsConn *WSConn) handshake(opts *TransformOptions, server bool) error {
+	if !opts.enabled() {
+		return nil
+	}
+	wsConn.conn.SetReadDeadline(time.Now().Add(opts.handshakeTimeout()))
+	p, err := negotiate(wsConn, opts, server, wsConn.maxMsgLen)
+	wsConn.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	wsConn.transform = p
+	return nil
+}
+
 // doDestroy forcibly closes the connection and cleans up resources.
 func (wsConn *WSConn) doDestroy() {
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	setLinger0(wsConn.conn.UnderlyingConn())
 	wsConn.conn.Close()
 
 	if !wsConn.closeFlag {
-		close(wsConn.writeChan)
+		close(wsConn.queue.ch)
 		wsConn.closeFlag = true
+		wsConn.queue.wake()
 	}
 }
 
@@ -82,19 +163,16 @@ func (wsConn *WSConn) Close() {
 		return
 	}
 
-	wsConn.doWrite(nil)
+	wsConn.doWrite(writeBuf{})
 	wsConn.closeFlag = true
 }
 
-// doWrite writes data to the write channel or destroys the connection if the channel is full.
-func (wsConn *WSConn) doWrite(b []byte) {
-	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
+// doWrite writes data to the write channel, applying the backpressure policy if the channel is full.
+func (wsConn *WSConn) doWrite(w writeBuf) {
+	if !wsConn.queue.push(&wsConn.Mutex, &wsConn.closeFlag, w) {
 		logs.Debug("close conn: channel full")
 		wsConn.doDestroy()
-		return
 	}
-
-	wsConn.writeChan <- b
 }
 
 // LocalAddr returns the local address of the connection.
@@ -110,22 +188,63 @@ func (wsConn *WSConn) RemoteAddr() net.Addr {
 	return wsConn.conn.RemoteAddr()
 }
 
-// ReadMsg reads a message from the websocket connection.
+// ReadMsg reads a message from the websocket connection, empty heartbeat messages are answered and skipped.
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
-	_, b, err := wsConn.conn.ReadMessage()
-	return b, err
+	for {
+		wsConn.extendReadDeadline()
+		_, b, err := wsConn.conn.ReadMessage()
+		if err == nil && len(b) > 0 && wsConn.transform != nil {
+			return wsConn.transform.decode(b)
+		}
+		if err != nil || len(b) > 0 || !wsConn.idle.echo {
+			return b, err
+		}
+
+		wsConn.Lock()
+		if !wsConn.closeFlag {
+			wsConn.doWrite(writeBuf{b: []byte{}})
+		}
+		wsConn.Unlock()
+	}
 }
 
 // WriteMsg writes a message to the websocket connection.
 // args must not be modified by other goroutines
 func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
+	return wsConn.writeMsg(false, args)
+}
+
+// WriteDroppableMsg writes a message the WriteDropDroppable policy may drop, e.g. a position update
+// superseded by the next one.
+// args must not be modified by other goroutines
+func (wsConn *WSConn) WriteDroppableMsg(args ...[]byte) error {
+	return wsConn.writeMsg(true, args)
+}
+
+func (wsConn *WSConn) writeMsg(droppable bool, args [][]byte) error {
+	defer wsConn.queue.notify(wsConn)
+	// the pipeline lock is taken first, a blocked write releases the connection lock only
+	if wsConn.transform != nil {
+		wsConn.transform.Lock()
+		defer wsConn.transform.Unlock()
+	}
 	wsConn.Lock()
 	defer wsConn.Unlock()
 	if wsConn.closeFlag {
 		return nil
 	}
 
+	// the pipeline merges and checks the parts
+	if wsConn.transform != nil {
+		msg, err := wsConn.transform.encode(args)
+		if err != nil {
+			return err
+		}
+		wsConn.doWrite(writeBuf{b: msg, droppable: droppable})
+		return nil
+	}
+
 	// calculate total message length
 	var msgLen uint32
 	for _, arg := range args {
@@ -141,7 +260,7 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 
 	// write directly if there's only one argument
 	if len(args) == 1 {
-		wsConn.doWrite(args[0])
+		wsConn.doWrite(writeBuf{b: args[0], droppable: droppable})
 		return nil
 	}
 
@@ -153,7 +272,7 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 		l += len(arg)
 	}
 
-	wsConn.doWrite(msg)
+	wsConn.doWrite(writeBuf{b: msg, droppable: droppable})
 
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,6 +22,15 @@ type WSServer struct {
 	HTTPTimeout     time.Duration       // HTTP handshake timeout
 	CertFile        string              // TLS certificate file
 	KeyFile         string              // TLS key file
+	FlushTimeout    time.Duration       // max time Close waits for pending writes, 0 closes immediately
+	ReadTimeout     time.Duration       // connections receiving no message, ping or pong for this long are closed, 0 waits forever
+	WriteTimeout    time.Duration       // connections whose write does not complete within this time are closed, 0 waits forever
+	PingInterval    time.Duration       // interval of the pings sent to the clients, 0 sends none
+	Heartbeat       bool                // empty messages are heartbeats, answered and not passed to the agent, for clients that cannot send pings
+	Transform       TransformOptions    // per-message compression and encryption negotiated with each client
+	Backpressure    Backpressure        // policy applied when PendingWriteNum messages wait to be written, the connection is destroyed by default
+	IPFilter        *IPFilter           // per-IP limits and allow and deny lists checked on the address given by getRealIP, nil accepts every client
+	TrustedProxies  []string            // addresses or CIDRs of the reverse proxies whose X-Forwarded-For or X-Real-IP header gives the client address, the headers of other peers are ignored. breaking change: they used to be honoured from every peer, a server behind a reverse proxy must list it, otherwise all its clients get the proxy address and share its IPFilter quota
 	NewAgent        func(*WSConn) Agent // callback to create a new agent
 	ln              net.Listener        // network listener
 	handler         *WSHandler          // WebSocket handler
@@ -28,29 +38,82 @@ type WSServer struct {
 
 // WSHandler handles WebSocket connections and manages their lifecycle.
 type WSHandler struct {
-	maxConnNum      int                 // maximum number of connections
-	pendingWriteNum int                 // pending write queue length per connection
-	maxMsgLen       uint32              // maximum message length
-	newAgent        func(*WSConn) Agent // callback to create a new agent
-	upgrader        websocket.Upgrader  // WebSocket upgrader
-	conns           WebsocketConnSet    // set of active connections
-	mutexConns      sync.Mutex          // mutex for connection set
-	wg              sync.WaitGroup      // wait group for active connections
+	maxConnNum      int                         // maximum number of connections
+	pendingWriteNum int                         // pending write queue length per connection
+	maxMsgLen       uint32                      // maximum message length
+	idle            idleTimeouts                // idle detection of the connections
+	transform       TransformOptions            // transforms offered to the clients
+	backpressure    Backpressure                // policy of the write queues
+	ipFilter        *IPFilter                   // checks the client addresses
+	trustedProxies  []*net.IPNet                // peers whose forwarding headers are honoured
+	untrustedWarned atomic.Bool                 // a forwarding header of an untrusted peer was logged
+	writeStats      writeStats                  // outcomes of the writes finding a full queue
+	newAgent        func(*WSConn) Agent         // callback to create a new agent
+	upgrader        websocket.Upgrader          // WebSocket upgrader
+	conns           map[*websocket.Conn]*WSConn // set of active connections
+	mutexConns      sync.Mutex                  // mutex for connection set
+	wg              sync.WaitGroup              // wait group for active connections
 }
 
-// getRealIP extracts the real IP address from the HTTP request headers.
-func getRealIP(req *http.Request) net.Addr {
-	ip := req.Header.Get("x-forwarded-for")
-	if ip == "" {
-		ip = req.Header.Get("x-real-ip")
+// getRealIP returns the client address of a request, nil if it cannot be parsed. the X-Forwarded-For
+// and X-Real-IP headers are honoured only from the trusted proxies, X-Forwarded-For is read from the
+// right: the first address that is not of a trusted proxy is the client, any client can set the others.
+func getRealIP(req *http.Request, trusted []*net.IPNet) net.Addr {
+	ip := parseHostIP(req.RemoteAddr)
+	if ip == nil || !containsIP(trusted, ip) {
+		return ipAddr(ip)
 	}
-	if ip != "" {
-		ip = strings.Split(ip, ",")[0]
-	} else {
-		ip, _, _ = net.SplitHostPort(req.RemoteAddr)
+
+	if values := req.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip = parseHostIP(hops[i])
+			if ip == nil || !containsIP(trusted, ip) {
+				break
+			}
+		}
+	} else if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+		ip = parseHostIP(realIP)
+	}
+	return ipAddr(ip)
+}
+
+// warnUntrustedProxy logs once that a peer that is not a trusted proxy sent a forwarding header,
+// the address of a reverse proxy missing from TrustedProxies is used for all its clients.
+func (handler *WSHandler) warnUntrustedProxy(req *http.Request) {
+	if handler.untrustedWarned.Load() {
+		return
+	}
+	if req.Header.Get("X-Forwarded-For") == "" && req.Header.Get("X-Real-IP") == "" {
+		return
+	}
+	if ip := parseHostIP(req.RemoteAddr); ip != nil && containsIP(handler.trustedProxies, ip) {
+		return
+	}
+	if handler.untrustedWarned.CompareAndSwap(false, true) {
+		logs.Warn("forwarding header from %v ignored, add the reverse proxies to TrustedProxies, logged once", req.RemoteAddr)
+	}
+}
+
+// parseHostIP parses an address with or without port, it returns nil if invalid.
+func parseHostIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
 	}
-	q := net.ParseIP(ip)
-	return &net.IPAddr{IP: q}
+	return net.ParseIP(host)
+}
+
+// ipAddr returns the address of ip, nil if ip is nil.
+func ipAddr(ip net.IP) net.Addr {
+	if ip == nil {
+		return nil
+	}
+	return &net.IPAddr{IP: ip}
 }
 
 // ServeHTTP handles incoming WebSocket upgrade requests.
@@ -59,6 +122,24 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	handler.warnUntrustedProxy(r)
+	addr := getRealIP(r, handler.trustedProxies)
+	if addr == nil {
+		http.Error(w, "invalid client address", http.StatusBadRequest)
+		logs.Debug("connection from %v refused: invalid client address", r.RemoteAddr)
+		return
+	}
+	if err := handler.ipFilter.acquire(addr); err != nil {
+		code := http.StatusTooManyRequests
+		if err == errIPDenied {
+			code = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), code)
+		logs.Debug("connection from %v refused: %v", addr, err)
+		return
+	}
+	defer handler.ipFilter.release(addr)
+
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logs.Error("upgrade error: %v", err)
@@ -81,11 +162,19 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logs.Error("too many connections. conn num=%v, limit=%v", len(handler.conns), handler.maxConnNum)
 		return
 	}
-	handler.conns[conn] = struct{}{}
+	wsConn := newWSConn(conn, newWriteQueue(handler.pendingWriteNum, &handler.backpressure, &handler.writeStats), handler.maxMsgLen, handler.idle)
+	wsConn.SetOriginIP(addr)
+	handler.conns[conn] = wsConn
 	handler.mutexConns.Unlock()
 
-	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
-	wsConn.SetOriginIP(getRealIP(r))
+	if err := wsConn.handshake(&handler.transform, true); err != nil {
+		logs.Debug("handshake with %v failed: %v", wsConn.RemoteAddr(), err)
+		wsConn.Destroy()
+		handler.mutexConns.Lock()
+		delete(handler.conns, conn)
+		handler.mutexConns.Unlock()
+		return
+	}
 	agent := handler.newAgent(wsConn)
 	agent.Run()
 
@@ -123,6 +212,14 @@ func (server *WSServer) Start() {
 	if server.NewAgent == nil {
 		logs.Fatal("newagent callback must not be nil. please provide a valid function.")
 	}
+	if err := server.Backpressure.Validate(); err != nil {
+		logs.Fatal("invalid backpressure: %v", err)
+	}
+
+	trusted, err := parseCIDRs(server.TrustedProxies)
+	if err != nil {
+		logs.Fatal("invalid trustedproxies: %v", err)
+	}
 
 	if server.CertFile != "" || server.KeyFile != "" {
 		config := &tls.Config{NextProtos: []string{"http/1.1"}}
@@ -140,7 +237,17 @@ func (server *WSServer) Start() {
 		pendingWriteNum: server.PendingWriteNum,
 		maxMsgLen:       server.MaxMsgLen,
 		newAgent:        server.NewAgent,
-		conns:           make(WebsocketConnSet),
+		transform:       server.Transform,
+		backpressure:    server.Backpressure,
+		ipFilter:        server.IPFilter,
+		trustedProxies:  trusted,
+		conns:           make(map[*websocket.Conn]*WSConn),
+		idle: idleTimeouts{
+			read:      server.ReadTimeout,
+			write:     server.WriteTimeout,
+			heartbeat: server.PingInterval,
+			echo:      server.Heartbeat,
+		},
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: server.HTTPTimeout,
 			CheckOrigin:      func(_ *http.Request) bool { return true },
@@ -155,12 +262,55 @@ func (server *WSServer) Start() {
 		MaxHeaderBytes: 1024,
 	}
 
+	server.IPFilter.attach(server.Addr)
 	go httpServer.Serve(ln)
 }
 
+// SetMaxConnNum changes the connection limit, active connections above the new limit are kept.
+func (server *WSServer) SetMaxConnNum(n int) {
+	server.handler.mutexConns.Lock()
+	server.MaxConnNum = n
+	server.handler.maxConnNum = n
+	server.handler.mutexConns.Unlock()
+}
+
+// SetPendingWriteNum changes the write queue length of the connections accepted from now on.
+func (server *WSServer) SetPendingWriteNum(n int) {
+	server.handler.mutexConns.Lock()
+	server.PendingWriteNum = n
+	server.handler.pendingWriteNum = n
+	server.handler.mutexConns.Unlock()
+}
+
+// WriteStats returns the outcomes of the writes finding a full queue.
+// goroutine safe
+func (server *WSServer) WriteStats() WriteStats {
+	return server.handler.writeStats.load()
+}
+
+// StopAccept closes the listener so no new connections are accepted, active connections are kept.
+func (server *WSServer) StopAccept() {
+	server.ln.Close()
+}
+
 // Close gracefully shuts down the WebSocket server and closes all active connections.
 func (server *WSServer) Close() {
-	server.ln.Close()
+	server.StopAccept()
+
+	// let active connections flush their pending writes
+	if server.FlushTimeout > 0 {
+		server.handler.mutexConns.Lock()
+		for _, wsConn := range server.handler.conns {
+			wsConn.Close()
+		}
+		server.handler.mutexConns.Unlock()
+
+		if !waitTimeout(&server.handler.wg, server.FlushTimeout) {
+			server.handler.mutexConns.Lock()
+			logs.Error("flush timeout. %v connections still open, addr=%v", len(server.handler.conns), server.Addr)
+			server.handler.mutexConns.Unlock()
+		}
+	}
 
 	server.handler.mutexConns.Lock()
 	for conn := range server.handler.conns {
@@ -170,4 +320,5 @@ func (server *WSServer) Close() {
 	server.handler.mutexConns.Unlock()
 
 	server.handler.wg.Wait()
+	server.IPFilter.detach(server.Addr)
 }
@@ -0,0 +1,195 @@
+package network
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWS starts a websocket server on a free port.
+func startWS(t *testing.T, server *WSServer) (testAgents, string) {
+	agents := make(testAgents, 10)
+	server.Addr = "127.0.0.1:0"
+	server.NewAgent = func(c *WSConn) Agent { return agents.new(c) }
+	server.Start()
+	t.Cleanup(server.Close)
+	return agents, "ws://" + server.ln.Addr().String()
+}
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWSPing(t *testing.T) {
+	agents, url := startWS(t, &WSServer{ReadTimeout: 100 * time.Millisecond, PingInterval: 20 * time.Millisecond})
+
+	// a client reading answers the pings and stays connected
+	conn := dialWS(t, url)
+	a := agents.next(t)
+	pings := make(chan struct{}, 100)
+	conn.SetPingHandler(func(data string) error {
+		pings <- struct{}{}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if a.isClosed() {
+		t.Fatal("connection answering the pings closed")
+	}
+	if len(pings) < 5 {
+		t.Fatalf("%v pings in 300ms", len(pings))
+	}
+
+	// a client not answering is closed after ReadTimeout
+	dialWS(t, url)
+	agents.next(t).waitClosed(t)
+}
+
+func TestWSHeartbeat(t *testing.T) {
+	agents, url := startWS(t, &WSServer{Heartbeat: true})
+	conn := dialWS(t, url)
+	a := agents.next(t)
+
+	// empty messages are answered and not passed to the agent
+	if err := conn.WriteMessage(websocket.BinaryMessage, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || len(msg) != 0 {
+		t.Fatalf("heartbeat answer %v, %v", msg, err)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, []byte("abc"))
+	if msg := a.next(t); string(msg) != "abc" {
+		t.Fatalf("message %q", msg)
+	}
+}
+
+func TestGetRealIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote string
+		header http.Header
+		want   string
+	}{
+		// the headers of other peers are ignored
+		{"192.0.2.1:1000", nil, "192.0.2.1"},
+		{"192.0.2.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"192.0.2.1:1000", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "192.0.2.1"},
+		// a trusted proxy gives the client
+		{"10.0.0.1:1000", nil, "10.0.0.1"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"[::1]:1000", http.Header{"X-Forwarded-For": {"198.51.100.1:5000"}}, "198.51.100.1"},
+		{"10.0.0.1:1000", http.Header{"X-Real-Ip": {"2001:db8::1"}}, "2001:db8::1"},
+		// the addresses a client prepends are skipped
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.1, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"203.0.113.1", "198.51.100.1"}}, "198.51.100.1"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		// invalid addresses
+		{"pipe", nil, "<nil>"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}}, "<nil>"},
+		{"10.0.0.1:1000", http.Header{"X-Real-Ip": {"unknown"}}, "<nil>"},
+	} {
+		req := &http.Request{RemoteAddr: c.remote, Header: c.header}
+		if addr := getRealIP(req, trusted); fmt.Sprint(addr) != c.want {
+			t.Fatalf("%v %v: %v, want %v", c.remote, c.header, addr, c.want)
+		}
+	}
+	// no typed nil
+	if addr := getRealIP(&http.Request{RemoteAddr: "pipe"}, nil); addr != nil {
+		t.Fatalf("address %#v", addr)
+	}
+}
+
+func TestWarnUntrustedProxy(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	handler := &WSHandler{trustedProxies: trusted}
+	warn := func(remote string, header http.Header) bool {
+		handler.warnUntrustedProxy(&http.Request{RemoteAddr: remote, Header: header})
+		return handler.untrustedWarned.Load()
+	}
+
+	// the headers of the trusted proxies and the requests without header are fine
+	if warn("10.0.0.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}) || warn("192.0.2.1:1000", nil) {
+		t.Fatal("warned without an untrusted header")
+	}
+	if !warn("192.0.2.1:1000", http.Header{"X-Real-Ip": {"198.51.100.1"}}) {
+		t.Fatal("untrusted header not warned")
+	}
+	if !warn("pipe", http.Header{"X-Forwarded-For": {"198.51.100.1"}}) {
+		t.Fatal("warning reset")
+	}
+}
+
+func TestWSIPFilter(t *testing.T) {
+	filter, err := NewIPFilter(IPFilterOptions{MaxConnPerIP: 1, Deny: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, url := startWS(t, &WSServer{IPFilter: filter, TrustedProxies: []string{"127.0.0.1"}})
+	dial := func(forwardedFor string) (*websocket.Conn, int) {
+		t.Helper()
+		header := http.Header{}
+		if forwardedFor != "" {
+			header.Set("X-Forwarded-For", forwardedFor)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+
+	// the limits are per client behind the proxy
+	dial("198.51.100.1")
+	a := agents.next(t)
+	if addr := a.conn.RemoteAddr().String(); addr != "198.51.100.1" {
+		t.Fatalf("remote address %v", addr)
+	}
+	if _, code := dial("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("status %v", code)
+	}
+	dial("198.51.100.2")
+	agents.next(t)
+	if _, code := dial("192.0.2.1"); code != http.StatusForbidden {
+		t.Fatalf("status %v", code)
+	}
+	if _, code := dial("unknown"); code != http.StatusBadRequest {
+		t.Fatalf("status %v", code)
+	}
+	if s := filter.Stats(); s != (IPFilterStats{Denied: 1, ConnLimited: 1}) {
+		t.Fatalf("stats %v", s)
+	}
+
+	// a client not behind a trusted proxy cannot choose its address
+	agents, url = startWS(t, &WSServer{IPFilter: filter})
+	dial("198.51.100.3")
+	a = agents.next(t)
+	if addr := a.conn.RemoteAddr().String(); addr != "127.0.0.1" {
+		t.Fatalf("remote address %v", addr)
+	}
+	if _, code := dial("198.51.100.4"); code != http.StatusTooManyRequests {
+		t.Fatalf("status %v", code)
+	}
+}
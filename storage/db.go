@@ -9,6 +9,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/yinyihanbing/gserv/conf"
 	"github.com/yinyihanbing/gutils"
 	"github.com/yinyihanbing/gutils/logs"
 )
@@ -24,15 +25,30 @@ type DbCli struct {
 
 // DbConfig holds the configuration for database connection.
 type DbConfig struct {
-	StrAddr         string
-	ConnMaxLifetime time.Duration
-	MaxOpenConns    int
-	MaxIdleConns    int
-
-	QueueType        DbQueueType
-	QueueRedisCliIdx int
-	QueueDbCliIdx    int
-	QueueLimitCount  int
+	StrAddr         string        `conf:"required,secret"`
+	ConnMaxLifetime time.Duration `conf:"min=0"`
+	MaxOpenConns    int           `conf:"min=0"`
+	MaxIdleConns    int           `conf:"min=0"`
+
+	QueueType        DbQueueType `conf:"min=0,max=2"`
+	QueueRedisCliIdx int         `conf:"min=0"`
+	QueueDbCliIdx    int         `conf:"min=0"`
+	QueueLimitCount  int         `conf:"min=0,hot"` // applied to the running memory queue by OnReload
+}
+
+// OnReload applies the reloaded QueueLimitCount to the queue of the clients created with cfg,
+// it is called by conf.Reload.
+func (cfg *DbConfig) OnReload(changes []conf.Change) {
+	for _, c := range changes {
+		if c.Field != "QueueLimitCount" {
+			continue
+		}
+		for _, dbCli := range storage.dbClis {
+			if dbCli.config == cfg {
+				dbCli.dbQueue.SetQueueLimitCount(c.New.(int))
+			}
+		}
+	}
 }
 
 // newDbCli initializes a new database client with the given configuration.
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -22,12 +23,16 @@ const (
 
 // DbQueue represents a database write queue
 type DbQueue struct {
-	QueueType        DbQueueType // queue type
-	QueueLimitCount  int         // max number of sql in queue, blocks if exceeded
-	QueueRedisCliIdx int         // redis connection pool index
-	QueueDbCliIdx    int         // db connection pool index
-	RedisQueueKey    string      // redis queue key
-	chanSql          chan string
+	QueueType        DbQueueType  // queue type
+	QueueLimitCount  int          // max number of sql in the memory queue when created, blocks if exceeded, see SetQueueLimitCount
+	QueueRedisCliIdx int          // redis connection pool index
+	QueueDbCliIdx    int          // db connection pool index
+	RedisQueueKey    string       // redis queue key
+	limit            atomic.Int64 // max number of sql in the memory queue in force
+	memLock          sync.Mutex
+	memCond          *sync.Cond // signalled when sql is added or taken, or the limit changes
+	memSql           []string   // memory queue, guarded by memLock
+	memClosed        bool       // the memory queue is drained and stopped, guarded by memLock
 	wg               sync.WaitGroup
 	closeFlag        bool
 	lock             sync.Mutex
@@ -51,10 +56,10 @@ func NewDbQueue(queueType DbQueueType, redisCliIdx int, dbCliIdx int, queueLimit
 	dbQueue.QueueRedisCliIdx = redisCliIdx
 	dbQueue.Dcr = new(DbQueueDcr)
 	dbQueue.timerHelper = gutils.NewTimerHelper()
+	dbQueue.memCond = sync.NewCond(&dbQueue.memLock)
+	dbQueue.SetQueueLimitCount(queueLimitCount)
 
 	switch queueType {
-	case DbQueueTypeMemory:
-		dbQueue.chanSql = make(chan string, dbQueue.QueueLimitCount)
 	case DbQueueTypeRedis:
 		dbQueue.RedisQueueKey = fmt.Sprintf("db_queue_%v", dbCliIdx)
 	}
@@ -71,7 +76,19 @@ func (dq *DbQueue) PutToQueue(strSql string) {
 
 	switch dq.QueueType {
 	case DbQueueTypeMemory:
-		dq.chanSql <- strSql
+		dq.memLock.Lock()
+		// a queue stopping takes the sql at once, it is drained before Destroy returns
+		for int64(len(dq.memSql)) >= dq.limit.Load() && !dq.closeFlag {
+			dq.memCond.Wait()
+		}
+		if dq.memClosed {
+			dq.memLock.Unlock()
+			logs.Error("cannot put in queue! db queue stopped, db idx=%v, sql=%v", dq.QueueDbCliIdx, strSql)
+			return
+		}
+		dq.memSql = append(dq.memSql, strSql)
+		dq.memCond.Broadcast()
+		dq.memLock.Unlock()
 		// increment put count
 		dq.Dcr.PutCount += 1
 		logs.Debug("put sql to memory queue: %v", strSql)
@@ -108,8 +125,9 @@ func (dq *DbQueue) startMemoryQueueTask() {
 	dq.wg.Add(1)
 	defer dq.wg.Done()
 
-	for strSql := range dq.chanSql {
-		if strSql == "" && len(dq.chanSql) == 0 {
+	for {
+		strSql, ok := dq.takeMemSql()
+		if !ok {
 			logs.Info("closed memory queue successfully, dbCliIdx: [%v]", dq.QueueDbCliIdx)
 			return
 		}
@@ -124,6 +142,41 @@ func (dq *DbQueue) startMemoryQueueTask() {
 	}
 }
 
+// takeMemSql waits for the next sql of the memory queue, it returns false once the queue is
+// stopping and drained.
+func (dq *DbQueue) takeMemSql() (string, bool) {
+	dq.memLock.Lock()
+	defer dq.memLock.Unlock()
+
+	for len(dq.memSql) == 0 && !dq.closeFlag {
+		dq.memCond.Wait()
+	}
+	if len(dq.memSql) == 0 {
+		dq.memClosed = true
+		return "", false
+	}
+	strSql := dq.memSql[0]
+	dq.memSql[0] = ""
+	dq.memSql = dq.memSql[1:]
+	dq.memCond.Broadcast()
+	return strSql, true
+}
+
+// SetQueueLimitCount changes the max number of sql in the memory queue, at least 1. the sql
+// already queued are kept, the puts wait until the queue is below the new limit.
+// goroutine safe
+func (dq *DbQueue) SetQueueLimitCount(n int) {
+	dq.limit.Store(int64(max(1, n)))
+	dq.memLock.Lock()
+	dq.memCond.Broadcast()
+	dq.memLock.Unlock()
+}
+
+// GetQueueLimitCount returns the max number of sql in the memory queue in force.
+func (dq *DbQueue) GetQueueLimitCount() int {
+	return int(dq.limit.Load())
+}
+
 // startRedisQueueTask processes the redis queue
 func (dq *DbQueue) startRedisQueueTask() {
 	defer dq.PanicError()
@@ -177,11 +230,13 @@ func (dq *DbQueue) Destroy() {
 	defer dq.lock.Unlock()
 
 	if !dq.closeFlag {
+		dq.memLock.Lock()
 		dq.closeFlag = true
+		dq.memCond.Broadcast()
+		dq.memLock.Unlock()
 
 		switch dq.QueueType {
 		case DbQueueTypeMemory:
-			dq.chanSql <- ""
 			logs.Info("waiting for memory queue to close... dbCliIdx: [%v], count=%v", dq.QueueDbCliIdx, dq.GetQueueCount())
 			dq.wg.Wait()
 		case DbQueueTypeRedis:
@@ -198,7 +253,9 @@ func (dq *DbQueue) Destroy() {
 func (dq *DbQueue) GetQueueCount() int64 {
 	switch dq.QueueType {
 	case DbQueueTypeMemory:
-		return int64(len(dq.chanSql))
+		dq.memLock.Lock()
+		defer dq.memLock.Unlock()
+		return int64(len(dq.memSql))
 	case DbQueueTypeRedis:
 		count, err := GetRedisCliExt(dq.QueueRedisCliIdx).DoLLen(dq.RedisQueueKey)
 		if err != nil {
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yinyihanbing/gserv/conf"
+)
+
+// putAsync puts sql from another goroutine, the channel is closed once it is queued.
+func putAsync(dq *DbQueue, strSql string) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		dq.PutToQueue(strSql)
+		close(done)
+	}()
+	return done
+}
+
+func expectBlocked(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatal("put not blocked by the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectQueued(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("put still blocked")
+	}
+}
+
+func TestDbQueueLimit(t *testing.T) {
+	dq := NewDbQueue(DbQueueTypeMemory, 0, 0, 2)
+	defer dq.Destroy()
+	dq.PutToQueue("a")
+	dq.PutToQueue("b")
+	done := putAsync(dq, "c")
+	expectBlocked(t, done)
+
+	// a raised limit lets the waiting puts in
+	dq.SetQueueLimitCount(3)
+	expectQueued(t, done)
+	if n := dq.GetQueueCount(); n != 3 {
+		t.Fatalf("queue count %v", n)
+	}
+
+	// a lowered limit keeps the queued sql, the puts wait until the queue is below it
+	dq.SetQueueLimitCount(1)
+	done = putAsync(dq, "d")
+	for _, want := range []string{"a", "b"} {
+		if strSql, _ := dq.takeMemSql(); strSql != want {
+			t.Fatalf("sql %q, want %q", strSql, want)
+		}
+		expectBlocked(t, done)
+	}
+	dq.takeMemSql()
+	expectQueued(t, done)
+	if strSql, _ := dq.takeMemSql(); strSql != "d" {
+		t.Fatalf("sql %q", strSql)
+	}
+
+	// the limit is at least 1
+	dq.SetQueueLimitCount(0)
+	if n := dq.GetQueueLimitCount(); n != 1 {
+		t.Fatalf("limit %v", n)
+	}
+}
+
+func TestDbQueueDestroy(t *testing.T) {
+	dq := NewDbQueue(DbQueueTypeMemory, 0, 0, 1)
+	dq.PutToQueue("a")
+	done := putAsync(dq, "b")
+	expectBlocked(t, done)
+
+	// the puts waiting are queued and drained, not lost
+	dq.Destroy()
+	expectQueued(t, done)
+	for _, want := range []string{"a", "b"} {
+		if strSql, ok := dq.takeMemSql(); !ok || strSql != want {
+			t.Fatalf("sql %q, %v, want %q", strSql, ok, want)
+		}
+	}
+	if _, ok := dq.takeMemSql(); ok {
+		t.Fatal("stopped queue not drained")
+	}
+}
+
+func TestDbQueueReload(t *testing.T) {
+	bindConfig()
+	cfg := &dbCfg
+	path := filepath.Join(t.TempDir(), "server.json")
+	write := func(limit string) {
+		data := `{"redis": {"StrAddr": "127.0.0.1:6379"}, "db": {"StrAddr": "db", "QueueType": 1, "QueueLimitCount": ` + limit + `}}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("2")
+	if err := conf.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	dq := NewDbQueue(cfg.QueueType, 0, 0, cfg.QueueLimitCount)
+	defer dq.Destroy()
+	storage.dbClis[100] = &DbCli{config: cfg, dbQueue: dq}
+	defer delete(storage.dbClis, 100)
+
+	// the limit is changed without a restart
+	write("3")
+	changes, err := conf.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Field != "QueueLimitCount" || !changes[0].Hot {
+		t.Fatalf("changes %v", changes)
+	}
+	if n := dq.GetQueueLimitCount(); n != 3 {
+		t.Fatalf("limit %v", n)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		dq.PutToQueue(s)
+	}
+	expectBlocked(t, putAsync(dq, "d"))
+}
@@ -18,13 +18,13 @@ type RedisCli struct {
 }
 
 type RedisConfig struct {
-	StrAddr     string        // redis connection string
-	StrPwd      string        // redis password
-	MaxIdle     int           // max idle connections
-	MaxActive   int           // max active connections, 0 means no limit
-	IdleTimeout time.Duration // max idle timeout in seconds
+	StrAddr     string        `conf:"required"` // redis connection string
+	StrPwd      string        `conf:"secret"`   // redis password
+	MaxIdle     int           `conf:"min=0"`    // max idle connections
+	MaxActive   int           `conf:"min=0"`    // max active connections, 0 means no limit
+	IdleTimeout time.Duration `conf:"min=0"`    // max idle timeout in seconds
 	Wait        bool          // block when max connections are reached
-	DB          int           // redis database index, default is 0
+	DB          int           `conf:"min=0"` // redis database index, default is 0
 }
 
 // getPrtSliceKV retrieves the reflect.Kind and reflect.Value of a slice pointer.
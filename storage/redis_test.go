@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/yinyihanbing/gserv/conf"
+)
+
+var (
+	bindOnce sync.Once
+	redisCfg RedisConfig
+	dbCfg    DbConfig
+)
+
+// bindConfig binds the sections of the tests once, the conf bindings are process wide.
+func bindConfig() {
+	bindOnce.Do(func() {
+		conf.Bind("redis", &redisCfg)
+		conf.Bind("db", &dbCfg)
+	})
+}
+
+func TestRedisConfig(t *testing.T) {
+	bindConfig()
+
+	// redis servers may be configured with more than 16 databases
+	if err := conf.LoadBytes([]byte(`{"redis": {"StrAddr": "127.0.0.1:6379", "DB": 32}, "db": {"StrAddr": "db"}}`), "json"); err != nil {
+		t.Fatal(err)
+	}
+	if redisCfg.DB != 32 {
+		t.Fatalf("DB = %v, want 32", redisCfg.DB)
+	}
+	if err := conf.LoadBytes([]byte(`{"redis": {"StrAddr": "127.0.0.1:6379", "DB": -1}, "db": {"StrAddr": "db"}}`), "json"); err == nil {
+		t.Fatal("negative DB accepted")
+	}
+}
@@ -44,6 +44,11 @@ func Destroy() {
 	storage.Destroy()
 }
 
+// describe the work left in the db queues, used for shutdown diagnostics
+func Pending() string {
+	return fmt.Sprintf("db queue tasks=%v", GetDbQueueTaskCount())
+}
+
 // add a redis client with a specific index
 func AddRedisCli(redisCliIdx int, redisCfg *RedisConfig) error {
 	if _, ok := storage.redisClis[redisCliIdx]; ok {